@@ -12,20 +12,55 @@ import (
 const configFile = "config.json"
 
 type Config struct {
-	Account        string    `json:"account"`        // 登入用户名
-	Password       string    `json:"password"`       // 登入密码
-	Title          string    `json:"title"`          // 自定义标题
-	WsPath         string    `json:"wspath"`         // 默认监听裸端点
-	Port           string    `json:"port"`           // WebUI端口
-	UseHttps       bool      `json:"useHttps"`       // 使用 https
-	StoreMsgs      bool      `json:"storeMsgs"`      // 储存每条信息 用于详细分析
-	PrintLogs      bool      `json:"printLogs"`      // 输出日志开关
-	Cert           string    `json:"cert"`           // 证书
-	Key            string    `json:"key"`            // 密钥
-	EnableWSServer bool      `json:"enableWsServer"` // 是否启用正向WS服务器
-	WSServerToken  string    `json:"wsServerToken"`  // 正向WS的Token
-	ApisInfos      []Apis    `json:"apis"`           // api信息数组
-	BotInfos       []BotInfo `json:"botInfos"`       // 机器人信息数组
+	Account           string     `json:"account"`           // 登入用户名
+	Password          string     `json:"password"`          // 登入密码
+	Title             string     `json:"title"`             // 自定义标题
+	WsPath            string     `json:"wspath"`            // 默认监听裸端点
+	Port              string     `json:"port"`              // WebUI端口
+	UseHttps          bool       `json:"useHttps"`          // 使用 https
+	StoreMsgs         bool       `json:"storeMsgs"`         // 储存每条信息 用于详细分析
+	PrintLogs         bool       `json:"printLogs"`         // 输出日志开关
+	Cert              string     `json:"cert"`              // 证书
+	Key               string     `json:"key"`               // 密钥
+	EnableWSServer    bool       `json:"enableWsServer"`    // 是否启用正向WS服务器
+	WSServerToken     string     `json:"wsServerToken"`     // 正向WS的Token
+	HttpPostPath      string     `json:"httpPostPath"`      // 接收onebot http上报的路径
+	HttpPostSecret    string     `json:"httpPostSecret"`    // http上报的secret 用于校验X-Signature 可空
+	ApisInfos         []Apis     `json:"apis"`              // api信息数组
+	BotInfos          []BotInfo  `json:"botInfos"`          // 机器人信息数组
+	WsClients         []WsClient `json:"wsClients"`         // 主动连接的onebot正向ws地址数组
+	RelayURL          string     `json:"relayUrl"`          // 中继模式 机器人连接后面板以反向ws连接到该地址的应用端 空为关闭
+	RelayToken        string     `json:"relayToken"`        // 连接应用端使用的access_token 可空
+	Capture           bool       `json:"capture"`           // 将收发的原始帧按天存档为jsonl 用于排查问题
+	CaptureDir        string     `json:"captureDir"`        // 存档目录
+	CaptureGzip       bool       `json:"captureGzip"`       // 存档使用gzip压缩
+	CaptureSelfIDs    []string   `json:"captureSelfIds"`    // 只存档这些机器人的帧 为空时存档全部
+	CaptureMaxFileMB  int        `json:"captureMaxFileMb"`  // 单个存档文件的大小上限 超出后写入新文件
+	CaptureMaxTotalMB int        `json:"captureMaxTotalMb"` // 存档目录的总大小上限 超出后删除最早的文件
+	WriteQueueSize    int        `json:"writeQueueSize"`    // 等待写入数据库的事件队列长度
+	WriteBatchSize    int        `json:"writeBatchSize"`    // 攒够多少个事件写入一次
+	WriteFlushMs      int        `json:"writeFlushMs"`      // 最长多少毫秒写入一次
+	WriteDropWhenFull bool       `json:"writeDropWhenFull"` // 队列已满时丢弃新事件 默认等待队列腾出空间
+	Storage           string     `json:"storage"`           // 数据储存方式 sqlite或memory memory不落盘 重启后数据丢失
+	RetainRawDays     int        `json:"retainRawDays"`     // 收发的原始消息和通知明细保留天数 -1为永久保留
+	RetainDailyDays   int        `json:"retainDailyDays"`   // 每日汇总 机器人每日状态 加群请求和连接会话保留天数 -1为永久保留
+	PruneIntervalMin  int        `json:"pruneInterval"`     // 清理过期数据和过期cookie的间隔 单位分钟
+	Timezone          string     `json:"timezone"`          // 统计日期和小时使用的时区 默认Local为系统时区 可设为Asia/Shanghai等
+
+	// 从消息中提取指令名的规则 按selfId对应机器人 selfId为空的规则用于其他机器人
+	// 不是指令的消息计为闲聊 规则为空数组时每条消息去掉开头的@和回复后的第一个词都计为指令
+	CommandRules []CommandRule `json:"commandRules"`
+}
+
+// CommandRule 一个机器人的指令提取规则 修改后可用recompute-commands重新统计已储存的消息
+type CommandRule struct {
+	SelfID      string            `json:"selfId"`      // 适用的机器人 空为默认规则
+	Prefixes    []string          `json:"prefixes"`    // 指令前缀 如/和# 不为空时没有前缀的消息不计为指令 指令名不含前缀
+	Patterns    []string          `json:"patterns"`    // 正则表达式 优先于前缀匹配 有捕获组时第一个捕获组为指令名 否则为整个匹配
+	Commands    []string          `json:"commands"`    // 不带前缀也计为指令的指令名 如签到 在别名转换后比较 只设置它时其他消息都是闲聊
+	Aliases     map[string]string `json:"aliases"`     // 别名对应的指令名 如"帮助":"help"
+	Ignore      []string          `json:"ignore"`      // 不计为指令的名称 在别名转换后比较
+	KeepLeading bool              `json:"keepLeading"` // 保留开头的@和回复 默认去掉后再提取
 }
 
 type BotInfo struct {
@@ -34,6 +69,12 @@ type BotInfo struct {
 	BotHead     string `json:"botHead"`     // 机器人的头像链接
 }
 
+// 面板作为ws客户端 主动连接到onebot实现开放的正向ws
+type WsClient struct {
+	URL         string `json:"url"`         // 正向ws地址 例如ws://127.0.0.1:8080
+	AccessToken string `json:"accessToken"` // 正向ws的access_token 可空
+}
+
 type Apis struct {
 	APIPaths string `json:"apiPaths"` // API地址 检测存活
 	APINames string `json:"apiNames"` // API名称 一一对应
@@ -41,18 +82,36 @@ type Apis struct {
 
 // 默认配置
 var defaultConfig = Config{
-	UseHttps:       false,
-	StoreMsgs:      true,
-	PrintLogs:      true,
-	Cert:           "",
-	Key:            "",
-	Account:        "admin",
-	Password:       "admin",
-	Title:          "",
-	WsPath:         "nil",
-	Port:           "18630",
-	EnableWSServer: true,
-	WSServerToken:  "",
+	UseHttps:          false,
+	StoreMsgs:         true,
+	PrintLogs:         true,
+	Cert:              "",
+	Key:               "",
+	Account:           "admin",
+	Password:          "admin",
+	Title:             "",
+	WsPath:            "nil",
+	Port:              "18630",
+	EnableWSServer:    true,
+	WSServerToken:     "",
+	HttpPostPath:      "post",
+	HttpPostSecret:    "",
+	CaptureDir:        "capture",
+	CaptureMaxFileMB:  100,
+	CaptureMaxTotalMB: 1024,
+	WriteQueueSize:    10000,
+	WriteBatchSize:    200,
+	WriteFlushMs:      500,
+	Storage:           "sqlite",
+	RetainRawDays:     -1,
+	RetainDailyDays:   -1,
+	PruneIntervalMin:  60,
+	Timezone:          "Local",
+	CommandRules: []CommandRule{
+		{
+			Prefixes: []string{"/", "#"},
+		},
+	},
 	ApisInfos: []Apis{
 		{
 			APIPaths: "http://127.0.0.1:18630",
@@ -120,6 +179,30 @@ func checkAndSetDefaults(config *Config) bool {
 		}
 	}
 
+	if config.FixWriteSettings() {
+		modified = true
+	}
+
+	return modified
+}
+
+// FixWriteSettings 写入队列的长度 批次大小和间隔小于等于0时使用默认值 返回是否做了修改
+// 这些值用于创建队列和定时器 不合法时启动会panic
+func (c *Config) FixWriteSettings() bool {
+	var modified bool
+	for _, setting := range []struct {
+		value        *int
+		defaultValue int
+	}{
+		{&c.WriteQueueSize, defaultConfig.WriteQueueSize},
+		{&c.WriteBatchSize, defaultConfig.WriteBatchSize},
+		{&c.WriteFlushMs, defaultConfig.WriteFlushMs},
+	} {
+		if *setting.value <= 0 {
+			*setting.value = setting.defaultValue
+			modified = true
+		}
+	}
 	return modified
 }
 
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/mylog"
+)
+
+// 数据目录的环境变量 --data-dir优先
+const dataDirEnv = "GENSOKYO_DASHBOARD_DATA_DIR"
+
+// 切换到数据目录之前的工作目录 用于解析命令行中的其他相对路径
+var launchDir string
+
+// applyDataDir 从参数中取出--data-dir 创建并切换到数据目录
+// 配置 数据库 日志 存档和重启脚本都使用相对路径 切换后全部位于数据目录下
+// 返回去掉--data-dir后的参数
+func applyDataDir(args []string) []string {
+	launchDir, _ = os.Getwd()
+
+	dir := os.Getenv(dataDirEnv)
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name := strings.TrimLeft(arg, "-")
+		if arg == name {
+			rest = append(rest, arg)
+			continue
+		}
+		if name == "data-dir" && i+1 < len(args) {
+			dir = args[i+1]
+			i++
+			continue
+		}
+		if strings.HasPrefix(name, "data-dir=") {
+			dir = strings.TrimPrefix(name, "data-dir=")
+			continue
+		}
+		rest = append(rest, arg)
+	}
+
+	if dir == "" {
+		return rest
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		log.Fatalf("invalid data dir %s: %v", dir, err)
+	}
+	if err := os.MkdirAll(absDir, 0755); err != nil {
+		log.Fatalf("create data dir %s: %v", absDir, err)
+	}
+	if err := os.Chdir(absDir); err != nil {
+		log.Fatalf("chdir to data dir %s: %v", absDir, err)
+	}
+	// 重启时新进程通过环境变量继承数据目录
+	os.Setenv(dataDirEnv, absDir)
+	mylog.SetLogPath(filepath.Join(absDir, "log"))
+	log.Printf("数据目录: %s", absDir)
+
+	return rest
+}
+
+// launchPath 将命令行中的相对路径解析为相对启动时的工作目录
+func launchPath(path string) string {
+	if path == "" || filepath.IsAbs(path) || launchDir == "" {
+		return path
+	}
+	return filepath.Join(launchDir, path)
+}
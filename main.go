@@ -15,6 +15,7 @@ import (
 	"github.com/hoshinonyaruko/gensokyo-dashboard/mylog"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/server"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/sqlite"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/sys"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/webui"
 
@@ -28,6 +29,23 @@ type APIStatus struct {
 }
 
 func main() {
+	// 数据目录 多开时每个实例使用各自的目录
+	args := applyDataDir(os.Args[1:])
+
+	// 子命令 回放记录的onebot事件 数据库结构变更和重新统计指令
+	if len(args) > 0 {
+		switch args[0] {
+		case "replay":
+			runReplay(args[1:])
+			return
+		case "migrate":
+			runMigrate(args[1:])
+			return
+		case "recompute-commands":
+			runRecomputeCommands(args[1:])
+			return
+		}
+	}
 
 	// 读取或创建配置
 	jsonconfig := config.ReadConfig()
@@ -39,55 +57,21 @@ func main() {
 	//给程序整个标题
 	sys.SetTitle(jsonconfig.Title + " 作者 早苗狐 答疑群:196173384")
 
-	// 打开数据库，使用参数启动SQLite
-	db, err := sql.Open("sqlite3", "file:mydb.sqlite?cache=shared&mode=rwc")
-	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
-	}
-	defer db.Close()
+	// 统计使用的时区和指令规则
+	configureStats(jsonconfig)
 
-	// 启动WAL模式
-	_, err = db.Exec("PRAGMA journal_mode=WAL;")
-	if err != nil {
-		log.Fatalf("Failed to set WAL mode: %v", err)
-	}
+	// 打开存储 默认使用sqlite
+	st := openStore(jsonconfig)
 
-	// 检查当前的journal_mode
-	var journalMode string
-	row := db.QueryRow("PRAGMA journal_mode;")
-	if err := row.Scan(&journalMode); err != nil {
-		log.Fatalf("Failed to fetch journal mode: %v", err)
-	}
-	fmt.Printf("Database journal mode is set to: %s\n", journalMode)
-
-	// 确保表存在 函数需要符合幂等性
-	err = sqlite.EnsureCookieTablesExist(db) //网页登入cookie表
+	// 上次运行遗留的连接已经不存在 全部标记为离线
+	err := st.ResetConnectionState()
 	if err != nil {
-		log.Fatalf("sqlite.EnsureCookieTablesExist: %v", err)
+		log.Fatalf("store.ResetConnectionState: %v", err)
 	}
-	err = sqlite.EnsureMessagesTableExists(db) //全量收信息表
-	if err != nil {
-		log.Fatalf("sqlite.EnsureMessagesTableExists: %v", err)
-	}
-	err = sqlite.EnsureRobotStatusTableExists(db) //机器人状态表
-	if err != nil {
-		log.Fatalf("sqlite.EnsureRobotStatusTableExists: %v", err)
-	}
-	err = sqlite.EnsureUserStatsTableExists(db) //用户统计表
-	if err != nil {
-		log.Fatalf(" sqlite.EnsureUserStatsTableExists: %v", err)
-	}
-	err = sqlite.EnsureGroupStatsTableExists(db) //群统计表
-	if err != nil {
-		log.Fatalf("sqlite.EnsureGroupStatsTableExists %v", err)
-	}
-	err = sqlite.EnsureCommandStatsTables(db) //指令统计表
-	if err != nil {
-		log.Fatalf("sqlite.EnsureCommandStatsTableExists: %v", err)
-	}
-	err = sqlite.EnsureAPITableExists(db) //api状态表
-	if err != nil {
-		log.Fatalf("sqlite.EnsureAPITableExists: %v", err)
+
+	// 原始帧存档
+	if err := server.StartCapture(jsonconfig); err != nil {
+		log.Fatalf("server.StartCapture: %v", err)
 	}
 
 	r := gin.Default()
@@ -95,23 +79,33 @@ func main() {
 	//webui和它的api
 	webuiGroup := r.Group("/webui")
 	{
-		webuiGroup.GET("/*filepath", webui.CombinedMiddleware(jsonconfig, db))
-		webuiGroup.POST("/*filepath", webui.CombinedMiddleware(jsonconfig, db))
-		webuiGroup.PUT("/*filepath", webui.CombinedMiddleware(jsonconfig, db))
-		webuiGroup.DELETE("/*filepath", webui.CombinedMiddleware(jsonconfig, db))
-		webuiGroup.PATCH("/*filepath", webui.CombinedMiddleware(jsonconfig, db))
+		webuiGroup.GET("/*filepath", webui.CombinedMiddleware(jsonconfig, st))
+		webuiGroup.POST("/*filepath", webui.CombinedMiddleware(jsonconfig, st))
+		webuiGroup.PUT("/*filepath", webui.CombinedMiddleware(jsonconfig, st))
+		webuiGroup.DELETE("/*filepath", webui.CombinedMiddleware(jsonconfig, st))
+		webuiGroup.PATCH("/*filepath", webui.CombinedMiddleware(jsonconfig, st))
 	}
 	//正向ws
 
 	wspath := jsonconfig.WsPath
 	if wspath == "nil" {
-		r.GET("", server.WsHandlerWithDependencies(jsonconfig, db))
+		r.GET("", server.WsHandlerWithDependencies(jsonconfig, st))
 		mylog.Println("正向ws启动成功,监听0.0.0.0:" + jsonconfig.Port + "请注意设置ws_server_token(可空),并对外放通端口...")
 	} else {
-		r.GET("/"+wspath, server.WsHandlerWithDependencies(jsonconfig, db))
+		r.GET("/"+wspath, server.WsHandlerWithDependencies(jsonconfig, st))
 		mylog.Println("正向ws启动成功,监听0.0.0.0:" + jsonconfig.Port + "/" + wspath + "请注意设置ws_server_token(可空),并对外放通端口...")
 	}
 
+	//http上报
+	r.POST("/"+jsonconfig.HttpPostPath, server.HttpPostHandlerWithDependencies(jsonconfig, st))
+	mylog.Println("http上报接收启动成功,地址0.0.0.0:" + jsonconfig.Port + "/" + jsonconfig.HttpPostPath + "请注意设置http_post_secret(可空)...")
+
+	//反向连接 主动连接到onebot实现的正向ws
+	if len(jsonconfig.WsClients) > 0 {
+		server.StartWsClients(jsonconfig, st)
+		mylog.Printf("开始主动连接%d个正向ws地址...", len(jsonconfig.WsClients))
+	}
+
 	// 创建一个http.Server实例(主服务器)
 	httpServer := &http.Server{
 		Addr:    "0.0.0.0:" + jsonconfig.Port,
@@ -147,7 +141,10 @@ func main() {
 	}
 
 	// 运行api监测
-	apistats.MonitorAPIs(db, jsonconfig)
+	apistats.MonitorAPIs(st, jsonconfig)
+
+	// 定期清理过期数据
+	store.MonitorRetention(st, jsonconfig)
 
 	// 设置信号捕获
 	sigChan := make(chan os.Signal, 1)
@@ -155,8 +152,86 @@ func main() {
 
 	// 等待信号
 	<-sigChan
+	// 写完存档文件的结尾
+	server.CloseCapture()
+	// 写入队列中剩余的事件
+	st.Close()
 	// 可以执行退出程序
 	// 正常退出程序
 	os.Exit(0)
 
 }
+
+// 根据配置打开存储 sqlite存储会启动异步写入和指令耗时汇总
+func openStore(jsonconfig config.Config) store.Store {
+	if jsonconfig.Storage == "memory" {
+		mylog.Println("使用内存存储,统计数据不会写入数据库,重启后丢失")
+		return store.NewMemory(jsonconfig)
+	}
+
+	// 打开数据库并确保表存在
+	db := openDatabase("mydb.sqlite")
+	sqliteStore := sqlite.NewStore(db, jsonconfig)
+
+	// 异步批量写入事件
+	sqliteStore.StartWriter()
+
+	// 汇总指令响应耗时 依赖储存的消息
+	if jsonconfig.StoreMsgs {
+		sqlite.MonitorCommandLatency(db)
+	}
+
+	return sqliteStore
+}
+
+// 打开数据库并启动WAL模式
+func connectDatabase(path string) *sql.DB {
+	// 打开数据库，使用参数启动SQLite
+	db, err := sql.Open("sqlite3", sqlite.DSN(path))
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	// 启动WAL模式
+	_, err = db.Exec("PRAGMA journal_mode=WAL;")
+	if err != nil {
+		log.Fatalf("Failed to set WAL mode: %v", err)
+	}
+
+	// 检查当前的journal_mode
+	var journalMode string
+	row := db.QueryRow("PRAGMA journal_mode;")
+	if err := row.Scan(&journalMode); err != nil {
+		log.Fatalf("Failed to fetch journal mode: %v", err)
+	}
+	fmt.Printf("Database journal mode is set to: %s\n", journalMode)
+
+	return db
+}
+
+// 按配置设置统计使用的时区和指令提取规则
+func configureStats(jsonconfig config.Config) {
+	if err := store.SetTimezone(jsonconfig.Timezone); err != nil {
+		log.Fatalf("store.SetTimezone: %v", err)
+	}
+	if err := store.SetCommandRules(jsonconfig.CommandRules); err != nil {
+		log.Fatalf("store.SetCommandRules: %v", err)
+	}
+}
+
+// 打开数据库并执行未执行的结构变更
+func openDatabase(path string) *sql.DB {
+	db := connectDatabase(path)
+
+	// 确保表结构为最新 变更需要符合幂等性
+	if err := sqlite.MigrateUp(db, 0); err != nil {
+		log.Fatalf("sqlite.MigrateUp: %v", err)
+	}
+
+	// 消息的全文索引 取决于编译时是否启用了fts5
+	if err := sqlite.EnsureMessageSearchIndex(db); err != nil {
+		log.Fatalf("sqlite.EnsureMessageSearchIndex: %v", err)
+	}
+
+	return db
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/sqlite"
+)
+
+// runMigrate 查看或手动执行数据库结构变更 正常启动时会自动执行全部变更
+// 用法: gensokyo-dashboard migrate status|up|down [--db mydb.sqlite] [--to 版本号]
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		fmt.Println("用法: migrate status|up|down [--db mydb.sqlite] [--to 版本号]")
+		os.Exit(2)
+	}
+	command := args[0]
+
+	flags := flag.NewFlagSet("migrate "+command, flag.ExitOnError)
+	dbPath := flags.String("db", "mydb.sqlite", "数据库文件")
+	target := flags.Int("to", -1, "up时执行到该版本(默认全部) down时回退到该版本(默认回退一个)")
+	flags.Parse(args[1:])
+
+	// 补全统计的变更按配置的时区和指令规则计算 与正常启动时一致
+	configureStats(config.ReadConfig())
+
+	db := connectDatabase(*dbPath)
+	defer db.Close()
+
+	switch command {
+	case "status":
+	case "up":
+		to := *target
+		if to < 0 {
+			to = 0
+		}
+		if err := sqlite.MigrateUp(db, to); err != nil {
+			log.Fatalf("migrate up failed: %v", err)
+		}
+	case "down":
+		to := *target
+		if to < 0 {
+			to = latestAppliedVersion(db) - 1
+		}
+		if to < 0 {
+			to = 0
+		}
+		if err := sqlite.MigrateDown(db, to); err != nil {
+			log.Fatalf("migrate down failed: %v", err)
+		}
+	default:
+		fmt.Printf("未知的migrate命令: %s\n", command)
+		os.Exit(2)
+	}
+
+	printMigrationStatus(db)
+}
+
+func latestAppliedVersion(db *sql.DB) int {
+	statuses, err := sqlite.FetchMigrationStatus(db)
+	if err != nil {
+		log.Fatalf("sqlite.FetchMigrationStatus: %v", err)
+	}
+	latest := 0
+	for _, status := range statuses {
+		if status.AppliedAt != 0 && status.Version > latest {
+			latest = status.Version
+		}
+	}
+	return latest
+}
+
+func printMigrationStatus(db *sql.DB) {
+	statuses, err := sqlite.FetchMigrationStatus(db)
+	if err != nil {
+		log.Fatalf("sqlite.FetchMigrationStatus: %v", err)
+	}
+	for _, status := range statuses {
+		applied := "未执行"
+		if status.AppliedAt != 0 {
+			applied = time.Unix(status.AppliedAt, 0).Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-24s %s\n", status.Version, status.Name, applied)
+	}
+}
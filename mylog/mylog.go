@@ -60,6 +60,11 @@ func init() {
 	logPath = filepath.Join(exeDir, "log")
 }
 
+// SetLogPath 设置文件日志的目录 默认为程序所在目录下的log
+func SetLogPath(path string) {
+	logPath = path
+}
+
 // 全局变量，用于存储日志启用状态
 var enableFileLogGlobal bool
 
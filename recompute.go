@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/sqlite"
+)
+
+// runRecomputeCommands 修改指令规则后 按新规则用储存的消息重新统计指令
+// 面板运行时也可以在webui调用/api/commands/recompute
+// 用法: gensokyo-dashboard recompute-commands [--db mydb.sqlite]
+func runRecomputeCommands(args []string) {
+	flags := flag.NewFlagSet("recompute-commands", flag.ExitOnError)
+	dbPath := flags.String("db", "mydb.sqlite", "数据库文件")
+	flags.Parse(args)
+
+	jsonconfig := config.ReadConfig()
+	configureStats(jsonconfig)
+
+	db := openDatabase(*dbPath)
+	defer db.Close()
+
+	result, err := sqlite.NewStore(db, jsonconfig).RecomputeCommandStats()
+	if err != nil {
+		log.Fatalf("recompute commands failed: %v", err)
+	}
+
+	selfIDs := make([]string, 0, len(result.Since))
+	for selfID := range result.Since {
+		selfIDs = append(selfIDs, selfID)
+	}
+	sort.Strings(selfIDs)
+	for _, selfID := range selfIDs {
+		fmt.Printf("机器人%s 自%s起重新统计\n", selfID, result.Since[selfID])
+	}
+	fmt.Printf("重新统计完成 共%d条消息 其中%d条为指令 用时%dms\n", result.Messages, result.Commands, result.DurationMs)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/server"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/sqlite"
+)
+
+// runReplay 将记录的onebot事件回放进统计 用于补录历史数据和复现问题
+// 用法: gensokyo-dashboard replay --file x.jsonl [--speed 10x] [--db out.sqlite] [--self-id 123]
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := flags.String("file", "", "要回放的jsonl文件 每行一个onebot事件")
+	speedStr := flags.String("speed", "", "按事件时间间隔回放的倍速 如10x 不填则不等待")
+	dbPath := flags.String("db", "mydb.sqlite", "写入的数据库文件")
+	selfID := flags.String("self-id", "", "事件缺少self_id时使用的机器人id")
+	flags.Parse(args)
+
+	if *file == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	// 回放文件相对启动时的目录 数据库相对数据目录
+	*file = launchPath(*file)
+
+	var speed float64
+	if *speedStr != "" {
+		var err error
+		speed, err = strconv.ParseFloat(strings.TrimSuffix(*speedStr, "x"), 64)
+		if err != nil || speed <= 0 {
+			log.Fatalf("invalid speed: %s", *speedStr)
+		}
+	}
+
+	// 是否储存消息等选项与正常运行时一致
+	jsonconfig := config.ReadConfig()
+	configureStats(jsonconfig)
+	// 回放不限速时队列总会写满 必须等待写入 不能丢弃事件
+	jsonconfig.WriteDropWhenFull = false
+
+	db := openDatabase(*dbPath)
+	defer db.Close()
+
+	st := sqlite.NewStore(db, jsonconfig)
+	st.StartWriter()
+
+	start := time.Now()
+	lines, err := server.ReplayFile(*file, speed, *selfID, st, jsonconfig)
+	st.Close()
+	if err != nil {
+		log.Fatalf("replay failed after %d lines: %v", lines, err)
+	}
+	fmt.Printf("回放完成 共%d行 用时%v\n", lines, time.Since(start).Round(time.Millisecond))
+}
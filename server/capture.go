@@ -0,0 +1,285 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/mylog"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+)
+
+// 存档帧的方向
+const (
+	DirectionIn  = "in"  // 机器人发给面板的事件和action响应
+	DirectionOut = "out" // 中继时应用端发给机器人的action
+)
+
+// CapturedFrame 存档文件中的一行 frame为收发的原始帧
+type CapturedFrame struct {
+	TimeMs    int64           `json:"time_ms"`
+	Direction string          `json:"direction"`
+	SelfID    string          `json:"self_id"`
+	Transport string          `json:"transport"`
+	Frame     json.RawMessage `json:"frame"`
+}
+
+// Capturer 将原始帧按天写入jsonl存档 单个文件超出上限时写入同一天的下一个文件
+type Capturer struct {
+	mu            sync.Mutex
+	dir           string
+	gzip          bool
+	selfIDs       map[string]bool
+	maxFileBytes  int64
+	maxTotalBytes int64
+
+	date    string
+	part    int
+	path    string
+	file    *os.File
+	gz      *gzip.Writer
+	counter *countingWriter
+}
+
+// 统计写入文件的字节数 gzip时为压缩后的大小
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+var capturer *Capturer
+
+// StartCapture 根据配置开启原始帧存档
+func StartCapture(config config.Config) error {
+	if !config.Capture {
+		return nil
+	}
+	if err := os.MkdirAll(config.CaptureDir, 0755); err != nil {
+		return fmt.Errorf("error creating capture dir: %w", err)
+	}
+
+	selfIDs := make(map[string]bool)
+	for _, selfID := range config.CaptureSelfIDs {
+		selfIDs[selfID] = true
+	}
+	capturer = &Capturer{
+		dir:           config.CaptureDir,
+		gzip:          config.CaptureGzip,
+		selfIDs:       selfIDs,
+		maxFileBytes:  int64(config.CaptureMaxFileMB) << 20,
+		maxTotalBytes: int64(config.CaptureMaxTotalMB) << 20,
+	}
+	return nil
+}
+
+// CloseCapture 关闭当前存档文件 gzip需要关闭才能写入完整的结尾
+func CloseCapture() {
+	if capturer == nil {
+		return
+	}
+	capturer.mu.Lock()
+	defer capturer.mu.Unlock()
+	capturer.closeFile()
+}
+
+// 存档一帧 未开启存档时不做任何事
+func captureFrame(conn *Connection, direction string, data []byte) {
+	if capturer == nil {
+		return
+	}
+	if err := capturer.write(conn, direction, data); err != nil {
+		mylog.Printf("Error capturing frame: %v", err)
+	}
+}
+
+func (c *Capturer) write(conn *Connection, direction string, data []byte) error {
+	selfID := conn.selfID()
+	if selfID == "" {
+		selfID = frameSelfID(data)
+	}
+	if len(c.selfIDs) > 0 && !c.selfIDs[selfID] {
+		return nil
+	}
+
+	frame := json.RawMessage(data)
+	if !json.Valid(data) {
+		// 无法解析的帧以字符串保存 保证每行都是合法的json
+		quoted, err := json.Marshal(string(data))
+		if err != nil {
+			return err
+		}
+		frame = quoted
+	}
+	line, err := json.Marshal(CapturedFrame{
+		TimeMs:    time.Now().UnixMilli(),
+		Direction: direction,
+		SelfID:    selfID,
+		Transport: conn.Transport,
+		Frame:     frame,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 与统计使用同一时区划分存档文件的日期
+	date := store.Now().Format("2006-01-02")
+	if c.file == nil || date != c.date || c.counter.n >= c.maxFileBytes {
+		if err := c.rotate(date); err != nil {
+			return err
+		}
+	}
+
+	if c.gz != nil {
+		if _, err := c.gz.Write(line); err != nil {
+			return err
+		}
+		// 每帧都刷新 进程意外退出时已写入的内容仍可读取
+		return c.gz.Flush()
+	}
+	_, err = c.counter.Write(line)
+	return err
+}
+
+// 切换到指定日期下一个未写满的文件 并清理超出总大小的旧文件
+func (c *Capturer) rotate(date string) error {
+	c.closeFile()
+	if date != c.date {
+		c.date = date
+		c.part = 0
+	} else {
+		c.part++
+	}
+
+	for {
+		c.path = filepath.Join(c.dir, c.fileName())
+		info, err := os.Stat(c.path)
+		if err != nil || info.Size() < c.maxFileBytes {
+			break
+		}
+		// 重启前已写满的文件
+		c.part++
+	}
+
+	file, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening capture file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error reading capture file: %w", err)
+	}
+
+	c.file = file
+	c.counter = &countingWriter{w: file, n: info.Size()}
+	if c.gzip {
+		// 追加到已有文件时会成为新的gzip成员 读取时可以连续解压
+		c.gz = gzip.NewWriter(c.counter)
+	}
+
+	c.prune()
+	return nil
+}
+
+func (c *Capturer) fileName() string {
+	name := c.date
+	if c.part > 0 {
+		name = fmt.Sprintf("%s.%d", c.date, c.part)
+	}
+	name += ".jsonl"
+	if c.gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+func (c *Capturer) closeFile() {
+	if c.gz != nil {
+		c.gz.Close()
+		c.gz = nil
+	}
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// 存档总大小超出上限时 从最早修改的文件开始删除 不会删除正在写入的文件
+func (c *Capturer) prune() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		mylog.Printf("Error reading capture dir: %v", err)
+		return
+	}
+
+	type archive struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var archives []archive
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !(strings.HasSuffix(name, ".jsonl") || strings.HasSuffix(name, ".jsonl.gz")) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		archives = append(archives, archive{path: filepath.Join(c.dir, name), size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	sort.Slice(archives, func(i, j int) bool { return archives[i].modTime.Before(archives[j].modTime) })
+	for _, old := range archives {
+		if total <= c.maxTotalBytes {
+			break
+		}
+		if old.path == c.path {
+			continue
+		}
+		if err := os.Remove(old.path); err != nil {
+			mylog.Printf("Error removing capture file %s: %v", old.path, err)
+			continue
+		}
+		mylog.Printf("存档超出%dMB, 已删除 %s", c.maxTotalBytes>>20, old.path)
+		total -= old.size
+	}
+}
+
+// 从帧中读取机器人id v11为self_id v12为self.user_id
+func frameSelfID(data []byte) string {
+	var frame struct {
+		SelfID json.RawMessage `json:"self_id"`
+		Self   struct {
+			UserID string `json:"user_id"`
+		} `json:"self"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return ""
+	}
+	if len(frame.SelfID) > 0 {
+		return strings.Trim(string(frame.SelfID), `"`)
+	}
+	return frame.Self.UserID
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/mylog"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+)
+
+// 重连退避的上下限
+const (
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 60 * time.Second
+)
+
+// StartWsClients 主动连接配置中的每一个onebot正向ws 无需修改机器人的配置即可接入面板
+func StartWsClients(config config.Config, st store.Store) {
+	for _, target := range config.WsClients {
+		if target.URL == "" {
+			continue
+		}
+		go connectWithRetry(target, config, st)
+	}
+}
+
+// 保持连接 断开后按指数退避重连
+func connectWithRetry(target config.WsClient, config config.Config, st store.Store) {
+	backoff := minReconnectBackoff
+	for {
+		connected, err := runWsClient(target, config, st)
+		if connected {
+			// 曾经连接成功过 从最短的间隔重新开始
+			backoff = minReconnectBackoff
+		}
+		mylog.Printf("正向ws %s 连接断开: %v, %v 后重连", target.URL, err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// 建立一次连接并持续读取 返回是否连接成功过以及断开的原因
+func runWsClient(target config.WsClient, config config.Config, st store.Store) (bool, error) {
+	header := http.Header{}
+	if target.AccessToken != "" {
+		header.Set("Authorization", "Bearer "+target.AccessToken)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(target.URL, header)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	mylog.Printf("已连接到正向ws %s", target.URL)
+
+	// 正向ws没有X-Self-ID 由首个事件的self_id绑定
+	connection := newConnection("", "Universal", target.URL, "", TransportForwardWS)
+	registerConnection(connection, st)
+	defer unregisterConnection(connection, st)
+
+	for {
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+
+		if messageType == websocket.TextMessage {
+			captureFrame(connection, DirectionIn, p)
+			processWSMessage(connection, p, st, config)
+		}
+	}
+}
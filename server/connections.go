@@ -0,0 +1,184 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/mylog"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+)
+
+// 连接的传输方式
+const (
+	TransportReverseWS = "reverse-ws" // 机器人连接到面板
+	TransportForwardWS = "forward-ws" // 面板连接到机器人
+	TransportHTTPPost  = "http-post"  // 机器人通过http上报事件
+	TransportReplay    = "replay"     // 从文件回放的历史事件
+)
+
+// Connection 一个已连接的机器人会话
+type Connection struct {
+	ID             string `json:"id"`
+	SelfID         string `json:"self_id"`
+	Role           string `json:"role"`           // X-Client-Role Universal/Event/API
+	RemoteIP       string `json:"remote_ip"`      // 对端地址
+	Implementation string `json:"implementation"` // onebot实现名称 来自User-Agent
+	Transport      string `json:"transport"`      // 传输方式
+	ConnectedAt    int64  `json:"connected_at"`   // 连接时间
+	Protocol       int    `json:"protocol"`       // onebot版本 0代表尚未识别
+
+	sessionID int64 // connection_sessions表中的行id 0代表尚未落库
+}
+
+// 连接注册表 以连接id为键 同一个self_id可能同时存在多个连接(Event/API分离)
+var (
+	connectionsMu sync.RWMutex
+	connections   = make(map[string]*Connection)
+)
+
+func newConnection(selfID string, role, remoteIP, implementation, transport string) *Connection {
+	return &Connection{
+		ID:             uuid.New().String(),
+		SelfID:         selfID,
+		Role:           role,
+		RemoteIP:       remoteIP,
+		Implementation: implementation,
+		Transport:      transport,
+		ConnectedAt:    time.Now().Unix(),
+	}
+}
+
+// 登记新连接 已知self_id时立即落库并标记在线
+func registerConnection(conn *Connection, st store.Store) {
+	connectionsMu.Lock()
+	connections[conn.ID] = conn
+	connectionsMu.Unlock()
+
+	if conn.selfID() != "" {
+		openSession(conn, st)
+	}
+}
+
+// 请求头中没有X-Self-ID时 使用首个事件中的self_id绑定连接
+func bindSelfID(conn *Connection, selfID string, st store.Store) {
+	if conn == nil || selfID == "" {
+		return
+	}
+	connectionsMu.Lock()
+	if conn.SelfID != "" {
+		connectionsMu.Unlock()
+		return
+	}
+	conn.SelfID = selfID
+	// http上报等短连接不在注册表中 不产生会话记录
+	_, registered := connections[conn.ID]
+	connectionsMu.Unlock()
+
+	if registered {
+		mylog.Printf("连接 %s 绑定到机器人 %s", conn.RemoteIP, selfID)
+		openSession(conn, st)
+	}
+}
+
+// 注销连接 该self_id没有其他连接时标记离线
+func unregisterConnection(conn *Connection, st store.Store) {
+	connectionsMu.Lock()
+	delete(connections, conn.ID)
+	selfID := conn.SelfID
+	stillOnline := false
+	for _, other := range connections {
+		if other.SelfID == selfID {
+			stillOnline = true
+			break
+		}
+	}
+	connectionsMu.Unlock()
+
+	if sessionID := conn.session(); sessionID != 0 {
+		if err := st.CloseConnectionSession(sessionID, time.Now().Unix()); err != nil {
+			mylog.Printf("store.CloseConnectionSession error %v", err)
+		}
+	}
+	if selfID != "" && !stillOnline {
+		if err := st.SetRobotOnline(selfID, false); err != nil {
+			mylog.Printf("store.SetRobotOnline error %v", err)
+		}
+	}
+}
+
+// 会话落库并标记在线
+func openSession(conn *Connection, st store.Store) {
+	connectionsMu.RLock()
+	selfID, implementation := conn.SelfID, conn.Implementation
+	connectionsMu.RUnlock()
+
+	sessionID, err := st.OpenConnectionSession(selfID, conn.Role, conn.RemoteIP, implementation, conn.Transport, conn.ConnectedAt)
+	if err != nil {
+		mylog.Printf("store.OpenConnectionSession error %v", err)
+	} else {
+		connectionsMu.Lock()
+		conn.sessionID = sessionID
+		connectionsMu.Unlock()
+	}
+	if err := st.SetRobotOnline(selfID, true); err != nil {
+		mylog.Printf("store.SetRobotOnline error %v", err)
+	}
+}
+
+// SelfID可能由首个事件补全 中继等其他goroutine通过它读取
+func (conn *Connection) selfID() string {
+	connectionsMu.RLock()
+	defer connectionsMu.RUnlock()
+	return conn.SelfID
+}
+
+// 连接登记后Protocol Implementation和sessionID仍会被事件更新 与注册表一样在connectionsMu下读写
+func (conn *Connection) protocol() int {
+	connectionsMu.RLock()
+	defer connectionsMu.RUnlock()
+	return conn.Protocol
+}
+
+func (conn *Connection) setProtocol(protocol int) {
+	connectionsMu.Lock()
+	conn.Protocol = protocol
+	connectionsMu.Unlock()
+}
+
+// 只在尚未识别实现名称时设置
+func (conn *Connection) setImplementation(implementation string) {
+	connectionsMu.Lock()
+	if conn.Implementation == "" {
+		conn.Implementation = implementation
+	}
+	connectionsMu.Unlock()
+}
+
+func (conn *Connection) session() int64 {
+	connectionsMu.RLock()
+	defer connectionsMu.RUnlock()
+	return conn.sessionID
+}
+
+// 根据lifecycle元事件更新在线状态 disable代表实现主动停用
+func handleLifecycle(conn *Connection, subType string, st store.Store) {
+	// 回放的历史事件不影响当前在线状态
+	if conn == nil || conn.Transport == TransportReplay {
+		return
+	}
+	selfID := conn.selfID()
+	if selfID == "" {
+		return
+	}
+	switch subType {
+	case "connect", "enable":
+		if err := st.SetRobotOnline(selfID, true); err != nil {
+			mylog.Printf("store.SetRobotOnline error %v", err)
+		}
+	case "disable":
+		if err := st.SetRobotOnline(selfID, false); err != nil {
+			mylog.Printf("store.SetRobotOnline error %v", err)
+		}
+	}
+}
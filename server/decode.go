@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// 判断事件的协议版本 v11使用post_type v12使用type和detail_type 无法判断时返回0
+func detectProtocol(genericMap map[string]interface{}) int {
+	if _, ok := genericMap["post_type"].(string); ok {
+		return structs.ProtocolV11
+	}
+	if _, ok := genericMap["notice_type"].(string); ok {
+		return structs.ProtocolV11
+	}
+	_, hasType := genericMap["type"].(string)
+	_, hasDetailType := genericMap["detail_type"].(string)
+	if hasType && hasDetailType {
+		return structs.ProtocolV12
+	}
+	return 0
+}
+
+// 将收到的信息按协议版本解码为内部事件
+func decodeEvents(msg []byte, genericMap map[string]interface{}, protocol int) ([]structs.Event, error) {
+	if protocol == structs.ProtocolV12 {
+		var v12Event structs.V12Event
+		if err := json.Unmarshal(msg, &v12Event); err != nil {
+			return nil, fmt.Errorf("error unmarshalling v12 event: %w", err)
+		}
+		return v12Event.Normalize(), nil
+	}
+
+	// Assuming there's a way to distinguish notice messages, for example, checking if notice_type exists
+	if noticeType, ok := genericMap["notice_type"].(string); ok && noticeType != "" {
+		var noticeEvent structs.NoticeEvent
+		if err := json.Unmarshal(msg, &noticeEvent); err != nil {
+			return nil, fmt.Errorf("error unmarshalling notice event: %w", err)
+		}
+		return []structs.Event{noticeEvent.Normalize()}, nil
+	}
+
+	postType, _ := genericMap["post_type"].(string)
+	switch postType {
+	case "message", "message_sent":
+		var messageEvent structs.MessageEvent
+		if err := json.Unmarshal(msg, &messageEvent); err != nil {
+			return nil, fmt.Errorf("error unmarshalling message event: %w", err)
+		}
+		return []structs.Event{messageEvent.Normalize()}, nil
+	case "request":
+		var requestEvent structs.RequestEvent
+		if err := json.Unmarshal(msg, &requestEvent); err != nil {
+			return nil, fmt.Errorf("error unmarshalling request event: %w", err)
+		}
+		return []structs.Event{requestEvent.Normalize()}, nil
+	case "meta_event":
+		var metaEvent structs.MetaEvent
+		if err := json.Unmarshal(msg, &metaEvent); err != nil {
+			return nil, fmt.Errorf("error unmarshalling meta event: %w", err)
+		}
+		return []structs.Event{metaEvent.Normalize()}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/mylog"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+)
+
+// 使用闭包结构 因为gin需要c *gin.Context固定签名
+func HttpPostHandlerWithDependencies(config config.Config, st store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		httpPostHandler(c, config, st)
+	}
+}
+
+// 处理onebot v11 http上报 与ws共用同一套解析和统计流程
+func httpPostHandler(c *gin.Context, config config.Config, st store.Store) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body"})
+		return
+	}
+
+	// 配置了secret时校验签名
+	if config.HttpPostSecret != "" {
+		signature := c.Request.Header.Get("X-Signature")
+		if signature == "" {
+			mylog.Printf("Http post rejected due to missing signature. IP: %s", c.ClientIP())
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing signature"})
+			return
+		}
+		if !verifySignature(body, signature, config.HttpPostSecret) {
+			mylog.Printf("Http post rejected due to incorrect signature. IP: %s, Signature: %s", c.ClientIP(), signature)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Incorrect signature"})
+			return
+		}
+	}
+
+	connection := newConnection(c.Request.Header.Get("X-Self-ID"), "Event", c.ClientIP(), c.Request.Header.Get("User-Agent"), TransportHTTPPost)
+
+	captureFrame(connection, DirectionIn, body)
+	processWSMessage(connection, body, st, config)
+
+	// 空的快速操作响应
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// 校验X-Signature 格式为 sha1=十六进制的HMAC-SHA1(body, secret)
+func verifySignature(body []byte, signature string, secret string) bool {
+	provided, err := hex.DecodeString(strings.TrimPrefix(signature, "sha1="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(provided, mac.Sum(nil))
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/mylog"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// 超过该时间没有收到响应的action记为失败
+const actionTimeout = 60 * time.Second
+
+// Relay 中继模式下 一个机器人连接对应的应用端连接
+// 事件由机器人转发给应用端 action由应用端转发给机器人 两个方向都会进入统计
+type Relay struct {
+	upstream   *websocket.Conn
+	upstreamMu sync.Mutex
+	bot        *WebSocketServerClient
+	connection *Connection
+	store      store.Store
+	config     config.Config
+
+	pendingMu sync.Mutex
+	pending   map[string]pendingAction // 以echo为键 等待机器人响应的action
+	done      chan struct{}
+}
+
+type pendingAction struct {
+	action string
+	sentAt time.Time
+}
+
+// action的响应 只解析统计需要的字段
+type actionResponse struct {
+	Status  string          `json:"status"`
+	Retcode *int            `json:"retcode"`
+	Echo    json.RawMessage `json:"echo"`
+}
+
+// 以机器人连接时的请求头连接应用端 使应用端看到的是原本的机器人
+func dialRelay(config config.Config, requestHeader http.Header, bot *WebSocketServerClient, connection *Connection, st store.Store) (*Relay, error) {
+	header := http.Header{}
+	for _, key := range []string{"X-Self-ID", "X-Client-Role", "User-Agent"} {
+		if value := requestHeader.Get(key); value != "" {
+			header.Set(key, value)
+		}
+	}
+	if config.RelayToken != "" {
+		header.Set("Authorization", "Bearer "+config.RelayToken)
+	}
+	if header.Get("X-Self-ID") == "" {
+		mylog.Printf("机器人 %s 未携带X-Self-ID, 应用端可能拒绝中继连接", connection.RemoteIP)
+	}
+
+	dialer := *websocket.DefaultDialer
+	if subprotocol := requestHeader.Get("Sec-WebSocket-Protocol"); subprotocol != "" {
+		dialer.Subprotocols = []string{subprotocol}
+	}
+
+	upstream, _, err := dialer.Dial(config.RelayURL, header)
+	if err != nil {
+		return nil, err
+	}
+
+	relay := &Relay{
+		upstream:   upstream,
+		bot:        bot,
+		connection: connection,
+		store:      st,
+		config:     config,
+		pending:    make(map[string]pendingAction),
+		done:       make(chan struct{}),
+	}
+	go relay.readUpstream()
+	go relay.expirePending()
+	return relay, nil
+}
+
+// ForwardEvent 将机器人发来的帧原样转发给应用端
+func (r *Relay) ForwardEvent(messageType int, data []byte) {
+	r.upstreamMu.Lock()
+	err := r.upstream.WriteMessage(messageType, data)
+	r.upstreamMu.Unlock()
+	if err != nil {
+		mylog.Printf("Error forwarding event to relay upstream: %v", err)
+	}
+}
+
+// 读取应用端发来的action 转发给机器人并记录
+func (r *Relay) readUpstream() {
+	// 应用端断开时同时断开机器人 让机器人重连以重新建立中继
+	defer r.bot.Close()
+
+	for {
+		messageType, p, err := r.upstream.ReadMessage()
+		if err != nil {
+			mylog.Printf("Relay upstream disconnected: %v", err)
+			return
+		}
+
+		// 先登记等待响应再转发 机器人很快响应时也能找到对应的action
+		var action *structs.ActionMessage
+		var key string
+		if messageType == websocket.TextMessage {
+			action, key = r.trackAction(p)
+		}
+
+		if err := r.bot.SendRaw(messageType, p); err != nil {
+			mylog.Printf("Error forwarding action to bot: %v", err)
+			r.failAction(key)
+			return
+		}
+
+		if messageType == websocket.TextMessage {
+			captureFrame(r.connection, DirectionOut, p)
+			// 发送消息类的action计入回复统计
+			if action != nil {
+				processOutgoingAction(r.connection, *action, r.store, r.config)
+			}
+		}
+	}
+}
+
+// 解析action 带echo时记录等待响应 返回等待响应的键 无法解析时返回nil
+func (r *Relay) trackAction(msg []byte) (*structs.ActionMessage, string) {
+	var action structs.ActionMessage
+	if err := json.Unmarshal(msg, &action); err != nil {
+		log.Printf("Error unmarshalling action: %v, Original message: %s\n", err, string(msg))
+		return nil, ""
+	}
+	if r.config.PrintLogs {
+		fmt.Printf("Relayed %s\n", TruncateMessage(action, 200))
+	}
+
+	if action.Echo == nil {
+		return &action, ""
+	}
+	key, err := json.Marshal(action.Echo)
+	if err != nil {
+		return &action, ""
+	}
+	r.pendingMu.Lock()
+	r.pending[string(key)] = pendingAction{action: action.Action, sentAt: time.Now()}
+	r.pendingMu.Unlock()
+	return &action, string(key)
+}
+
+// 转发失败的action不会有响应 直接记为失败
+func (r *Relay) failAction(key string) {
+	if key == "" {
+		return
+	}
+	r.pendingMu.Lock()
+	pending, ok := r.pending[key]
+	delete(r.pending, key)
+	r.pendingMu.Unlock()
+	if ok {
+		r.recordAction(pending.action, time.Since(pending.sentAt), false)
+	}
+}
+
+// CompleteAction 如果是某个action的响应 记录耗时和结果并返回true
+func (r *Relay) CompleteAction(msg []byte) bool {
+	var response actionResponse
+	if err := json.Unmarshal(msg, &response); err != nil || response.Retcode == nil {
+		return false
+	}
+	if len(response.Echo) == 0 {
+		return true
+	}
+
+	// 与请求时相同的方式序列化echo 保证两边的键一致
+	var echo interface{}
+	if err := json.Unmarshal(response.Echo, &echo); err != nil {
+		return true
+	}
+	key, err := json.Marshal(echo)
+	if err != nil {
+		return true
+	}
+
+	r.pendingMu.Lock()
+	pending, ok := r.pending[string(key)]
+	delete(r.pending, string(key))
+	r.pendingMu.Unlock()
+	if !ok {
+		return true
+	}
+
+	success := response.Status != "failed" && *response.Retcode == 0
+	r.recordAction(pending.action, time.Since(pending.sentAt), success)
+	return true
+}
+
+// 定期清理超时未响应的action 记为失败
+func (r *Relay) expirePending() {
+	ticker := time.NewTicker(actionTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			var expired []pendingAction
+			r.pendingMu.Lock()
+			for key, pending := range r.pending {
+				if now.Sub(pending.sentAt) > actionTimeout {
+					expired = append(expired, pending)
+					delete(r.pending, key)
+				}
+			}
+			r.pendingMu.Unlock()
+
+			for _, pending := range expired {
+				r.recordAction(pending.action, actionTimeout, false)
+			}
+		}
+	}
+}
+
+func (r *Relay) recordAction(action string, latency time.Duration, success bool) {
+	selfID := r.connection.selfID()
+	if selfID == "" {
+		return
+	}
+	if err := r.store.RecordActionResult(selfID, action, latency.Milliseconds(), success); err != nil {
+		fmt.Printf("store.RecordActionResult error %v.\n", err)
+	}
+}
+
+// Close 断开应用端连接
+func (r *Relay) Close() {
+	close(r.done)
+	r.upstream.Close()
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+)
+
+// 单行记录的最大长度 合并转发等消息可能很长
+const maxReplayLineSize = 16 * 1024 * 1024
+
+// ReplayFile 将jsonl文件中每行一个的onebot事件依次送入统计流程 返回处理的行数
+// 文件可以是原始事件 也可以是capture存档(支持.gz) 存档中发出的action会被跳过
+// 统计使用事件自身的时间 speed大于0时按事件时间间隔的1/speed等待 否则不等待
+// selfID用于补全缺少self_id的事件 可为空
+func ReplayFile(path string, speed float64, selfID string, st store.Store, config config.Config) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("error opening replay file: %w", err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, fmt.Errorf("error opening gzip replay file: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReplayLineSize)
+
+	var lines int
+	var lastTime float64
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		// 原始事件的self_id可能是数字 这里只读取capture存档的字段
+		var frame struct {
+			Time      float64         `json:"time"`
+			TimeMs    int64           `json:"time_ms"`
+			Direction string          `json:"direction"`
+			SelfID    json.RawMessage `json:"self_id"`
+			Frame     json.RawMessage `json:"frame"`
+		}
+		if err := json.Unmarshal(line, &frame); err != nil {
+			log.Printf("Error unmarshalling replay line: %v\n", err)
+			continue
+		}
+		lineSelfID := selfID
+		frameTime := frame.Time
+		if frame.Direction != "" && len(frame.Frame) > 0 {
+			// capture存档 只回放收到的帧
+			if frame.Direction != DirectionIn {
+				continue
+			}
+			line = frame.Frame
+			frameTime = float64(frame.TimeMs) / 1000
+			if lineSelfID == "" {
+				lineSelfID = strings.Trim(string(frame.SelfID), `"`)
+			}
+		}
+
+		if speed > 0 && frameTime > 0 {
+			if lastTime > 0 && frameTime > lastTime {
+				time.Sleep(time.Duration((frameTime - lastTime) / speed * float64(time.Second)))
+			}
+			lastTime = frameTime
+		}
+
+		// 文件中可能混有不同机器人和协议版本的事件 每行使用独立的连接
+		connection := newConnection(lineSelfID, "Event", "", "", TransportReplay)
+		processWSMessage(connection, line, st, config)
+		lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return lines, fmt.Errorf("error reading replay file: %w", err)
+	}
+
+	return lines, nil
+}
@@ -1,24 +1,26 @@
 package server
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/mylog"
-	"github.com/hoshinonyaruko/gensokyo-dashboard/sqlite"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
 )
 
 type WebSocketServerClient struct {
 	Conn *websocket.Conn
+	mu   sync.Mutex // 中继模式下存在多个写入方
 }
 
 var upgrader = websocket.Upgrader{
@@ -28,14 +30,14 @@ var upgrader = websocket.Upgrader{
 }
 
 // 使用闭包结构 因为gin需要c *gin.Context固定签名
-func WsHandlerWithDependencies(config config.Config, db *sql.DB) gin.HandlerFunc {
+func WsHandlerWithDependencies(config config.Config, st store.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		wsHandler(c, config, db)
+		wsHandler(c, config, st)
 	}
 }
 
 // 处理正向ws客户端的连接
-func wsHandler(c *gin.Context, config config.Config, db *sql.DB) {
+func wsHandler(c *gin.Context, config config.Config, st store.Store) {
 	// 先从请求头中尝试获取token
 	tokenFromHeader := c.Request.Header.Get("Authorization")
 	token := ""
@@ -70,7 +72,17 @@ func wsHandler(c *gin.Context, config config.Config, db *sql.DB) {
 		return
 	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	// onebot v12 的反向ws通过Sec-WebSocket-Protocol声明版本 格式为 12.<实现名称>
+	protocol := 0
+	implementation := c.Request.Header.Get("User-Agent")
+	var responseHeader http.Header
+	if subprotocol := c.Request.Header.Get("Sec-WebSocket-Protocol"); strings.HasPrefix(subprotocol, "12.") {
+		protocol = structs.ProtocolV12
+		implementation = strings.TrimPrefix(subprotocol, "12.")
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": {subprotocol}}
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
 	if err != nil {
 		mylog.Printf("Failed to set websocket upgrade: %+v", err)
 		return
@@ -84,24 +96,41 @@ func wsHandler(c *gin.Context, config config.Config, db *sql.DB) {
 		Conn: conn,
 	}
 
-	botID := 123
+	// 从请求头中识别机器人 没有X-Self-ID时由首个事件的self_id补全
+	connection := newConnection(c.Request.Header.Get("X-Self-ID"), c.Request.Header.Get("X-Client-Role"), clientIP, implementation, TransportReverseWS)
+	connection.Protocol = protocol
+	registerConnection(connection, st)
+	defer unregisterConnection(connection, st)
 
-	// 发送连接成功的消息
-	message := map[string]interface{}{
-		"meta_event_type": "lifecycle",
-		"post_type":       "meta_event",
-		"self_id":         botID,
-		"sub_type":        "connect",
-		"time":            int(time.Now().Unix()),
-	}
-	err = client.SendMessage(message)
-	if err != nil {
-		mylog.Printf("Error sending connection success message: %v\n", err)
+	// 发送连接成功的消息 v12没有对应的lifecycle事件
+	if protocol != structs.ProtocolV12 {
+		message := map[string]interface{}{
+			"meta_event_type": "lifecycle",
+			"post_type":       "meta_event",
+			"self_id":         idValue(connection.selfID()),
+			"sub_type":        "connect",
+			"time":            int(time.Now().Unix()),
+		}
+		err = client.SendMessage(message)
+		if err != nil {
+			mylog.Printf("Error sending connection success message: %v\n", err)
+		}
 	}
 
 	//退出时候的清理
 	defer conn.Close()
 
+	// 中继模式 为该机器人建立到应用端的连接
+	var relay *Relay
+	if config.RelayURL != "" {
+		relay, err = dialRelay(config, c.Request.Header, client, connection, st)
+		if err != nil {
+			mylog.Printf("Failed to connect relay upstream %s: %v", config.RelayURL, err)
+			return
+		}
+		defer relay.Close()
+	}
+
 	for {
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
@@ -109,67 +138,125 @@ func wsHandler(c *gin.Context, config config.Config, db *sql.DB) {
 			return
 		}
 
+		if relay != nil {
+			relay.ForwardEvent(messageType, p)
+		}
+
 		if messageType == websocket.TextMessage {
-			processWSMessage(p, db, config)
+			captureFrame(connection, DirectionIn, p)
+
+			// action的响应只用于计算耗时 不是事件
+			if relay != nil && relay.CompleteAction(p) {
+				continue
+			}
+			processWSMessage(connection, p, st, config)
 		}
 	}
 }
 
-// 处理收到的信息
-func processWSMessage(msg []byte, db *sql.DB, config config.Config) {
+// 处理收到的信息 ws与http上报共用
+func processWSMessage(conn *Connection, msg []byte, st store.Store, config config.Config) {
 	var genericMap map[string]interface{}
 	if err := json.Unmarshal(msg, &genericMap); err != nil {
 		log.Printf("Error unmarshalling message to map: %v, Original message: %s\n", err, string(msg))
 		return
 	}
 
-	// Assuming there's a way to distinguish notice messages, for example, checking if notice_type exists
-	if noticeType, ok := genericMap["notice_type"].(string); ok && noticeType != "" {
-		var noticeEvent structs.NoticeEvent
-		if err := json.Unmarshal(msg, &noticeEvent); err != nil {
-			log.Printf("Error unmarshalling notice event: %v\n", err)
+	// 每个连接只判断一次协议版本
+	protocol := 0
+	if conn != nil {
+		protocol = conn.protocol()
+	}
+	if protocol == 0 {
+		protocol = detectProtocol(genericMap)
+		if protocol == 0 {
+			log.Printf("Unknown message type or missing post type\n")
 			return
 		}
-		fmt.Printf("Processed a notice event of type '%s' from group %d.\n", noticeEvent.NoticeType, noticeEvent.GroupID)
-		//进入快乐的处理流程 write
-		err := sqlite.ProcessNoticeEvent(db, noticeEvent, config)
-		if err != nil {
-			fmt.Printf("sqlite.ProcessNoticeEvent error %v.\n", err)
+		if conn != nil {
+			conn.setProtocol(protocol)
 		}
-	} else if postType, ok := genericMap["post_type"].(string); ok {
-		switch postType {
-		case "message":
-			var messageEvent structs.MessageEvent
-			if err := json.Unmarshal(msg, &messageEvent); err != nil {
-				log.Printf("Error unmarshalling message event: %v\n", err)
-				return
-			}
+	}
 
-			if config.PrintLogs {
-				fmt.Printf("Processed a message event from group %d.\n", messageEvent.GroupID)
-			}
+	events, err := decodeEvents(msg, genericMap, protocol)
+	if err != nil {
+		log.Printf("Error decoding event: %v\n", err)
+		return
+	}
 
-			//进入快乐的处理流程 write
-			err := sqlite.ProcessMessageEvent(db, messageEvent, config)
-			if err != nil {
-				fmt.Printf("sqlite.ProcessMessageEvent error %v.\n", err)
-			}
-		case "meta_event":
-			var metaEvent structs.MetaEvent
-			if err := json.Unmarshal(msg, &metaEvent); err != nil {
-				log.Printf("Error unmarshalling meta event: %v\n", err)
-				return
-			}
-			fmt.Printf("Processed a meta event, heartbeat interval: %d.\n", metaEvent.Interval)
-			//进入快乐的处理流程 write
-			err := sqlite.ProcessMetaEvent(db, metaEvent)
-			if err != nil {
-				fmt.Printf("sqlite.ProcessMetaEvent error %v.\n", err)
+	for _, event := range events {
+		if event.SelfID == "" && conn != nil {
+			// 事件本身缺少self_id时 使用X-Self-ID补全
+			event.SelfID = conn.selfID()
+		} else {
+			// 连接建立时未携带X-Self-ID 使用首个事件的self_id
+			bindSelfID(conn, event.SelfID, st)
+		}
+		dispatchEvent(conn, event, st, config)
+	}
+}
+
+// 根据事件类型进入对应的统计流程
+func dispatchEvent(conn *Connection, event structs.Event, st store.Store, config config.Config) {
+	switch event.PostType {
+	case "notice":
+		fmt.Printf("Processed a notice event of type '%s' from group %s.\n", event.DetailType, event.GroupID)
+	case "request":
+		fmt.Printf("Processed a %s request event from user %s.\n", event.DetailType, event.UserID)
+	case "message":
+		if config.PrintLogs {
+			fmt.Printf("Processed a message event from group %s.\n", event.GroupID)
+		}
+	case "message_sent":
+		if config.PrintLogs {
+			fmt.Printf("Processed a message sent by %s to group %s.\n", event.SelfID, event.GroupID)
+		}
+	case "meta_event":
+		switch event.DetailType {
+		case "lifecycle":
+			handleLifecycle(conn, event.SubType, st)
+			return
+		case "connect":
+			// v12的connect元事件携带实现名称
+			if conn != nil {
+				conn.setImplementation(event.Implementation)
 			}
+			return
 		}
-	} else {
-		log.Printf("Unknown message type or missing post type\n")
+		fmt.Printf("Processed a %s meta event from %s.\n", event.DetailType, event.SelfID)
+	default:
+		return
+	}
+
+	//进入快乐的处理流程 write 由写入队列批量写入
+	if err := st.SubmitEvent(event); err != nil {
+		fmt.Printf("store.SubmitEvent error %v.\n", err)
+	}
+}
+
+// 处理发往机器人的action 中继模式下由应用端发出 发送消息类的action计入回复统计
+func processOutgoingAction(conn *Connection, action structs.ActionMessage, st store.Store, config config.Config) {
+	if conn == nil {
+		return
 	}
+	selfID := conn.selfID()
+	if selfID == "" {
+		return
+	}
+
+	event, ok := action.NormalizeSend(selfID)
+	if !ok {
+		return
+	}
+	dispatchEvent(conn, event, st, config)
+}
+
+// 数字id按数字发送 兼容只接受数字self_id的v11实现
+func idValue(id string) interface{} {
+	if number, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return number
+	}
+	return id
 }
 
 // 发信息给client
@@ -179,7 +266,14 @@ func (c *WebSocketServerClient) SendMessage(message map[string]interface{}) erro
 		mylog.Println("Error marshalling message:", err)
 		return err
 	}
-	return c.Conn.WriteMessage(websocket.TextMessage, msgBytes)
+	return c.SendRaw(websocket.TextMessage, msgBytes)
+}
+
+// 原样发送一帧给client
+func (c *WebSocketServerClient) SendRaw(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
 }
 
 func (client *WebSocketServerClient) Close() error {
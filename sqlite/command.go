@@ -0,0 +1,142 @@
+package sqlite
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// RecomputeCommandStats 按当前的指令规则用储存的消息重新统计指令和闲聊
+// 每个机器人只重新统计最早一条储存的消息之后的日期 累计调用次数减去这些日期原有的次数后加上新的次数
+// 每天在单独的事务中读取消息并写入 写入队列只需等待一天的消息
+func (s *Store) RecomputeCommandStats() (*structs.CommandRecompute, error) {
+	start := time.Now()
+	result := &structs.CommandRecompute{Since: make(map[string]string)}
+
+	rows, err := s.db.Query("SELECT CAST(self_id AS TEXT), date(MIN(message_date)), date(MAX(message_date)) FROM messages GROUP BY self_id")
+	if err != nil {
+		return nil, fmt.Errorf("error reading message dates: %w", err)
+	}
+	first, last := "", store.Now().Format("2006-01-02")
+	for rows.Next() {
+		var selfID, since, until string
+		if err := rows.Scan(&selfID, &since, &until); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error reading message dates: %w", err)
+		}
+		result.Since[selfID] = since
+		if first == "" || since < first {
+			first = since
+		}
+		if until > last {
+			last = until
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading message dates: %w", err)
+	}
+
+	if first != "" {
+		day, err := time.Parse("2006-01-02", first)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing message date %s: %w", first, err)
+		}
+		for date := first; date <= last; date = day.Format("2006-01-02") {
+			if err := s.recomputeCommandDay(date, result); err != nil {
+				return nil, err
+			}
+			day = day.AddDate(0, 0, 1)
+		}
+	}
+	if _, err := s.db.Exec("DELETE FROM command_stats WHERE total_calls <= 0"); err != nil {
+		return nil, fmt.Errorf("error deleting empty command stats: %w", err)
+	}
+
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// 重新统计一天的指令和闲聊 只处理这一天已在重新统计范围内的机器人
+func (s *Store) recomputeCommandDay(date string, result *structs.CommandRecompute) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT CAST(self_id AS TEXT), "+messageGroupIDSQL+", COALESCE(raw_message, ''), time, "+
+		messageSceneSQL+" FROM messages WHERE message_date = ? ORDER BY time", date)
+	if err != nil {
+		return fmt.Errorf("error reading messages of %s: %w", date, err)
+	}
+	b := newBatch(tx)
+	botCommands := make(map[hourlyKey]int)
+	for rows.Next() {
+		var selfID, groupID, rawMessage, scene string
+		var timestamp int64
+		if err := rows.Scan(&selfID, &groupID, &rawMessage, &timestamp, &scene); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading messages of %s: %w", date, err)
+		}
+		result.Messages++
+
+		commandName := store.ParseCommandName(selfID, rawMessage)
+		b.countMessageKind(commandName, groupID, selfID, date)
+		if commandName == "" {
+			continue
+		}
+		result.Commands++
+		hour := store.EventHour(structs.Event{Time: timestamp})
+		b.countCommand(commandName, selfID, scene, date, timestamp)
+		b.hourlyCommands[hourlyKey{selfID: selfID, id: commandName, date: date, hour: hour}]++
+		botCommands[hourlyKey{selfID: selfID, date: date, hour: hour}]++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading messages of %s: %w", date, err)
+	}
+
+	// 先去掉这一天原有的统计
+	clearSQL := []string{
+		`UPDATE command_stats SET total_calls = command_stats.total_calls - d.calls,
+             private_calls = command_stats.private_calls - d.private_calls,
+             group_calls = command_stats.group_calls - d.group_calls,
+             guild_calls = command_stats.guild_calls - d.guild_calls
+         FROM (SELECT self_id, command_name, SUM(calls) AS calls, SUM(private_calls) AS private_calls,
+                   SUM(group_calls) AS group_calls, SUM(guild_calls) AS guild_calls
+               FROM daily_command_stats WHERE date = ? GROUP BY self_id, command_name) d
+         WHERE command_stats.self_id = ? AND d.self_id = command_stats.self_id AND d.command_name = command_stats.command_name`,
+		"DELETE FROM daily_command_stats WHERE date = ? AND self_id = ?",
+		"DELETE FROM hourly_command_stats WHERE date = ? AND self_id = ?",
+		"UPDATE hourly_bot_stats SET commands = 0 WHERE date = ? AND self_id = ?",
+		"DELETE FROM daily_message_kind_stats WHERE date = ? AND self_id = ?",
+	}
+	for selfID, since := range result.Since {
+		if date < since {
+			continue
+		}
+		for _, statement := range clearSQL {
+			if _, err := tx.Exec(statement, date, selfID); err != nil {
+				return fmt.Errorf("error clearing command stats of %s: %w", selfID, err)
+			}
+		}
+	}
+
+	if err := b.flushCounters(); err != nil {
+		return err
+	}
+	for key, commands := range botCommands {
+		if _, err := tx.Exec("UPDATE hourly_bot_stats SET commands = ? WHERE self_id = ? AND date = ? AND hour = ?",
+			commands, key.selfID, key.date, key.hour); err != nil {
+			return fmt.Errorf("error updating hourly bot stats: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing recomputed command stats of %s: %w", date, err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package sqlite
+
+import (
+	"testing"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// 修改指令规则后按天重新统计 之前计为指令的闲聊从排行中去掉
+func TestRecomputeCommandStats(t *testing.T) {
+	db := openTestDB(t)
+	cfg := config.Config{StoreMsgs: true}
+	t.Cleanup(func() { store.SetCommandRules(nil) })
+	if err := store.SetCommandRules(nil); err != nil {
+		t.Fatalf("SetCommandRules: %v", err)
+	}
+
+	yesterday := func(event structs.Event) structs.Event {
+		event.Time -= 86400
+		return event
+	}
+	events := []structs.Event{
+		yesterday(testMessage("1", "1", "/help")),
+		yesterday(testMessage("2", "1", "hello")),
+		testMessage("3", "1", "/help"),
+		testMessage("4", "2", "hi"),
+	}
+	if failed, err := processBatch(db, events, cfg, nil); err != nil || failed != 0 {
+		t.Fatalf("processBatch failed %d events: %v", failed, err)
+	}
+
+	if err := store.SetCommandRules([]config.CommandRule{{Prefixes: []string{"/"}}}); err != nil {
+		t.Fatalf("SetCommandRules: %v", err)
+	}
+	st := NewStore(db, cfg)
+	result, err := st.RecomputeCommandStats()
+	if err != nil {
+		t.Fatalf("RecomputeCommandStats: %v", err)
+	}
+	if result.Messages != 4 || result.Commands != 2 || result.Since["10"] != store.EventDate(events[0]) {
+		t.Fatalf("recompute result = %+v, want 4 messages with 2 commands since %s", result, store.EventDate(events[0]))
+	}
+
+	commands, err := st.FetchTopCommands("10", "", 10)
+	if err != nil {
+		t.Fatalf("FetchTopCommands: %v", err)
+	}
+	if len(commands) != 1 || commands[0].CommandName != "help" || commands[0].TotalCalls != 2 || commands[0].GroupCalls != 2 {
+		t.Fatalf("top commands = %+v, want help with 2 group calls", commands)
+	}
+	var commandCount, chats int
+	if err := db.QueryRow("SELECT SUM(commands), SUM(chats) FROM daily_message_kind_stats").Scan(&commandCount, &chats); err != nil {
+		t.Fatalf("read message kinds: %v", err)
+	}
+	if commandCount != 2 || chats != 2 {
+		t.Fatalf("message kinds = %d commands %d chats, want 2 and 2", commandCount, chats)
+	}
+}
@@ -0,0 +1,204 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+)
+
+// 汇总间隔
+const latencyInterval = 10 * time.Minute
+
+// MonitorCommandLatency 定期汇总今天和昨天的指令响应耗时
+func MonitorCommandLatency(db *sql.DB) {
+	go func() {
+		ticker := time.NewTicker(latencyInterval)
+		defer ticker.Stop()
+
+		for {
+			now := store.Now()
+			// 跨天后昨天最后一段时间的回复也需要计入
+			for _, date := range []time.Time{now.AddDate(0, 0, -1), now} {
+				if err := ComputeDailyCommandLatency(db, date); err != nil {
+					log.Printf("Error computing command latency for %s: %v", date.Format("2006-01-02"), err)
+				}
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// ComputeDailyCommandLatency 根据当天储存的消息和机器人发出的消息 计算每个指令的响应耗时分布
+// 回复优先通过reply段对应到原消息 否则对应到同一群或私聊中回复窗口内最近一条尚未回复的指令
+// 每条指令只取机器人的第一条回复 闲聊不会被当作回复的对象
+func ComputeDailyCommandLatency(db *sql.DB, date time.Time) error {
+	currentDate := date.Format("2006-01-02")
+	previousDate := date.AddDate(0, 0, -1).Format("2006-01-02")
+
+	// 回复窗口可能跨过零点 同时读取前一天的回复和前两天的指令
+	// 前一天的回复只用于标记已回复的指令 不计入当天的耗时
+	commands, err := loadCommandMessages(db, date.AddDate(0, 0, -2).Format("2006-01-02"), currentDate)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT CAST(self_id AS TEXT), COALESCE(CAST(group_id AS TEXT), ''), COALESCE(CAST(user_id AS TEXT), ''), COALESCE(reply_to, ''), time, message_date
+	FROM sent_messages WHERE message_date BETWEEN ? AND ? ORDER BY time ASC`, previousDate, currentDate)
+	if err != nil {
+		return fmt.Errorf("error querying command replies: %w", err)
+	}
+	var sent []latencyReply
+	for rows.Next() {
+		var reply latencyReply
+		var replyDate time.Time
+		if err := rows.Scan(&reply.selfID, &reply.groupID, &reply.userID, &reply.replyTo, &reply.time, &replyDate); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading command replies: %w", err)
+		}
+		reply.current = replyDate.Format("2006-01-02") == currentDate
+		sent = append(sent, reply)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error during rows iteration: %w", err)
+	}
+
+	type latencyKey struct {
+		selfID      string
+		commandName string
+	}
+	latencies := make(map[latencyKey][]int64)
+	answered := make(map[int64]bool)
+	for _, reply := range sent {
+		target, ok, err := replyTarget(db, reply, commands, answered)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		answered[target.rowID] = true
+		if !reply.current {
+			continue
+		}
+		key := latencyKey{selfID: reply.selfID, commandName: target.commandName}
+		latencies[key] = append(latencies[key], reply.time-target.time)
+	}
+
+	// 每次重新计算整天的数据 保证幂等
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM daily_command_latency WHERE date = ?", currentDate); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error clearing command latency: %w", err)
+	}
+
+	insertSQL := `
+	INSERT INTO daily_command_latency (command_name, self_id, date, samples, avg_latency, p50, p90, p99, max_latency)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	for key, values := range latencies {
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		var total int64
+		for _, value := range values {
+			total += value
+		}
+		avg := float64(total) / float64(len(values))
+		if _, err := tx.Exec(insertSQL, key.commandName, key.selfID, currentDate, len(values), avg,
+			store.Percentile(values, 50), store.Percentile(values, 90), store.Percentile(values, 99), values[len(values)-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error inserting command latency: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// 机器人发出的一条消息
+type latencyReply struct {
+	selfID  string
+	groupID string
+	userID  string
+	replyTo string
+	time    int64
+	current bool // 是否为正在计算的那一天的回复
+}
+
+// 一条指令消息
+type latencyCommand struct {
+	rowID       int64
+	time        int64
+	commandName string
+}
+
+// 群或私聊会话 与回复的对应范围一致
+func conversationKey(selfID, groupID, userID string) string {
+	if groupID != "" {
+		return selfID + ":group:" + groupID
+	}
+	return selfID + ":private:" + userID
+}
+
+// 读取日期范围内的指令消息 按会话分组 每组按时间排序
+func loadCommandMessages(db *sql.DB, startDate, endDate string) (map[string][]latencyCommand, error) {
+	rows, err := db.Query(`SELECT message_id, CAST(self_id AS TEXT), `+messageGroupIDSQL+`, COALESCE(CAST(user_id AS TEXT), ''), time, COALESCE(raw_message, '')
+	FROM messages WHERE message_date BETWEEN ? AND ? ORDER BY time ASC`, startDate, endDate)
+	if err != nil {
+		return nil, fmt.Errorf("error querying command messages: %w", err)
+	}
+	defer rows.Close()
+
+	commands := make(map[string][]latencyCommand)
+	for rows.Next() {
+		var command latencyCommand
+		var selfID, groupID, userID, rawMessage string
+		if err := rows.Scan(&command.rowID, &selfID, &groupID, &userID, &command.time, &rawMessage); err != nil {
+			return nil, fmt.Errorf("error reading command messages: %w", err)
+		}
+		if command.commandName = store.ParseCommandName(selfID, rawMessage); command.commandName == "" {
+			continue
+		}
+		key := conversationKey(selfID, groupID, userID)
+		commands[key] = append(commands[key], command)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+	return commands, nil
+}
+
+// 回复对应的指令 reply段引用的消息已储存时只对应该消息 引用的是闲聊或已回复的指令时不对应
+// 否则为同一会话回复窗口内最近一条尚未回复的指令
+func replyTarget(db *sql.DB, reply latencyReply, commands map[string][]latencyCommand, answered map[int64]bool) (latencyCommand, bool, error) {
+	if reply.replyTo != "" {
+		var target latencyCommand
+		var rawMessage string
+		err := db.QueryRow("SELECT message_id, time, COALESCE(raw_message, '') FROM messages WHERE self_id = ? AND original_id = ?",
+			reply.selfID, reply.replyTo).Scan(&target.rowID, &target.time, &rawMessage)
+		if err == nil {
+			target.commandName = store.ParseCommandName(reply.selfID, rawMessage)
+			return target, target.commandName != "" && !answered[target.rowID], nil
+		}
+		if err != sql.ErrNoRows {
+			return latencyCommand{}, false, fmt.Errorf("error querying replied message: %w", err)
+		}
+	}
+
+	candidates := commands[conversationKey(reply.selfID, reply.groupID, reply.userID)]
+	for i := len(candidates) - 1; i >= 0; i-- {
+		command := candidates[i]
+		if command.time > reply.time || answered[command.rowID] {
+			continue
+		}
+		if command.time < reply.time-store.ReplyWindow {
+			break
+		}
+		return command, true, nil
+	}
+	return latencyCommand{}, false, nil
+}
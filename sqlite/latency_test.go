@@ -0,0 +1,113 @@
+package sqlite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+func testReply(messageID string, replyTo string, at int64) structs.Event {
+	event := structs.Event{
+		PostType:   "message_sent",
+		DetailType: "group",
+		Time:       at,
+		SelfID:     "10",
+		MessageID:  messageID,
+		GroupID:    "100",
+		RawMessage: "ok",
+	}
+	if replyTo != "" {
+		event.Message = []interface{}{
+			map[string]interface{}{"type": "reply", "data": map[string]interface{}{"id": replyTo}},
+		}
+	}
+	return event
+}
+
+// 指令和回复之间有闲聊时 回复仍对应到尚未回复的指令 引用闲聊的回复不对应任何指令
+func TestCommandLatencySkipsChat(t *testing.T) {
+	if err := store.SetCommandRules([]config.CommandRule{{Prefixes: []string{"/"}}}); err != nil {
+		t.Fatalf("SetCommandRules: %v", err)
+	}
+	t.Cleanup(func() { store.SetCommandRules(nil) })
+
+	db := openTestDB(t)
+	cfg := config.Config{StoreMsgs: true}
+	date := time.Date(2026, 1, 2, 12, 0, 0, 0, time.Local)
+	base := date.Unix()
+	at := func(message structs.Event, offset int64) structs.Event {
+		message.Time = base + offset
+		return message
+	}
+	events := []structs.Event{
+		at(testMessage("1", "1", "/help"), 0),
+		at(testMessage("2", "2", "hello"), 5),
+		testReply("s1", "", base+10),
+		testReply("s2", "", base+20),
+		at(testMessage("3", "3", "/sign"), 30),
+		at(testMessage("4", "1", "lol"), 31),
+		testReply("s3", "4", base+32),
+		testReply("s4", "3", base+33),
+	}
+	if failed, err := processBatch(db, events, cfg, nil); err != nil || failed != 0 {
+		t.Fatalf("processBatch failed %d events: %v", failed, err)
+	}
+	if err := ComputeDailyCommandLatency(db, date); err != nil {
+		t.Fatalf("ComputeDailyCommandLatency: %v", err)
+	}
+
+	stats, err := NewStore(db, cfg).FetchDailyCommandLatency("10", date, 10)
+	if err != nil {
+		t.Fatalf("FetchDailyCommandLatency: %v", err)
+	}
+	got := make(map[string][2]int64)
+	for _, stat := range stats {
+		got[stat.CommandName] = [2]int64{int64(stat.Samples), stat.MaxLatency}
+	}
+	want := map[string][2]int64{"help": {1, 10}, "sign": {1, 3}}
+	if len(got) != len(want) || got["help"] != want["help"] || got["sign"] != want["sign"] {
+		t.Fatalf("latencies (samples, max) = %v, want %v", got, want)
+	}
+}
+
+// 前一天零点前已回复的指令 不会再被当天的第一条回复对应
+func TestCommandLatencyAcrossMidnight(t *testing.T) {
+	db := openTestDB(t)
+	cfg := config.Config{StoreMsgs: true}
+	date := time.Date(2026, 1, 2, 0, 0, 0, 0, time.Local)
+	midnight := date.Unix()
+	command := testMessage("1", "1", "/help")
+	command.Time = midnight - 60
+	events := []structs.Event{
+		command,
+		testReply("s1", "", midnight-50),
+		testReply("s2", "", midnight+30),
+	}
+	if failed, err := processBatch(db, events, cfg, nil); err != nil || failed != 0 {
+		t.Fatalf("processBatch failed %d events: %v", failed, err)
+	}
+
+	st := NewStore(db, cfg)
+	for _, day := range []time.Time{date.AddDate(0, 0, -1), date} {
+		if err := ComputeDailyCommandLatency(db, day); err != nil {
+			t.Fatalf("ComputeDailyCommandLatency: %v", err)
+		}
+	}
+	yesterday, err := st.FetchDailyCommandLatency("10", date.AddDate(0, 0, -1), 10)
+	if err != nil {
+		t.Fatalf("FetchDailyCommandLatency: %v", err)
+	}
+	if len(yesterday) != 1 || yesterday[0].Samples != 1 || yesterday[0].MaxLatency != 10 {
+		t.Fatalf("yesterday latencies = %+v, want one sample of 10s", yesterday)
+	}
+	today, err := st.FetchDailyCommandLatency("10", date, 10)
+	if err != nil {
+		t.Fatalf("FetchDailyCommandLatency: %v", err)
+	}
+	if len(today) != 0 {
+		t.Fatalf("today latencies = %+v, want none", today)
+	}
+}
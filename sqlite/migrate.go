@@ -0,0 +1,1034 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// Migration 一次数据库结构变更 版本号必须递增 Up和Down需要符合幂等性 部分执行或执行后未记录版本时可以重新执行
+// Down为nil的变更无法回退
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(db *sql.DB) error
+	Down    func(db *sql.DB) error
+}
+
+// migrations 按版本号排列的所有变更 新的表和字段变更都应追加到末尾 不要修改已发布的变更
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up:      ensureBaselineTables,
+	},
+	{
+		Version: 2,
+		Name:    "per_bot_user_stats",
+		Up:      migratePerBotUserStatsUp,
+		Down:    migratePerBotUserStatsDown,
+	},
+	{
+		Version: 3,
+		Name:    "incremental_vacuum",
+		Up:      migrateIncrementalVacuumUp,
+		Down:    migrateIncrementalVacuumDown,
+	},
+	{
+		Version: 4,
+		Name:    "hourly_stats",
+		Up:      migrateHourlyStatsUp,
+		Down:    migrateHourlyStatsDown,
+	},
+	{
+		Version: 5,
+		Name:    "message_segments",
+		Up:      migrateMessageSegmentsUp,
+		Down:    migrateMessageSegmentsDown,
+	},
+	{
+		Version: 6,
+		Name:    "message_kinds",
+		Up:      migrateMessageKindsUp,
+		Down:    migrateMessageKindsDown,
+	},
+	{
+		Version: 7,
+		Name:    "message_scenes",
+		Up:      migrateMessageScenesUp,
+		Down:    migrateMessageScenesDown,
+	},
+	{
+		Version: 8,
+		Name:    "user_first_seen",
+		Up:      migrateUserFirstSeenUp,
+		Down:    migrateUserFirstSeenDown,
+	},
+	{
+		Version: 9,
+		Name:    "message_original_ids",
+		Up:      migrateMessageOriginalIDsUp,
+		Down:    migrateMessageOriginalIDsDown,
+	},
+}
+
+// 引入迁移前的所有表 对已有数据库执行也是安全的
+func ensureBaselineTables(db *sql.DB) error {
+	ensures := []func(*sql.DB) error{
+		EnsureCookieTablesExist,             //网页登入cookie表
+		EnsureMessagesTableExists,           //全量收信息表
+		EnsureRobotStatusTableExists,        //机器人状态表
+		EnsureUserStatsTableExists,          //用户统计表
+		EnsureGroupStatsTableExists,         //群统计表
+		EnsureCommandStatsTables,            //指令统计表
+		EnsureAPITableExists,                //api状态表
+		EnsureConnectionSessionsTableExists, //连接会话表
+		EnsureReplyStatsTablesExist,         //发出消息和回复统计表
+		EnsureActionStatsTableExists,        //中继action统计表
+		EnsureCommandLatencyTableExists,     //指令响应耗时表
+		EnsureRequestEventsTableExists,      //好友请求与加群邀请表
+		EnsureNoticeEventsTablesExist,       //通知事件明细与每日汇总表
+	}
+	for _, ensure := range ensures {
+		if err := ensure(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 返回表的主键列 按在主键中的顺序排列
+func primaryKeyColumns(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s table info: %w", table, err)
+	}
+	defer rows.Close()
+
+	keys := make(map[int]string)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, fmt.Errorf("error reading %s table info: %w", table, err)
+		}
+		if pk > 0 {
+			keys[pk] = name
+		}
+	}
+	columns := make([]string, 0, len(keys))
+	for i := 1; i <= len(keys); i++ {
+		columns = append(columns, keys[i])
+	}
+	return columns, rows.Err()
+}
+
+// 主键与期望不同时按新的建表语句重建表
+func rebuildWithPrimaryKey(db *sql.DB, table string, primaryKey []string, createTableSQL, selectSQL string) error {
+	columns, err := primaryKeyColumns(db, table)
+	if err != nil {
+		return err
+	}
+	if strings.Join(columns, ",") == strings.Join(primaryKey, ",") {
+		return nil
+	}
+	return rebuildTable(db, table, createTableSQL, selectSQL)
+}
+
+// 用户统计按机器人区分 并新增按群区分的用户统计
+// 同一用户在多个机器人或多个群中发言时不再互相覆盖
+func migratePerBotUserStatsUp(db *sql.DB) error {
+	userStatsSQL := `
+    CREATE TABLE user_stats (
+        user_id BIGINT,
+        self_id BIGINT,
+        nickname TEXT,
+        role TEXT,
+        total_messages_sent INTEGER DEFAULT 0,
+        last_message_timestamp INTEGER,
+        consecutive_message_days INTEGER DEFAULT 0,
+        PRIMARY KEY (user_id, self_id)
+    );`
+	if err := rebuildWithPrimaryKey(db, "user_stats", []string{"user_id", "self_id"}, userStatsSQL,
+		"SELECT user_id, self_id, nickname, role, total_messages_sent, last_message_timestamp, consecutive_message_days FROM user_stats_old"); err != nil {
+		return err
+	}
+
+	dailyUserStatsSQL := `
+    CREATE TABLE daily_user_stats (
+        user_id BIGINT,
+        self_id BIGINT,
+        date DATE NOT NULL,
+        nickname TEXT,
+        role TEXT,
+        messages_sent INTEGER DEFAULT 0,
+        last_message_timestamp INTEGER,
+        included_in_group_count BOOLEAN DEFAULT FALSE,
+        PRIMARY KEY (user_id, self_id, date)
+    );`
+	if err := rebuildWithPrimaryKey(db, "daily_user_stats", []string{"user_id", "self_id", "date"}, dailyUserStatsSQL,
+		"SELECT user_id, self_id, date, nickname, role, messages_sent, last_message_timestamp, included_in_group_count FROM daily_user_stats_old"); err != nil {
+		return err
+	}
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS group_user_stats (
+            self_id BIGINT,
+            group_id BIGINT,
+            user_id BIGINT,
+            nickname TEXT,
+            card TEXT,
+            role TEXT,
+            total_messages_sent INTEGER DEFAULT 0,
+            first_message_timestamp INTEGER,
+            last_message_timestamp INTEGER,
+            PRIMARY KEY (self_id, group_id, user_id)
+        );`,
+		`CREATE TABLE IF NOT EXISTS daily_group_user_stats (
+            self_id BIGINT,
+            group_id BIGINT,
+            user_id BIGINT,
+            date DATE NOT NULL,
+            messages_sent INTEGER DEFAULT 0,
+            last_message_timestamp INTEGER,
+            PRIMARY KEY (self_id, group_id, user_id, date)
+        );`,
+		"CREATE INDEX IF NOT EXISTS idx_user_self_id ON user_stats (self_id);",
+		"CREATE INDEX IF NOT EXISTS idx_daily_user_self_date ON daily_user_stats (self_id, date);",
+		"CREATE INDEX IF NOT EXISTS idx_group_user_user ON group_user_stats (user_id);",
+		"CREATE INDEX IF NOT EXISTS idx_daily_group_user_date ON daily_group_user_stats (self_id, group_id, date);",
+		// 储存了消息时 用已有的消息补全按群的统计 昵称和身份等到下次发言时补全
+		`INSERT OR IGNORE INTO group_user_stats (self_id, group_id, user_id, total_messages_sent, first_message_timestamp, last_message_timestamp)
+         SELECT self_id, group_id, user_id, COUNT(*), MIN(time), MAX(time) FROM messages
+         WHERE message_type = 'group' GROUP BY self_id, group_id, user_id;`,
+		`INSERT OR IGNORE INTO daily_group_user_stats (self_id, group_id, user_id, date, messages_sent, last_message_timestamp)
+         SELECT self_id, group_id, user_id, message_date, COUNT(*), MAX(time) FROM messages
+         WHERE message_type = 'group' GROUP BY self_id, group_id, user_id, message_date;`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("error creating group user stats: %w", err)
+		}
+	}
+	return nil
+}
+
+// 回退为全局的用户统计 同一用户在多个机器人下的数据合并为一行
+func migratePerBotUserStatsDown(db *sql.DB) error {
+	for _, table := range []string{"group_user_stats", "daily_group_user_stats"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			return fmt.Errorf("error dropping %s: %w", table, err)
+		}
+	}
+
+	userStatsSQL := `
+    CREATE TABLE user_stats (
+        user_id BIGINT PRIMARY KEY,
+        self_id BIGINT,
+        nickname TEXT,
+        role TEXT,
+        total_messages_sent INTEGER DEFAULT 0,
+        last_message_timestamp INTEGER,
+        consecutive_message_days INTEGER DEFAULT 0
+    );`
+	if err := rebuildWithPrimaryKey(db, "user_stats", []string{"user_id"}, userStatsSQL,
+		`SELECT user_id, MAX(self_id), MAX(nickname), MAX(role), SUM(total_messages_sent), MAX(last_message_timestamp), MAX(consecutive_message_days)
+         FROM user_stats_old GROUP BY user_id`); err != nil {
+		return err
+	}
+
+	dailyUserStatsSQL := `
+    CREATE TABLE daily_user_stats (
+        user_id INTEGER,
+        self_id BIGINT,
+        date DATE NOT NULL,
+        nickname TEXT,
+        role TEXT,
+        messages_sent INTEGER DEFAULT 0,
+        last_message_timestamp INTEGER,
+        included_in_group_count BOOLEAN DEFAULT FALSE,
+        PRIMARY KEY (user_id, date)
+    );`
+	if err := rebuildWithPrimaryKey(db, "daily_user_stats", []string{"user_id", "date"}, dailyUserStatsSQL,
+		`SELECT user_id, MAX(self_id), date, MAX(nickname), MAX(role), SUM(messages_sent), MAX(last_message_timestamp), MIN(included_in_group_count)
+         FROM daily_user_stats_old GROUP BY user_id, date`); err != nil {
+		return err
+	}
+
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_user_self_id ON user_stats (self_id);")
+	return err
+}
+
+// MigrationStatus 一个变更的执行情况 未执行时AppliedAt为0
+type MigrationStatus struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt int64  `json:"applied_at"`
+}
+
+func ensureSchemaMigrationsTableExists(db *sql.DB) error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT,
+        applied_at INTEGER
+    );`
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// FetchMigrationStatus 返回所有变更及其执行时间
+func FetchMigrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	if err := ensureSchemaMigrationsTableExists(db); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]int64)
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error querying schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error reading schema_migrations: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		statuses = append(statuses, MigrationStatus{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			AppliedAt: applied[migration.Version],
+		})
+	}
+	return statuses, nil
+}
+
+// MigrateUp 执行版本不超过target的所有未执行变更 target为0时执行全部 执行前会备份数据库
+// 变更中的重建和补全各自在事务中提交 与版本记录不在同一事务 进程在两者之间退出时下次启动会重新执行该变更
+// 所以Up必须幂等 已有的数据不会被重复补全或累加
+func MigrateUp(db *sql.DB, target int) error {
+	statuses, err := FetchMigrationStatus(db)
+	if err != nil {
+		return err
+	}
+
+	var pending []Migration
+	for i, status := range statuses {
+		if status.AppliedAt == 0 && (target == 0 || status.Version <= target) {
+			pending = append(pending, migrations[i])
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := backupDatabase(db); err != nil {
+		return err
+	}
+
+	for _, migration := range pending {
+		log.Printf("Applying migration %d %s", migration.Version, migration.Name)
+		if err := migration.Up(db); err != nil {
+			return fmt.Errorf("error applying migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		if _, err := db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", migration.Version, migration.Name, time.Now().Unix()); err != nil {
+			return fmt.Errorf("error recording migration %d: %w", migration.Version, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown 从最新的变更开始回退 直到只保留版本不超过target的变更 执行前会备份数据库
+func MigrateDown(db *sql.DB, target int) error {
+	statuses, err := FetchMigrationStatus(db)
+	if err != nil {
+		return err
+	}
+
+	var rollback []Migration
+	for i := len(statuses) - 1; i >= 0; i-- {
+		if statuses[i].AppliedAt != 0 && statuses[i].Version > target {
+			rollback = append(rollback, migrations[i])
+		}
+	}
+	if len(rollback) == 0 {
+		return nil
+	}
+	for _, migration := range rollback {
+		if migration.Down == nil {
+			return fmt.Errorf("migration %d %s cannot be reverted", migration.Version, migration.Name)
+		}
+	}
+
+	if err := backupDatabase(db); err != nil {
+		return err
+	}
+
+	for _, migration := range rollback {
+		log.Printf("Reverting migration %d %s", migration.Version, migration.Name)
+		if err := migration.Down(db); err != nil {
+			return fmt.Errorf("error reverting migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		if _, err := db.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version); err != nil {
+			return fmt.Errorf("error recording migration %d: %w", migration.Version, err)
+		}
+	}
+	return nil
+}
+
+// 开启增量vacuum 清理过期数据后可以逐步归还空闲页 并为按日期清理通知明细增加索引
+func migrateIncrementalVacuumUp(db *sql.DB) error {
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_notice_date ON notice_events (notice_date)"); err != nil {
+		return fmt.Errorf("error creating notice date index: %w", err)
+	}
+	return setAutoVacuum(db, "INCREMENTAL")
+}
+
+func migrateIncrementalVacuumDown(db *sql.DB) error {
+	if _, err := db.Exec("DROP INDEX IF EXISTS idx_notice_date"); err != nil {
+		return fmt.Errorf("error dropping notice date index: %w", err)
+	}
+	return setAutoVacuum(db, "NONE")
+}
+
+// 按小时的统计 用于查看高峰时段和时段内的故障影响
+func migrateHourlyStatsUp(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS hourly_bot_stats (
+            self_id BIGINT,
+            date DATE NOT NULL,
+            hour INTEGER NOT NULL,
+            messages INTEGER DEFAULT 0,
+            active_users INTEGER DEFAULT 0,
+            active_groups INTEGER DEFAULT 0,
+            commands INTEGER DEFAULT 0,
+            PRIMARY KEY (self_id, date, hour)
+        );`,
+		`CREATE TABLE IF NOT EXISTS hourly_user_stats (
+            self_id BIGINT,
+            user_id BIGINT,
+            date DATE NOT NULL,
+            hour INTEGER NOT NULL,
+            messages_sent INTEGER DEFAULT 0,
+            PRIMARY KEY (self_id, user_id, date, hour)
+        );`,
+		`CREATE TABLE IF NOT EXISTS hourly_group_stats (
+            self_id BIGINT,
+            group_id BIGINT,
+            date DATE NOT NULL,
+            hour INTEGER NOT NULL,
+            messages_sent INTEGER DEFAULT 0,
+            PRIMARY KEY (self_id, group_id, date, hour)
+        );`,
+		`CREATE TABLE IF NOT EXISTS hourly_command_stats (
+            self_id BIGINT,
+            command_name TEXT,
+            date DATE NOT NULL,
+            hour INTEGER NOT NULL,
+            calls INTEGER DEFAULT 0,
+            PRIMARY KEY (self_id, command_name, date, hour)
+        );`,
+		"CREATE INDEX IF NOT EXISTS idx_hourly_user_date ON hourly_user_stats (date);",
+		"CREATE INDEX IF NOT EXISTS idx_hourly_group_date ON hourly_group_stats (self_id, date);",
+		"CREATE INDEX IF NOT EXISTS idx_hourly_command_date ON hourly_command_stats (self_id, date);",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("error creating hourly stats: %w", err)
+		}
+	}
+	return backfillHourlyStats(db)
+}
+
+// 储存了消息时 用已有的消息补全按小时的统计 日期和小时按统计时区计算 指令按当前的指令规则提取
+// 已有统计的数据库不重复补全
+func backfillHourlyStats(db *sql.DB) error {
+	var existing int
+	if err := db.QueryRow("SELECT COUNT(*) FROM hourly_bot_stats").Scan(&existing); err != nil {
+		return fmt.Errorf("error counting hourly stats: %w", err)
+	}
+	if existing > 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT CAST(self_id AS TEXT), COALESCE(CAST(user_id AS TEXT), ''), " + messageGroupIDSQL + ", COALESCE(raw_message, ''), time FROM messages")
+	if err != nil {
+		return fmt.Errorf("error reading messages: %w", err)
+	}
+	b := newBatch(tx)
+	for rows.Next() {
+		var event structs.Event
+		if err := rows.Scan(&event.SelfID, &event.UserID, &event.GroupID, &event.RawMessage, &event.Time); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading messages: %w", err)
+		}
+		b.countHourly(event, store.ParseCommandName(event.SelfID, event.RawMessage), store.EventDate(event))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading messages: %w", err)
+	}
+
+	if err := b.flushHourlyCounters(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateHourlyStatsDown(db *sql.DB) error {
+	for _, table := range []string{"hourly_bot_stats", "hourly_user_stats", "hourly_group_stats", "hourly_command_stats"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			return fmt.Errorf("error dropping %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// 储存的消息的群号 旧版本的私聊消息group_id为0 与新的写入一致按空字符串统计
+const messageGroupIDSQL = "COALESCE(CAST(NULLIF(group_id, 0) AS TEXT), '')"
+
+// 消息段明细和按消息段类型的每日统计 私聊消息的group_id为空
+func migrateMessageSegmentsUp(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS message_segments (
+            message_id INTEGER NOT NULL,
+            seq INTEGER NOT NULL,
+            self_id BIGINT,
+            segment_type TEXT,
+            data TEXT,
+            message_date DATE,
+            PRIMARY KEY (message_id, seq)
+        );`,
+		`CREATE TABLE IF NOT EXISTS daily_segment_stats (
+            self_id BIGINT,
+            group_id BIGINT,
+            date DATE NOT NULL,
+            segment_type TEXT,
+            segments INTEGER DEFAULT 0,
+            messages INTEGER DEFAULT 0,
+            at_self INTEGER DEFAULT 0,
+            PRIMARY KEY (self_id, group_id, date, segment_type)
+        );`,
+		"CREATE INDEX IF NOT EXISTS idx_message_segments_date ON message_segments (message_date);",
+		"CREATE INDEX IF NOT EXISTS idx_daily_segment_date ON daily_segment_stats (self_id, date);",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("error creating message segment tables: %w", err)
+		}
+	}
+	return backfillMessageSegments(db)
+}
+
+// 储存了消息时 解析raw_message中的CQ码补全消息段和每日统计 已有消息段的数据库不重复补全
+func backfillMessageSegments(db *sql.DB) error {
+	var existing int
+	if err := db.QueryRow("SELECT COUNT(*) FROM message_segments").Scan(&existing); err != nil {
+		return fmt.Errorf("error counting message segments: %w", err)
+	}
+	if existing > 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT message_id, CAST(self_id AS TEXT), " + messageGroupIDSQL + ", message_date, COALESCE(raw_message, '') FROM messages")
+	if err != nil {
+		return fmt.Errorf("error reading messages: %w", err)
+	}
+	type message struct {
+		id               int64
+		selfID, groupID  string
+		date, rawMessage string
+	}
+	var messages []message
+	for rows.Next() {
+		var m message
+		var date time.Time
+		if err := rows.Scan(&m.id, &m.selfID, &m.groupID, &date, &m.rawMessage); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading messages: %w", err)
+		}
+		m.date = date.Format("2006-01-02")
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading messages: %w", err)
+	}
+
+	b := newBatch(tx)
+	for _, m := range messages {
+		segments := structs.ParseCQCode(m.rawMessage)
+		if err := b.storeSegments(m.id, m.selfID, segments, m.date); err != nil {
+			return err
+		}
+		b.countSegments(structs.Event{SelfID: m.selfID, GroupID: m.groupID}, segments, m.date)
+	}
+	if err := b.flushCounters(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateMessageSegmentsDown(db *sql.DB) error {
+	for _, table := range []string{"message_segments", "daily_segment_stats"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			return fmt.Errorf("error dropping %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// 每天每个群指令和闲聊的消息数 私聊消息的group_id为空
+func migrateMessageKindsUp(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS daily_message_kind_stats (
+            self_id BIGINT,
+            group_id BIGINT,
+            date DATE NOT NULL,
+            commands INTEGER DEFAULT 0,
+            chats INTEGER DEFAULT 0,
+            PRIMARY KEY (self_id, group_id, date)
+        );`,
+		"CREATE INDEX IF NOT EXISTS idx_daily_message_kind_date ON daily_message_kind_stats (self_id, date);",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("error creating message kind table: %w", err)
+		}
+	}
+	return backfillMessageKinds(db)
+}
+
+// 储存了消息时 按当前的指令规则补全每日统计 已有统计的数据库不重复补全
+func backfillMessageKinds(db *sql.DB) error {
+	var existing int
+	if err := db.QueryRow("SELECT COUNT(*) FROM daily_message_kind_stats").Scan(&existing); err != nil {
+		return fmt.Errorf("error counting message kind stats: %w", err)
+	}
+	if existing > 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT CAST(self_id AS TEXT), " + messageGroupIDSQL + ", message_date, COALESCE(raw_message, '') FROM messages")
+	if err != nil {
+		return fmt.Errorf("error reading messages: %w", err)
+	}
+	b := newBatch(tx)
+	for rows.Next() {
+		var selfID, groupID, rawMessage string
+		var date time.Time
+		if err := rows.Scan(&selfID, &groupID, &date, &rawMessage); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading messages: %w", err)
+		}
+		b.countMessageKind(store.ParseCommandName(selfID, rawMessage), groupID, selfID, date.Format("2006-01-02"))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading messages: %w", err)
+	}
+
+	if err := b.flushCounters(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateMessageKindsDown(db *sql.DB) error {
+	if _, err := db.Exec("DROP TABLE IF EXISTS daily_message_kind_stats"); err != nil {
+		return fmt.Errorf("error dropping daily_message_kind_stats: %w", err)
+	}
+	return nil
+}
+
+// 用户和指令统计中按场景拆分的计数列
+var sceneColumns = map[string][]string{
+	"user_stats":          {"private_messages", "group_messages", "guild_messages"},
+	"daily_user_stats":    {"private_messages", "group_messages", "guild_messages"},
+	"command_stats":       {"private_calls", "group_calls", "guild_calls"},
+	"daily_command_stats": {"private_calls", "group_calls", "guild_calls"},
+}
+
+// 储存的消息的场景 与structs.Event.Scene一致
+const messageSceneSQL = `CASE WHEN message_type IN ('guild', 'channel') THEN 'guild'
+         WHEN COALESCE(group_id, '') NOT IN ('', 0) THEN 'group' ELSE 'private' END`
+
+// 旧版本的私聊记在group_id为0的行中 新的写入使用空字符串 重建时合并为一行
+const oldGroupIDSQL = `CASE WHEN COALESCE(group_id, '') IN ('', 0) THEN '' ELSE group_id END`
+
+// 区分私聊 群和频道 用户和指令统计增加按场景的计数 群统计增加场景和频道id并按机器人和频道区分
+// 之前的私聊和频道消息都记在group_id为空的一行中 升级后该行视为私聊
+func migrateMessageScenesUp(db *sql.DB) error {
+	for _, table := range []string{"user_stats", "daily_user_stats", "command_stats", "daily_command_stats"} {
+		for _, column := range sceneColumns[table] {
+			if err := addColumnIfMissing(db, table, column, "INTEGER DEFAULT 0"); err != nil {
+				return err
+			}
+		}
+	}
+
+	groupStatsSQL := `
+    CREATE TABLE group_stats (
+        group_id BIGINT,
+        self_id BIGINT,
+        message_type TEXT NOT NULL DEFAULT '',
+        guild_id TEXT NOT NULL DEFAULT '',
+        channel_id TEXT NOT NULL DEFAULT '',
+        total_messages_sent INTEGER DEFAULT 0,
+        last_message_timestamp INTEGER,
+        consecutive_message_days INTEGER DEFAULT 0,
+        PRIMARY KEY (self_id, group_id, guild_id, channel_id)
+    );`
+	if err := rebuildWithPrimaryKey(db, "group_stats", []string{"self_id", "group_id", "guild_id", "channel_id"}, groupStatsSQL,
+		`SELECT `+oldGroupIDSQL+`, self_id, CASE WHEN `+oldGroupIDSQL+` = '' THEN 'private' ELSE 'group' END, '', '',
+             SUM(total_messages_sent), MAX(last_message_timestamp), MAX(consecutive_message_days)
+         FROM group_stats_old GROUP BY self_id, `+oldGroupIDSQL); err != nil {
+		return err
+	}
+
+	dailyGroupStatsSQL := `
+    CREATE TABLE daily_group_stats (
+        group_id BIGINT,
+        self_id BIGINT,
+        message_type TEXT NOT NULL DEFAULT '',
+        guild_id TEXT NOT NULL DEFAULT '',
+        channel_id TEXT NOT NULL DEFAULT '',
+        date DATE NOT NULL,
+        messages_sent INTEGER DEFAULT 0,
+        active_members INTEGER DEFAULT 0,
+        PRIMARY KEY (self_id, group_id, guild_id, channel_id, date)
+    );`
+	if err := rebuildWithPrimaryKey(db, "daily_group_stats", []string{"self_id", "group_id", "guild_id", "channel_id", "date"}, dailyGroupStatsSQL,
+		`SELECT `+oldGroupIDSQL+`, self_id, CASE WHEN `+oldGroupIDSQL+` = '' THEN 'private' ELSE 'group' END, '', '',
+             date, SUM(messages_sent), SUM(active_members)
+         FROM daily_group_stats_old GROUP BY self_id, `+oldGroupIDSQL+`, date`); err != nil {
+		return err
+	}
+
+	statements := []string{
+		"CREATE INDEX IF NOT EXISTS idx_group_self_id ON group_stats (self_id);",
+		"CREATE INDEX IF NOT EXISTS idx_daily_group_self_date ON daily_group_stats (self_id, date);",
+		// 储存了消息时 用已有的消息补全用户按场景的计数
+		`UPDATE daily_user_stats SET private_messages = s.private_messages, group_messages = s.group_messages, guild_messages = s.guild_messages
+         FROM (SELECT self_id, user_id, message_date,
+                   SUM(scene = 'private') AS private_messages, SUM(scene = 'group') AS group_messages, SUM(scene = 'guild') AS guild_messages
+               FROM (SELECT self_id, user_id, message_date, ` + messageSceneSQL + ` AS scene FROM messages)
+               GROUP BY self_id, user_id, message_date) s
+         WHERE daily_user_stats.self_id = s.self_id AND daily_user_stats.user_id = s.user_id AND daily_user_stats.date = s.message_date;`,
+		`UPDATE user_stats SET private_messages = s.private_messages, group_messages = s.group_messages, guild_messages = s.guild_messages
+         FROM (SELECT self_id, user_id,
+                   SUM(scene = 'private') AS private_messages, SUM(scene = 'group') AS group_messages, SUM(scene = 'guild') AS guild_messages
+               FROM (SELECT self_id, user_id, ` + messageSceneSQL + ` AS scene FROM messages)
+               GROUP BY self_id, user_id) s
+         WHERE user_stats.self_id = s.self_id AND user_stats.user_id = s.user_id;`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("error migrating message scenes: %w", err)
+		}
+	}
+	return backfillCommandScenes(db)
+}
+
+// 储存了消息时 按当前的指令规则补全指令按场景的调用次数
+func backfillCommandScenes(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT CAST(self_id AS TEXT), message_date, COALESCE(raw_message, ''), " + messageSceneSQL + " FROM messages")
+	if err != nil {
+		return fmt.Errorf("error reading messages: %w", err)
+	}
+	type sceneCalls struct {
+		private, group, guild int
+	}
+	daily := make(map[commandKey]*sceneCalls)
+	totals := make(map[commandKey]*sceneCalls)
+	for rows.Next() {
+		var selfID, rawMessage, scene string
+		var date time.Time
+		if err := rows.Scan(&selfID, &date, &rawMessage, &scene); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading messages: %w", err)
+		}
+		commandName := store.ParseCommandName(selfID, rawMessage)
+		if commandName == "" {
+			continue
+		}
+		for _, key := range []commandKey{
+			{commandName: commandName, selfID: selfID, date: date.Format("2006-01-02")},
+			{commandName: commandName, selfID: selfID},
+		} {
+			counts := daily
+			if key.date == "" {
+				counts = totals
+			}
+			count, ok := counts[key]
+			if !ok {
+				count = &sceneCalls{}
+				counts[key] = count
+			}
+			switch scene {
+			case structs.ScenePrivate:
+				count.private++
+			case structs.SceneGroup:
+				count.group++
+			case structs.SceneGuild:
+				count.guild++
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading messages: %w", err)
+	}
+
+	for key, count := range daily {
+		if _, err := tx.Exec("UPDATE daily_command_stats SET private_calls = ?, group_calls = ?, guild_calls = ? WHERE command_name = ? AND self_id = ? AND date = ?",
+			count.private, count.group, count.guild, key.commandName, key.selfID, key.date); err != nil {
+			return fmt.Errorf("error updating daily command scenes: %w", err)
+		}
+	}
+	for key, count := range totals {
+		if _, err := tx.Exec("UPDATE command_stats SET private_calls = ?, group_calls = ?, guild_calls = ? WHERE command_name = ? AND self_id = ?",
+			count.private, count.group, count.guild, key.commandName, key.selfID); err != nil {
+			return fmt.Errorf("error updating command scenes: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// 回退时按群合并频道的统计 并删除按场景的计数列
+func migrateMessageScenesDown(db *sql.DB) error {
+	groupStatsSQL := `
+    CREATE TABLE group_stats (
+        group_id BIGINT PRIMARY KEY,
+        self_id BIGINT,
+        total_messages_sent INTEGER DEFAULT 0,
+        last_message_timestamp INTEGER,
+        consecutive_message_days INTEGER DEFAULT 0
+    );`
+	if err := rebuildWithPrimaryKey(db, "group_stats", []string{"group_id"}, groupStatsSQL,
+		`SELECT group_id, MAX(self_id), SUM(total_messages_sent), MAX(last_message_timestamp), MAX(consecutive_message_days)
+         FROM group_stats_old GROUP BY group_id`); err != nil {
+		return err
+	}
+
+	dailyGroupStatsSQL := `
+    CREATE TABLE daily_group_stats (
+        group_id INTEGER,
+        self_id BIGINT,
+        date DATE NOT NULL,
+        messages_sent INTEGER DEFAULT 0,
+        active_members INTEGER DEFAULT 0,
+        PRIMARY KEY (group_id, date)
+    );`
+	if err := rebuildWithPrimaryKey(db, "daily_group_stats", []string{"group_id", "date"}, dailyGroupStatsSQL,
+		`SELECT group_id, MAX(self_id), date, SUM(messages_sent), SUM(active_members)
+         FROM daily_group_stats_old GROUP BY group_id, date`); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_group_self_id ON group_stats (self_id);"); err != nil {
+		return fmt.Errorf("error creating index on group_stats: %w", err)
+	}
+
+	for _, table := range []string{"user_stats", "daily_user_stats", "command_stats", "daily_command_stats"} {
+		for _, column := range sceneColumns[table] {
+			if err := dropColumnIfExists(db, table, column); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 每个用户第一次向机器人发言的日期 不随每日统计清理 用于区分新老用户和计算留存
+func migrateUserFirstSeenUp(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS user_first_seen (
+            self_id BIGINT,
+            user_id BIGINT,
+            first_date DATE NOT NULL,
+            PRIMARY KEY (self_id, user_id)
+        );`,
+		"CREATE INDEX IF NOT EXISTS idx_user_first_seen_date ON user_first_seen (self_id, first_date);",
+		`INSERT OR IGNORE INTO user_first_seen (self_id, user_id, first_date)
+         SELECT self_id, user_id, MIN(date) FROM daily_user_stats GROUP BY self_id, user_id;`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("error creating user first seen table: %w", err)
+		}
+	}
+	return backfillPrunedFirstSeen(db)
+}
+
+// 每日统计已被清理的用户不知道第一次发言的日期 记为早于任何统计窗口的日期
+// 既不会被计为新用户 也不属于任何留存的批次 之后的发言日期都不会早于它
+const unknownFirstDate = "1970-01-01"
+
+func backfillPrunedFirstSeen(db *sql.DB) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO user_first_seen (self_id, user_id, first_date)
+         SELECT self_id, user_id, ? FROM user_stats u
+         WHERE NOT EXISTS (SELECT 1 FROM user_first_seen f WHERE f.self_id = u.self_id AND f.user_id = u.user_id)`, unknownFirstDate)
+	if err != nil {
+		return fmt.Errorf("error inserting user first seen: %w", err)
+	}
+	return nil
+}
+
+func migrateUserFirstSeenDown(db *sql.DB) error {
+	if _, err := db.Exec("DROP TABLE IF EXISTS user_first_seen"); err != nil {
+		return fmt.Errorf("error dropping user_first_seen: %w", err)
+	}
+	return nil
+}
+
+// 消息表的主键只能存放整数 增加一列保存事件中原始的message_id 用于按v12等非数字id查找回复的原消息
+// 之前的消息都以数字id作为主键 原样补全 之前非数字id的消息使用的是自增主键 无法还原
+func migrateMessageOriginalIDsUp(db *sql.DB) error {
+	if err := addColumnIfMissing(db, "messages", "original_id", "TEXT"); err != nil {
+		return err
+	}
+	statements := []string{
+		"UPDATE messages SET original_id = CAST(message_id AS TEXT) WHERE original_id IS NULL;",
+		"CREATE INDEX IF NOT EXISTS idx_messages_original_id ON messages (self_id, original_id);",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("error backfilling message original ids: %w", err)
+		}
+	}
+	return nil
+}
+
+func migrateMessageOriginalIDsDown(db *sql.DB) error {
+	if _, err := db.Exec("DROP INDEX IF EXISTS idx_messages_original_id;"); err != nil {
+		return fmt.Errorf("error dropping index on messages: %w", err)
+	}
+	return dropColumnIfExists(db, "messages", "original_id")
+}
+
+// 表中是否有该列
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count); err != nil {
+		return false, fmt.Errorf("error reading %s table info: %w", table, err)
+	}
+	return count > 0, nil
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	exists, err := columnExists(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition)); err != nil {
+		return fmt.Errorf("error adding %s to %s: %w", column, table, err)
+	}
+	return nil
+}
+
+func dropColumnIfExists(db *sql.DB, table, column string) error {
+	exists, err := columnExists(db, table, column)
+	if err != nil || !exists {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s;", table, column)); err != nil {
+		return fmt.Errorf("error dropping %s from %s: %w", column, table, err)
+	}
+	return nil
+}
+
+// 已有表的数据库修改auto_vacuum后需要VACUUM才会生效 两条语句必须在同一连接上执行
+func setAutoVacuum(db *sql.DB, mode string) error {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(context.Background(), "PRAGMA auto_vacuum = "+mode); err != nil {
+		return fmt.Errorf("error setting auto_vacuum to %s: %w", mode, err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "VACUUM"); err != nil {
+		return fmt.Errorf("error vacuuming database: %w", err)
+	}
+	return nil
+}
+
+// 变更前将数据库完整复制到同目录下 新建的空数据库不需要备份
+func backupDatabase(db *sql.DB) error {
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_migrations'").Scan(&tables); err != nil {
+		return fmt.Errorf("error checking database tables: %w", err)
+	}
+	if tables == 0 {
+		return nil
+	}
+
+	var path string
+	if err := db.QueryRow("SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&path); err != nil {
+		return fmt.Errorf("error reading database path: %w", err)
+	}
+	if path == "" {
+		// 内存数据库
+		return nil
+	}
+
+	backupPath := fmt.Sprintf("%s.%s.bak", path, time.Now().Format("20060102-150405"))
+	for i := 1; fileExists(backupPath); i++ {
+		// 同一秒内多次变更
+		backupPath = fmt.Sprintf("%s.%s-%d.bak", path, time.Now().Format("20060102-150405"), i)
+	}
+	if _, err := db.Exec("VACUUM INTO ?", backupPath); err != nil {
+		return fmt.Errorf("error backing up database to %s: %w", backupPath, err)
+	}
+	log.Printf("Backed up database to %s", backupPath)
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
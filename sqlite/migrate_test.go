@@ -0,0 +1,178 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// 每日统计已被清理的用户补全为未知的首次发言日期 再次发言时仍是老用户
+func TestPrunedUserFirstSeen(t *testing.T) {
+	db := openTestDB(t)
+	cfg := config.Config{}
+
+	if failed, err := processBatch(db, []structs.Event{testMessage("1", "2", "/help")}, cfg, nil); err != nil || failed != 0 {
+		t.Fatalf("processBatch failed %d events: %v", failed, err)
+	}
+	// 模拟升级前每日统计已被清理的用户
+	for _, statement := range []string{"DELETE FROM daily_user_stats", "DELETE FROM user_first_seen"} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	if err := backfillPrunedFirstSeen(db); err != nil {
+		t.Fatalf("backfillPrunedFirstSeen: %v", err)
+	}
+
+	events := []structs.Event{testMessage("2", "1", "/help"), testMessage("3", "2", "/help")}
+	if failed, err := processBatch(db, events, cfg, nil); err != nil || failed != 0 {
+		t.Fatalf("processBatch failed %d events: %v", failed, err)
+	}
+
+	st := NewStore(db, cfg)
+	activity, err := st.FetchDailyUserActivity("10", 1)
+	if err != nil {
+		t.Fatalf("FetchDailyUserActivity: %v", err)
+	}
+	if len(activity) != 1 || activity[0].ActiveUsers != 2 || activity[0].NewUsers != 1 {
+		t.Fatalf("user activity = %+v, want 2 active users with 1 new", activity)
+	}
+	cohorts, err := st.FetchCohorts("10", 1, 1)
+	if err != nil {
+		t.Fatalf("FetchCohorts: %v", err)
+	}
+	for _, cohort := range cohorts {
+		if cohort.NewUsers > 1 {
+			t.Fatalf("cohort %s has %d new users, want at most 1", cohort.Date, cohort.NewUsers)
+		}
+	}
+}
+
+// 升级前不同机器人的私聊行在重建后仍按机器人区分
+func TestMessageScenesKeepsBotsApart(t *testing.T) {
+	db := openTestDB(t)
+	if err := MigrateDown(db, 6); err != nil {
+		t.Fatalf("migrate down: %v", err)
+	}
+	for _, statement := range []string{
+		"INSERT INTO group_stats (group_id, self_id, total_messages_sent) VALUES (0, 10, 3), ('', 20, 5), (100, 20, 7)",
+		"INSERT INTO daily_group_stats (group_id, self_id, date, messages_sent) VALUES (0, 10, '2026-01-02', 3), ('', 20, '2026-01-02', 5)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	if err := MigrateUp(db, 0); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+
+	for _, table := range []string{"group_stats", "daily_group_stats"} {
+		column := "total_messages_sent"
+		if table == "daily_group_stats" {
+			column = "messages_sent"
+		}
+		got := make(map[string]int)
+		rows, err := db.Query("SELECT CAST(self_id AS TEXT), " + column + " FROM " + table + " WHERE message_type = 'private'")
+		if err != nil {
+			t.Fatalf("read %s: %v", table, err)
+		}
+		for rows.Next() {
+			var selfID string
+			var messages int
+			if err := rows.Scan(&selfID, &messages); err != nil {
+				t.Fatalf("read %s: %v", table, err)
+			}
+			got[selfID] = messages
+		}
+		rows.Close()
+		if len(got) != 2 || got["10"] != 3 || got["20"] != 5 {
+			t.Fatalf("%s private rows = %v, want 10:3 and 20:5", table, got)
+		}
+	}
+}
+
+// 变更执行完成但未记录版本时进程退出 下次启动重新执行的变更不改变已有的数据
+func TestMigrationsRerunAfterCrash(t *testing.T) {
+	db := openTestDB(t)
+	cfg := config.Config{StoreMsgs: true}
+
+	private := testMessage("3", "2", "/sign")
+	private.DetailType = "private"
+	private.GroupID = ""
+	events := []structs.Event{
+		testMessage("1", "1", "/help"),
+		testMessage("2", "1", "hello [CQ:at,qq=10]"),
+		private,
+		testReply("s1", "1", time.Now().Unix()),
+	}
+	if failed, err := processBatch(db, events, cfg, nil); err != nil || failed != 0 {
+		t.Fatalf("processBatch failed %d events: %v", failed, err)
+	}
+
+	before := snapshotTables(t, db)
+	for _, migration := range migrations {
+		if err := migration.Up(db); err != nil {
+			t.Fatalf("rerun migration %d %s: %v", migration.Version, migration.Name, err)
+		}
+		after := snapshotTables(t, db)
+		if !reflect.DeepEqual(before, after) {
+			for table := range before {
+				if !reflect.DeepEqual(before[table], after[table]) {
+					t.Errorf("migration %d %s changed %s:\n%v\nwant\n%v", migration.Version, migration.Name, table, after[table], before[table])
+				}
+			}
+			t.FailNow()
+		}
+	}
+}
+
+// 读取除版本记录和搜索索引外所有表的内容 每个表的行按文本排序
+func snapshotTables(t *testing.T, db *sql.DB) map[string][]string {
+	t.Helper()
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table'
+         AND name NOT IN ('schema_migrations', 'sqlite_sequence') AND name NOT LIKE 'messages_fts%'`)
+	if err != nil {
+		t.Fatalf("list tables: %v", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatalf("list tables: %v", err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	snapshot := make(map[string][]string)
+	for _, table := range tables {
+		rows, err := db.Query("SELECT * FROM " + table)
+		if err != nil {
+			t.Fatalf("read %s: %v", table, err)
+		}
+		columns, _ := rows.Columns()
+		lines := []string{strings.Join(columns, ",")}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err := rows.Scan(pointers...); err != nil {
+				t.Fatalf("read %s: %v", table, err)
+			}
+			lines = append(lines, fmt.Sprint(values...))
+		}
+		rows.Close()
+		sort.Strings(lines[1:])
+		snapshot[table] = lines
+	}
+	return snapshot
+}
@@ -2,86 +2,34 @@ package sqlite
 
 import (
 	"database/sql"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"log"
-	"os"
-	"strconv"
 	"time"
 
-	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
 )
 
-// RobotStatus represents the structure corresponding to the robot_status table
-type RobotStatus struct {
-	SelfID          int64  `json:"self_id"`
-	MessageReceived int    `json:"message_received"`
-	MessageSent     int    `json:"message_sent"`
-	LastMessageTime int64  `json:"last_message_time"`
-	InvitesReceived int    `json:"invites_received"`
-	KicksReceived   int    `json:"kicks_received"`
-	DailyDAU        int    `json:"daily_dau"`
-	Nickname        string `json:"nickname"`
-	ImgHead         string `json:"imgHead"`
-	IsOnline        bool   `json:"isOnline"`
-}
-
-// FetchOnlineRobots returns a JSON array of all online robots' statuses for the current day
-// 返回机器人信息，会返回当日所有机器人，包括不在线的
-func FetchOnlineRobots(db *sql.DB, cfg *config.Config) ([]byte, error) {
-	currentDate := time.Now().Format("2006-01-02") // Get the current date in YYYY-MM-DD format
-
-	// Adjust the query to select only today's entries and directly use the 'online' column.
-	query := `SELECT self_id, message_received, message_sent, last_message_time, invites_received, kicks_received, daily_dau, online
+// FetchRobotStatuses 返回指定日期所有机器人的状态
+func (s *Store) FetchRobotStatuses(date time.Time) ([]structs.RobotStatus, error) {
+	query := `SELECT self_id, online, message_received, message_sent, last_message_time, invites_received, kicks_received, daily_dau
               FROM robot_status
-              WHERE date = ?` // Only fetch entries for the current date
-	rows, err := db.Query(query, currentDate)
+              WHERE date = ?`
+	rows, err := s.db.Query(query, date.Format("2006-01-02"))
 	if err != nil {
 		return nil, fmt.Errorf("error querying robots for today: %w", err)
 	}
 	defer rows.Close()
 
-	var robots []RobotStatus
-	onlineBots := make(map[string]bool) // Map to track which bots are online
+	var robots []structs.RobotStatus
 	for rows.Next() {
-		var robot RobotStatus
-		err = rows.Scan(&robot.SelfID, &robot.MessageReceived, &robot.MessageSent, &robot.LastMessageTime,
-			&robot.InvitesReceived, &robot.KicksReceived, &robot.DailyDAU, &robot.IsOnline)
+		var robot structs.RobotStatus
+		err = rows.Scan(&robot.SelfID, &robot.Online, &robot.MessageReceived, &robot.MessageSent, &robot.LastMessageTime,
+			&robot.InvitesReceived, &robot.KicksReceived, &robot.DailyDAU)
 		if err != nil {
 			return nil, fmt.Errorf("error reading robot status rows: %w", err)
 		}
-
-		// Map robot info from config and handle the image
-		botFound := false
-		for _, botInfo := range cfg.BotInfos {
-			if fmt.Sprintf("%d", robot.SelfID) == botInfo.BotID {
-				robot.Nickname = botInfo.BotNickname
-				imgData, imgErr := os.ReadFile(botInfo.BotHead)
-				if imgErr == nil {
-					robot.ImgHead = base64.StdEncoding.EncodeToString(imgData)
-				} else {
-					fmt.Printf("Error reading image file: %v\n", imgErr)
-					robot.ImgHead = "" // Use an empty string if the image cannot be loaded
-				}
-				botFound = true
-				break
-			}
-		}
-
-		// If bot not found in config, initialize with default settings
-		if !botFound {
-			newBotInfo := config.BotInfo{
-				BotID:       fmt.Sprintf("%d", robot.SelfID),
-				BotNickname: "NewBot-" + fmt.Sprintf("%d", robot.SelfID),
-				BotHead:     "images/head.gif", // Default image path
-			}
-			cfg.BotInfos = append(cfg.BotInfos, newBotInfo)
-			config.WriteConfigToFile(*cfg)
-		}
-
-		onlineBots[fmt.Sprintf("%d", robot.SelfID)] = true // Mark this bot as online
+		robot.Date = date.Format("2006-01-02")
 		robots = append(robots, robot)
 	}
 
@@ -89,43 +37,18 @@ func FetchOnlineRobots(db *sql.DB, cfg *config.Config) ([]byte, error) {
 		return nil, fmt.Errorf("error iterating over robot status rows for today: %w", err)
 	}
 
-	// Append offline robots
-	for _, botInfo := range cfg.BotInfos {
-		if !onlineBots[botInfo.BotID] {
-			imgData, _ := os.ReadFile(botInfo.BotHead)
-			botid64, _ := strconv.ParseInt(botInfo.BotID, 10, 64)
-			robots = append(robots, RobotStatus{
-				SelfID:          botid64,
-				MessageReceived: 0,
-				MessageSent:     0,
-				LastMessageTime: 0,
-				InvitesReceived: 0,
-				KicksReceived:   0,
-				DailyDAU:        0,
-				Nickname:        botInfo.BotNickname,
-				ImgHead:         base64.StdEncoding.EncodeToString(imgData),
-				IsOnline:        false,
-			})
-		}
-	}
-
-	jsonData, err := json.Marshal(robots)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling today's robot statuses to JSON: %w", err)
-	}
-
-	return jsonData, nil
+	return robots, nil
 }
 
 // FetchFieldValuesForRobot queries the robot_status table for a specified number of past days for a given field type.
 // 根据机器人id 需要的数据天数 数据类型，获取数据 数据类型=表的列名
-func FetchFieldValuesForRobot(db *sql.DB, selfID int64, days int, fieldType string) ([]string, error) {
+func (s *Store) FetchFieldValuesForRobot(selfID string, days int, fieldType string) ([]string, error) {
 	// Calculate the start date for the query.
-	endDate := time.Now()
+	endDate := store.Now()
 	startDate := endDate.AddDate(0, 0, -days)
 
 	query := fmt.Sprintf(`SELECT %s FROM robot_status WHERE self_id = ? AND date BETWEEN ? AND ? ORDER BY date DESC`, fieldType)
-	rows, err := db.Query(query, selfID, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	rows, err := s.db.Query(query, selfID, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
 	if err != nil {
 		log.Printf("Error querying robot_status: %v", err)
 		return nil, fmt.Errorf("error querying robot_status: %w", err)
@@ -151,15 +74,15 @@ func FetchFieldValuesForRobot(db *sql.DB, selfID int64, days int, fieldType stri
 	return values, nil
 }
 
-func FetchAllFieldsForRobot(db *sql.DB, selfID int64, days int) ([]structs.RobotStatus, error) {
-	endDate := time.Now()
+func (s *Store) FetchAllFieldsForRobot(selfID string, days int) ([]structs.RobotStatus, error) {
+	endDate := store.Now()
 	startDate := endDate.AddDate(0, 0, -days)
 
 	query := `SELECT self_id, date, online, message_received, message_sent, last_message_time,
               invites_received, kicks_received, daily_dau 
               FROM robot_status 
               WHERE self_id = ? AND date BETWEEN ? AND ? ORDER BY date DESC`
-	rows, err := db.Query(query, selfID, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	rows, err := s.db.Query(query, selfID, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
 	if err != nil {
 		log.Printf("Error querying robot_status: %v", err)
 		return nil, fmt.Errorf("error querying robot_status: %w", err)
@@ -188,221 +111,948 @@ func FetchAllFieldsForRobot(db *sql.DB, selfID int64, days int) ([]structs.Robot
 	return robots, nil
 }
 
-type CommandStat struct {
-	CommandName       string `json:"command_name"`
-	SelfID            int64  `json:"self_id"`
-	TotalCalls        int    `json:"total_calls"`
-	LastCallTimestamp int64  `json:"last_call_timestamp"`
+// 排行榜的排序 scene为私聊 群或频道时只保留该场景有计数的行 按该场景的计数列排序
+// 场景的计数列名为场景名加上suffix
+func sceneOrder(scene string, totalColumn string, suffix string) string {
+	for _, known := range structs.Scenes {
+		if scene == known {
+			column := scene + suffix
+			return " AND " + column + " > 0 ORDER BY " + column + " DESC"
+		}
+	}
+	return " ORDER BY " + totalColumn + " DESC"
 }
 
-func FetchTopCommands(db *sql.DB, selfId int64, rank int) ([]CommandStat, error) {
-	query := `SELECT command_name, self_id, total_calls, last_call_timestamp 
+// FetchTopCommands 按累计调用次数排序 按当前规则已不是指令的闲聊不计入排名
+func (s *Store) FetchTopCommands(selfId string, scene string, rank int) ([]structs.CommandStat, error) {
+	query := `SELECT command_name, self_id, total_calls, last_call_timestamp, private_calls, group_calls, guild_calls 
               FROM command_stats 
-              WHERE self_id = ? 
-              ORDER BY total_calls DESC 
-              LIMIT ?`
-	rows, err := db.Query(query, selfId, rank)
+              WHERE self_id = ?` + sceneOrder(scene, "total_calls", "_calls")
+	rows, err := s.db.Query(query, selfId)
 	if err != nil {
-		log.Printf("Error querying top commands for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error querying top commands for selfId %d: %w", selfId, err)
+		log.Printf("Error querying top commands for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying top commands for selfId %s: %w", selfId, err)
 	}
 	defer rows.Close()
 
-	var results []CommandStat
+	var results []structs.CommandStat
 	for rows.Next() {
-		var stat CommandStat
-		if err := rows.Scan(&stat.CommandName, &stat.SelfID, &stat.TotalCalls, &stat.LastCallTimestamp); err != nil {
-			log.Printf("Error reading command stats for selfId %d: %v", selfId, err)
-			return nil, fmt.Errorf("error reading command stats for selfId %d: %w", selfId, err)
+		var stat structs.CommandStat
+		if err := rows.Scan(&stat.CommandName, &stat.SelfID, &stat.TotalCalls, &stat.LastCallTimestamp, &stat.PrivateCalls, &stat.GroupCalls, &stat.GuildCalls); err != nil {
+			log.Printf("Error reading command stats for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading command stats for selfId %s: %w", selfId, err)
+		}
+		if !store.IsCommandName(selfId, stat.CommandName) {
+			continue
 		}
 		results = append(results, stat)
+		if rank >= 0 && len(results) >= rank {
+			break
+		}
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Printf("Error during rows iteration for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error during rows iteration for selfId %d: %w", selfId, err)
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
 	}
 
 	return results, nil
 }
 
-func FetchTopDailyCommands(db *sql.DB, selfId int64, date time.Time, rank int) ([]CommandStat, error) {
-	query := `SELECT command_name, self_id, calls, last_call_timestamp 
+// FetchTopDailyCommands 按当天的调用次数排序 按当前规则已不是指令的闲聊不计入排名
+func (s *Store) FetchTopDailyCommands(selfId string, scene string, date time.Time, rank int) ([]structs.CommandStat, error) {
+	query := `SELECT command_name, self_id, calls, last_call_timestamp, private_calls, group_calls, guild_calls 
               FROM daily_command_stats 
-              WHERE self_id = ? AND date = ? 
-              ORDER BY calls DESC 
-              LIMIT ?`
-	rows, err := db.Query(query, selfId, date.Format("2006-01-02"), rank)
+              WHERE self_id = ? AND date = ?` + sceneOrder(scene, "calls", "_calls")
+	rows, err := s.db.Query(query, selfId, date.Format("2006-01-02"))
 	if err != nil {
-		log.Printf("Error querying daily top commands for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error querying daily top commands for selfId %d: %w", selfId, err)
+		log.Printf("Error querying daily top commands for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily top commands for selfId %s: %w", selfId, err)
 	}
 	defer rows.Close()
 
-	var results []CommandStat
+	var results []structs.CommandStat
 	for rows.Next() {
-		var stat CommandStat
-		if err := rows.Scan(&stat.CommandName, &stat.SelfID, &stat.TotalCalls, &stat.LastCallTimestamp); err != nil {
-			log.Printf("Error reading daily command stats for selfId %d: %v", selfId, err)
-			return nil, fmt.Errorf("error reading daily command stats for selfId %d: %w", selfId, err)
+		var stat structs.CommandStat
+		if err := rows.Scan(&stat.CommandName, &stat.SelfID, &stat.TotalCalls, &stat.LastCallTimestamp, &stat.PrivateCalls, &stat.GroupCalls, &stat.GuildCalls); err != nil {
+			log.Printf("Error reading daily command stats for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily command stats for selfId %s: %w", selfId, err)
+		}
+		if !store.IsCommandName(selfId, stat.CommandName) {
+			continue
 		}
 		results = append(results, stat)
+		if rank >= 0 && len(results) >= rank {
+			break
+		}
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Printf("Error during rows iteration for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error during rows iteration for selfId %d: %w", selfId, err)
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
 	}
 
 	return results, nil
 }
 
-type GroupStat struct {
-	GroupID                int64  `json:"group_id"`
-	SelfID                 int64  `json:"self_id"`
-	TotalMessagesSent      int    `json:"total_messages_sent,omitempty"`
-	LastMessageTimestamp   int64  `json:"last_message_timestamp,omitempty"`
-	ConsecutiveMessageDays int    `json:"consecutive_message_days,omitempty"`
-	MessagesSent           int    `json:"messages_sent,omitempty"`  // For daily stats
-	ActiveMembers          int    `json:"active_members,omitempty"` // For daily stats
-	Date                   string `json:"date,omitempty"`           // Only for daily stats
-}
-
-func FetchTopGroups(db *sql.DB, selfId int64, rank int) ([]GroupStat, error) {
-	query := `SELECT group_id, self_id, total_messages_sent, last_message_timestamp, consecutive_message_days 
+// FetchTopGroups 按累计消息数排序 每个机器人的私聊合计为一行 频道按子频道区分
+func (s *Store) FetchTopGroups(selfId string, scene string, rank int) ([]structs.GroupStat, error) {
+	query := `SELECT group_id, self_id, message_type, guild_id, channel_id, total_messages_sent, last_message_timestamp, consecutive_message_days 
               FROM group_stats 
-              WHERE self_id = ? 
+              WHERE self_id = ? AND (? = '' OR message_type = ?) 
               ORDER BY total_messages_sent DESC 
               LIMIT ?`
-	rows, err := db.Query(query, selfId, rank)
+	rows, err := s.db.Query(query, selfId, scene, scene, rank)
 	if err != nil {
-		log.Printf("Error querying top groups for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error querying top groups for selfId %d: %w", selfId, err)
+		log.Printf("Error querying top groups for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying top groups for selfId %s: %w", selfId, err)
 	}
 	defer rows.Close()
 
-	var results []GroupStat
+	var results []structs.GroupStat
 	for rows.Next() {
-		var stat GroupStat
-		if err := rows.Scan(&stat.GroupID, &stat.SelfID, &stat.TotalMessagesSent, &stat.LastMessageTimestamp, &stat.ConsecutiveMessageDays); err != nil {
-			log.Printf("Error reading group stats for selfId %d: %v", selfId, err)
-			return nil, fmt.Errorf("error reading group stats for selfId %d: %w", selfId, err)
+		var stat structs.GroupStat
+		if err := rows.Scan(&stat.GroupID, &stat.SelfID, &stat.MessageType, &stat.GuildID, &stat.ChannelID, &stat.TotalMessagesSent, &stat.LastMessageTimestamp, &stat.ConsecutiveMessageDays); err != nil {
+			log.Printf("Error reading group stats for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading group stats for selfId %s: %w", selfId, err)
 		}
 		results = append(results, stat)
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Printf("Error during rows iteration for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error during rows iteration for selfId %d: %w", selfId, err)
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
 	}
 
 	return results, nil
 }
 
-func FetchTopDailyGroups(db *sql.DB, selfId int64, date time.Time, rank int) ([]GroupStat, error) {
+func (s *Store) FetchTopDailyGroups(selfId string, scene string, date time.Time, rank int) ([]structs.GroupStat, error) {
 	// Updated SQL query to include selfId in the WHERE clause
-	query := `SELECT group_id, self_id, messages_sent, active_members, date 
+	query := `SELECT group_id, self_id, message_type, guild_id, channel_id, messages_sent, active_members, date 
               FROM daily_group_stats 
-              WHERE self_id = ? AND date = ? 
+              WHERE self_id = ? AND date = ? AND (? = '' OR message_type = ?) 
               ORDER BY messages_sent DESC 
               LIMIT ?`
 	// Pass selfId along with date and rank to the query
-	rows, err := db.Query(query, selfId, date.Format("2006-01-02"), rank)
+	rows, err := s.db.Query(query, selfId, date.Format("2006-01-02"), scene, scene, rank)
 	if err != nil {
-		log.Printf("Error querying daily top groups for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error querying daily top groups for selfId %d: %w", selfId, err)
+		log.Printf("Error querying daily top groups for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily top groups for selfId %s: %w", selfId, err)
 	}
 	defer rows.Close()
 
-	var results []GroupStat
+	var results []structs.GroupStat
 	for rows.Next() {
-		var stat GroupStat
-		if err := rows.Scan(&stat.GroupID, &stat.SelfID, &stat.MessagesSent, &stat.ActiveMembers, &stat.Date); err != nil {
-			log.Printf("Error reading daily group stats for selfId %d: %v", selfId, err)
-			return nil, fmt.Errorf("error reading daily group stats for selfId %d: %w", selfId, err)
+		var stat structs.GroupStat
+		var date time.Time
+		if err := rows.Scan(&stat.GroupID, &stat.SelfID, &stat.MessageType, &stat.GuildID, &stat.ChannelID, &stat.MessagesSent, &stat.ActiveMembers, &date); err != nil {
+			log.Printf("Error reading daily group stats for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily group stats for selfId %s: %w", selfId, err)
 		}
+		stat.Date = date.Format("2006-01-02")
 		results = append(results, stat)
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Printf("Error during rows iteration for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error during rows iteration for selfId %d: %w", selfId, err)
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
 	}
 
 	return results, nil
 }
 
-type UserStat struct {
-	UserID                 int64  `json:"user_id"`
-	SelfID                 int64  `json:"self_id"`
-	Nickname               string `json:"nickname"`
-	Role                   string `json:"role"`
-	TotalMessagesSent      int    `json:"total_messages_sent,omitempty"`
-	LastMessageTimestamp   int64  `json:"last_message_timestamp,omitempty"`
-	ConsecutiveMessageDays int    `json:"consecutive_message_days,omitempty"`
-	MessagesSent           int    `json:"messages_sent,omitempty"`           // For daily stats
-	IncludedInGroupCount   bool   `json:"included_in_group_count,omitempty"` // For daily stats
-	Date                   string `json:"date,omitempty"`                    // Only for daily stats
-}
-
-func FetchTopUsers(db *sql.DB, selfId int64, rank int) ([]UserStat, error) {
-	query := `SELECT user_id, self_id, nickname, role, total_messages_sent, last_message_timestamp, consecutive_message_days 
+func (s *Store) FetchTopUsers(selfId string, scene string, rank int) ([]structs.UserStat, error) {
+	query := `SELECT user_id, self_id, nickname, role, total_messages_sent, last_message_timestamp, consecutive_message_days,
+                  private_messages, group_messages, guild_messages 
               FROM user_stats 
-              WHERE self_id = ? 
-              ORDER BY total_messages_sent DESC 
+              WHERE self_id = ?` + sceneOrder(scene, "total_messages_sent", "_messages") + ` 
               LIMIT ?`
-	rows, err := db.Query(query, selfId, rank)
+	rows, err := s.db.Query(query, selfId, rank)
 	if err != nil {
-		log.Printf("Error querying top users for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error querying top users for selfId %d: %w", selfId, err)
+		log.Printf("Error querying top users for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying top users for selfId %s: %w", selfId, err)
 	}
 	defer rows.Close()
 
-	var results []UserStat
+	var results []structs.UserStat
 	for rows.Next() {
-		var stat UserStat
-		if err := rows.Scan(&stat.UserID, &stat.SelfID, &stat.Nickname, &stat.Role, &stat.TotalMessagesSent, &stat.LastMessageTimestamp, &stat.ConsecutiveMessageDays); err != nil {
-			log.Printf("Error reading user stats for selfId %d: %v", selfId, err)
-			return nil, fmt.Errorf("error reading user stats for selfId %d: %w", selfId, err)
+		var stat structs.UserStat
+		if err := rows.Scan(&stat.UserID, &stat.SelfID, &stat.Nickname, &stat.Role, &stat.TotalMessagesSent, &stat.LastMessageTimestamp, &stat.ConsecutiveMessageDays,
+			&stat.PrivateMessages, &stat.GroupMessages, &stat.GuildMessages); err != nil {
+			log.Printf("Error reading user stats for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading user stats for selfId %s: %w", selfId, err)
 		}
 		results = append(results, stat)
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Printf("Error during rows iteration for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error during rows iteration for selfId %d: %w", selfId, err)
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
 	}
 
 	return results, nil
 }
 
-func FetchTopDailyUsers(db *sql.DB, selfId int64, date time.Time, rank int) ([]UserStat, error) {
-	query := `SELECT user_id, self_id, nickname, role, messages_sent, last_message_timestamp, included_in_group_count, date 
+func (s *Store) FetchTopDailyUsers(selfId string, scene string, date time.Time, rank int) ([]structs.UserStat, error) {
+	query := `SELECT user_id, self_id, nickname, role, messages_sent, last_message_timestamp, included_in_group_count, date,
+                  private_messages, group_messages, guild_messages 
               FROM daily_user_stats 
-              WHERE self_id = ? AND date = ? 
-              ORDER BY messages_sent DESC 
+              WHERE self_id = ? AND date = ?` + sceneOrder(scene, "messages_sent", "_messages") + ` 
+              LIMIT ?`
+	rows, err := s.db.Query(query, selfId, date.Format("2006-01-02"), rank)
+	if err != nil {
+		log.Printf("Error querying daily top users for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily top users for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.UserStat
+	for rows.Next() {
+		var stat structs.UserStat
+		var date time.Time
+		if err := rows.Scan(&stat.UserID, &stat.SelfID, &stat.Nickname, &stat.Role, &stat.MessagesSent, &stat.LastMessageTimestamp, &stat.IncludedInGroupCount, &date,
+			&stat.PrivateMessages, &stat.GroupMessages, &stat.GuildMessages); err != nil {
+			log.Printf("Error reading daily user stats for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily user stats for selfId %s: %w", selfId, err)
+		}
+		stat.Date = date.Format("2006-01-02")
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchConnectionSessions 返回最近的连接会话 selfId为空时返回所有机器人
+func (s *Store) FetchConnectionSessions(selfId string, limit int) ([]structs.ConnectionSession, error) {
+	query := `SELECT session_id, self_id, role, remote_ip, implementation, transport, connected_at, disconnected_at
+              FROM connection_sessions
+              WHERE ? = '' OR self_id = ?
+              ORDER BY connected_at DESC
+              LIMIT ?`
+	rows, err := s.db.Query(query, selfId, selfId, limit)
+	if err != nil {
+		log.Printf("Error querying connection sessions for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying connection sessions for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.ConnectionSession
+	for rows.Next() {
+		var session structs.ConnectionSession
+		var disconnectedAt sql.NullInt64
+		if err := rows.Scan(&session.SessionID, &session.SelfID, &session.Role, &session.RemoteIP, &session.Implementation,
+			&session.Transport, &session.ConnectedAt, &disconnectedAt); err != nil {
+			log.Printf("Error reading connection sessions for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading connection sessions for selfId %s: %w", selfId, err)
+		}
+		session.DisconnectedAt = disconnectedAt.Int64
+		session.Online = !disconnectedAt.Valid
+		results = append(results, session)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchDailyReplies 返回最近days天每天的指令数 回复数和回复率
+func (s *Store) FetchDailyReplies(selfId string, days int) ([]structs.ReplyStat, error) {
+	endDate := store.Now().Format("2006-01-02")
+	startDate := store.Now().AddDate(0, 0, -days).Format("2006-01-02")
+
+	query := `SELECT c.date, c.calls, COALESCE(r.replies, 0)
+              FROM (SELECT date, SUM(calls) AS calls FROM daily_command_stats
+                    WHERE self_id = ? AND date BETWEEN ? AND ? GROUP BY date) c
+              LEFT JOIN (SELECT date, SUM(replies) AS replies FROM daily_reply_stats
+                    WHERE self_id = ? AND date BETWEEN ? AND ? GROUP BY date) r ON r.date = c.date
+              ORDER BY c.date DESC`
+	rows, err := s.db.Query(query, selfId, startDate, endDate, selfId, startDate, endDate)
+	if err != nil {
+		log.Printf("Error querying daily replies for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily replies for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.ReplyStat
+	for rows.Next() {
+		var stat structs.ReplyStat
+		var date time.Time
+		if err := rows.Scan(&date, &stat.Calls, &stat.Replies); err != nil {
+			log.Printf("Error reading daily replies for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily replies for selfId %s: %w", selfId, err)
+		}
+		stat.Date = date.Format("2006-01-02")
+		stat.CalculateRate()
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchDailyCommandReplies 返回指定日期每个指令的调用数和回复数
+func (s *Store) FetchDailyCommandReplies(selfId string, date time.Time, rank int) ([]structs.ReplyStat, error) {
+	query := `SELECT c.command_name, c.calls, COALESCE(SUM(r.replies), 0), COALESCE(MAX(r.last_reply_timestamp), 0)
+              FROM daily_command_stats c
+              LEFT JOIN daily_reply_stats r
+                ON r.command_name = c.command_name AND r.self_id = c.self_id AND r.date = c.date
+              WHERE c.self_id = ? AND c.date = ?
+              GROUP BY c.command_name, c.calls
+              ORDER BY c.calls DESC
+              LIMIT ?`
+	rows, err := s.db.Query(query, selfId, date.Format("2006-01-02"), rank)
+	if err != nil {
+		log.Printf("Error querying daily command replies for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily command replies for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.ReplyStat
+	for rows.Next() {
+		var stat structs.ReplyStat
+		if err := rows.Scan(&stat.CommandName, &stat.Calls, &stat.Replies, &stat.LastReplyAt); err != nil {
+			log.Printf("Error reading daily command replies for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily command replies for selfId %s: %w", selfId, err)
+		}
+		stat.CalculateRate()
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchDailyGroupReplies 返回指定日期每个群收到的消息数和回复数
+func (s *Store) FetchDailyGroupReplies(selfId string, date time.Time, rank int) ([]structs.ReplyStat, error) {
+	query := `SELECT r.group_id, COALESCE(g.messages_sent, 0), SUM(r.replies), MAX(r.last_reply_timestamp)
+              FROM daily_reply_stats r
+              LEFT JOIN daily_group_stats g
+                ON g.group_id = r.group_id AND g.guild_id = '' AND g.channel_id = '' AND g.date = r.date
+              WHERE r.self_id = ? AND r.date = ?
+              GROUP BY r.group_id
+              ORDER BY SUM(r.replies) DESC
               LIMIT ?`
-	rows, err := db.Query(query, selfId, date.Format("2006-01-02"), rank)
+	rows, err := s.db.Query(query, selfId, date.Format("2006-01-02"), rank)
 	if err != nil {
-		log.Printf("Error querying daily top users for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error querying daily top users for selfId %d: %w", selfId, err)
+		log.Printf("Error querying daily group replies for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily group replies for selfId %s: %w", selfId, err)
 	}
 	defer rows.Close()
 
-	var results []UserStat
+	var results []structs.ReplyStat
 	for rows.Next() {
-		var stat UserStat
-		if err := rows.Scan(&stat.UserID, &stat.SelfID, &stat.Nickname, &stat.Role, &stat.MessagesSent, &stat.LastMessageTimestamp, &stat.IncludedInGroupCount, &stat.Date); err != nil {
-			log.Printf("Error reading daily user stats for selfId %d: %v", selfId, err)
-			return nil, fmt.Errorf("error reading daily user stats for selfId %d: %w", selfId, err)
+		var stat structs.ReplyStat
+		if err := rows.Scan(&stat.GroupID, &stat.Calls, &stat.Replies, &stat.LastReplyAt); err != nil {
+			log.Printf("Error reading daily group replies for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily group replies for selfId %s: %w", selfId, err)
 		}
+		stat.CalculateRate()
 		results = append(results, stat)
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Printf("Error during rows iteration for selfId %d: %v", selfId, err)
-		return nil, fmt.Errorf("error during rows iteration for selfId %d: %w", selfId, err)
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
 	}
 
 	return results, nil
 }
+
+// FetchDailyActionStats 返回指定日期每个action的调用数 失败率和耗时
+func (s *Store) FetchDailyActionStats(selfId string, date time.Time) ([]structs.ActionStat, error) {
+	query := `SELECT action, calls, failures, total_latency_ms, max_latency_ms
+              FROM daily_action_stats
+              WHERE self_id = ? AND date = ?
+              ORDER BY calls DESC`
+	rows, err := s.db.Query(query, selfId, date.Format("2006-01-02"))
+	if err != nil {
+		log.Printf("Error querying daily action stats for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily action stats for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.ActionStat
+	for rows.Next() {
+		var stat structs.ActionStat
+		if err := rows.Scan(&stat.Action, &stat.Calls, &stat.Failures, &stat.TotalLatencyMs, &stat.MaxLatencyMs); err != nil {
+			log.Printf("Error reading daily action stats for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily action stats for selfId %s: %w", selfId, err)
+		}
+		if stat.Calls > 0 {
+			stat.FailureRate = float64(stat.Failures) / float64(stat.Calls)
+			stat.AvgLatencyMs = float64(stat.TotalLatencyMs) / float64(stat.Calls)
+		}
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchDailyCommandLatency 返回指定日期每个指令的响应耗时分布 单位为秒
+func (s *Store) FetchDailyCommandLatency(selfId string, date time.Time, rank int) ([]structs.CommandLatency, error) {
+	query := `SELECT command_name, self_id, samples, avg_latency, p50, p90, p99, max_latency
+              FROM daily_command_latency
+              WHERE self_id = ? AND date = ?
+              ORDER BY samples DESC
+              LIMIT ?`
+	rows, err := s.db.Query(query, selfId, date.Format("2006-01-02"), rank)
+	if err != nil {
+		log.Printf("Error querying daily command latency for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily command latency for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.CommandLatency
+	for rows.Next() {
+		var stat structs.CommandLatency
+		if err := rows.Scan(&stat.CommandName, &stat.SelfID, &stat.Samples, &stat.AvgLatency, &stat.P50, &stat.P90, &stat.P99, &stat.MaxLatency); err != nil {
+			log.Printf("Error reading daily command latency for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily command latency for selfId %s: %w", selfId, err)
+		}
+		stat.Date = date.Format("2006-01-02")
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchDailyRequestFunnel 返回最近几天每种请求的数量 以及其中已加入和已发言的数量
+func (s *Store) FetchDailyRequestFunnel(selfId string, days int) ([]structs.RequestFunnel, error) {
+	endDate := store.Now().Format("2006-01-02")
+	startDate := store.Now().AddDate(0, 0, -days).Format("2006-01-02")
+
+	query := `SELECT request_date, request_type, COUNT(*), COUNT(joined_at), COUNT(first_message_at)
+              FROM request_events
+              WHERE self_id = ? AND request_date BETWEEN ? AND ?
+              GROUP BY request_date, request_type
+              ORDER BY request_date DESC, request_type`
+	rows, err := s.db.Query(query, selfId, startDate, endDate)
+	if err != nil {
+		log.Printf("Error querying request funnel for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying request funnel for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.RequestFunnel
+	for rows.Next() {
+		var funnel structs.RequestFunnel
+		var date time.Time
+		if err := rows.Scan(&date, &funnel.RequestType, &funnel.Requests, &funnel.Joined, &funnel.FirstMessaged); err != nil {
+			log.Printf("Error reading request funnel for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading request funnel for selfId %s: %w", selfId, err)
+		}
+		funnel.Date = date.Format("2006-01-02")
+		results = append(results, funnel)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchRequestEvents 返回指定日期收到的请求 包括邀请人和群号
+func (s *Store) FetchRequestEvents(selfId string, date time.Time) ([]structs.RequestRecord, error) {
+	query := `SELECT request_type, sub_type, CAST(user_id AS TEXT), CAST(group_id AS TEXT), comment, time,
+                     COALESCE(joined_at, 0), COALESCE(first_message_at, 0)
+              FROM request_events
+              WHERE self_id = ? AND request_date = ?
+              ORDER BY time DESC`
+	rows, err := s.db.Query(query, selfId, date.Format("2006-01-02"))
+	if err != nil {
+		log.Printf("Error querying request events for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying request events for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.RequestRecord
+	for rows.Next() {
+		var record structs.RequestRecord
+		if err := rows.Scan(&record.RequestType, &record.SubType, &record.UserID, &record.GroupID, &record.Comment, &record.Time, &record.JoinedAt, &record.FirstMessageAt); err != nil {
+			log.Printf("Error reading request events for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading request events for selfId %s: %w", selfId, err)
+		}
+		results = append(results, record)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchDailyNoticeStats 返回最近几天每种通知的数量
+func (s *Store) FetchDailyNoticeStats(selfId string, days int) ([]structs.NoticeStat, error) {
+	endDate := store.Now().Format("2006-01-02")
+	startDate := store.Now().AddDate(0, 0, -days).Format("2006-01-02")
+
+	query := `SELECT date, notice_type, sub_type, count, last_notice_timestamp
+              FROM daily_notice_stats
+              WHERE self_id = ? AND date BETWEEN ? AND ?
+              ORDER BY date DESC, count DESC`
+	rows, err := s.db.Query(query, selfId, startDate, endDate)
+	if err != nil {
+		log.Printf("Error querying daily notice stats for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily notice stats for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.NoticeStat
+	for rows.Next() {
+		var stat structs.NoticeStat
+		var date time.Time
+		if err := rows.Scan(&date, &stat.NoticeType, &stat.SubType, &stat.Count, &stat.LastNoticeTimestamp); err != nil {
+			log.Printf("Error reading daily notice stats for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily notice stats for selfId %s: %w", selfId, err)
+		}
+		stat.Date = date.Format("2006-01-02")
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchDailySegmentStats 返回最近days天每天每种消息段的统计 groupId为空时合计机器人的所有消息
+func (s *Store) FetchDailySegmentStats(selfId string, groupId string, days int) ([]structs.SegmentStat, error) {
+	endDate := store.Now().Format("2006-01-02")
+	startDate := store.Now().AddDate(0, 0, -days).Format("2006-01-02")
+
+	query := `SELECT date, segment_type, SUM(segments), SUM(messages), SUM(at_self)
+              FROM daily_segment_stats
+              WHERE self_id = ? AND date BETWEEN ? AND ?`
+	args := []interface{}{selfId, startDate, endDate}
+	if groupId != "" {
+		query += " AND group_id = ?"
+		args = append(args, groupId)
+	}
+	query += " GROUP BY date, segment_type ORDER BY date DESC, SUM(segments) DESC"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying daily segment stats for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily segment stats for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.SegmentStat
+	for rows.Next() {
+		var stat structs.SegmentStat
+		var date time.Time
+		if err := rows.Scan(&date, &stat.SegmentType, &stat.Segments, &stat.Messages, &stat.AtSelf); err != nil {
+			log.Printf("Error reading daily segment stats for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily segment stats for selfId %s: %w", selfId, err)
+		}
+		stat.Date = date.Format("2006-01-02")
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchDailyCommandRatio 返回最近days天每天指令与闲聊的消息数 groupId为空时合计机器人的所有消息
+func (s *Store) FetchDailyCommandRatio(selfId string, groupId string, days int) ([]structs.CommandRatio, error) {
+	endDate := store.Now().Format("2006-01-02")
+	startDate := store.Now().AddDate(0, 0, -days).Format("2006-01-02")
+
+	query := `SELECT date, SUM(commands), SUM(chats)
+              FROM daily_message_kind_stats
+              WHERE self_id = ? AND date BETWEEN ? AND ?`
+	args := []interface{}{selfId, startDate, endDate}
+	if groupId != "" {
+		query += " AND group_id = ?"
+		args = append(args, groupId)
+	}
+	query += " GROUP BY date ORDER BY date DESC"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying daily command ratio for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily command ratio for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.CommandRatio
+	for rows.Next() {
+		var count structs.CommandRatio
+		var date time.Time
+		if err := rows.Scan(&date, &count.Commands, &count.Chats); err != nil {
+			log.Printf("Error reading daily command ratio for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily command ratio for selfId %s: %w", selfId, err)
+		}
+		stat := structs.CommandRatio{Date: date.Format("2006-01-02"), GroupID: groupId}
+		stat.Add(count)
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchDailyGroupCommandRatio 返回某一天各群指令与闲聊的消息数 按消息数取前rank个群 不含私聊
+func (s *Store) FetchDailyGroupCommandRatio(selfId string, date time.Time, rank int) ([]structs.CommandRatio, error) {
+	query := `SELECT CAST(group_id AS TEXT), commands, chats
+              FROM daily_message_kind_stats
+              WHERE self_id = ? AND date = ? AND group_id != ''
+              ORDER BY commands + chats DESC
+              LIMIT ?`
+	rows, err := s.db.Query(query, selfId, date.Format("2006-01-02"), rank)
+	if err != nil {
+		log.Printf("Error querying daily group command ratio for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily group command ratio for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.CommandRatio
+	for rows.Next() {
+		var count structs.CommandRatio
+		stat := structs.CommandRatio{Date: date.Format("2006-01-02")}
+		if err := rows.Scan(&stat.GroupID, &count.Commands, &count.Chats); err != nil {
+			log.Printf("Error reading daily group command ratio for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily group command ratio for selfId %s: %w", selfId, err)
+		}
+		stat.Add(count)
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchDailyUserActivity 返回最近days天每天的活跃用户数和其中的新用户数 新用户为当天第一次向该机器人发言的用户
+func (s *Store) FetchDailyUserActivity(selfId string, days int) ([]structs.UserActivity, error) {
+	endDate := store.Now().Format("2006-01-02")
+	startDate := store.Now().AddDate(0, 0, -days).Format("2006-01-02")
+
+	query := `SELECT d.date, COUNT(*), SUM(CASE WHEN f.first_date = d.date THEN 1 ELSE 0 END)
+              FROM daily_user_stats d
+              LEFT JOIN user_first_seen f ON f.self_id = d.self_id AND f.user_id = d.user_id
+              WHERE d.self_id = ? AND d.date BETWEEN ? AND ?
+              GROUP BY d.date ORDER BY d.date DESC`
+	rows, err := s.db.Query(query, selfId, startDate, endDate)
+	if err != nil {
+		log.Printf("Error querying daily user activity for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying daily user activity for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.UserActivity
+	for rows.Next() {
+		var stat structs.UserActivity
+		var date time.Time
+		if err := rows.Scan(&date, &stat.ActiveUsers, &stat.NewUsers); err != nil {
+			log.Printf("Error reading daily user activity for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading daily user activity for selfId %s: %w", selfId, err)
+		}
+		stat.Date = date.Format("2006-01-02")
+		stat.ReturningUsers = stat.ActiveUsers - stat.NewUsers
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// FetchCohorts 返回最近days天每天的新用户在之后periods天内每天仍发言的人数
+func (s *Store) FetchCohorts(selfId string, days int, periods int) ([]structs.Cohort, error) {
+	today := store.Now().Format("2006-01-02")
+	startDate := store.Now().AddDate(0, 0, -days).Format("2006-01-02")
+
+	cohorts := make(map[string]*structs.Cohort)
+	rows, err := s.db.Query(`SELECT first_date, COUNT(*)
+              FROM user_first_seen
+              WHERE self_id = ? AND first_date BETWEEN ? AND ?
+              GROUP BY first_date`, selfId, startDate, today)
+	if err != nil {
+		log.Printf("Error querying cohorts for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying cohorts for selfId %s: %w", selfId, err)
+	}
+	for rows.Next() {
+		var date time.Time
+		var users int
+		if err := rows.Scan(&date, &users); err != nil {
+			rows.Close()
+			log.Printf("Error reading cohorts for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading cohorts for selfId %s: %w", selfId, err)
+		}
+		cohort := store.NewCohort(date.Format("2006-01-02"), today, periods)
+		cohort.NewUsers = users
+		cohorts[cohort.Date] = cohort
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	// 第一次发言之后periods天内每天仍发言的人数
+	rows, err = s.db.Query(`SELECT f.first_date, CAST(julianday(d.date) - julianday(f.first_date) AS INTEGER), COUNT(*)
+              FROM user_first_seen f
+              JOIN daily_user_stats d ON d.self_id = f.self_id AND d.user_id = f.user_id
+                  AND d.date > f.first_date AND d.date <= date(f.first_date, ?)
+              WHERE f.self_id = ? AND f.first_date BETWEEN ? AND ?
+              GROUP BY 1, 2`, fmt.Sprintf("+%d days", periods), selfId, startDate, today)
+	if err != nil {
+		log.Printf("Error querying cohort retention for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying cohort retention for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var date time.Time
+		var day, users int
+		if err := rows.Scan(&date, &day, &users); err != nil {
+			log.Printf("Error reading cohort retention for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading cohort retention for selfId %s: %w", selfId, err)
+		}
+		if cohort, ok := cohorts[date.Format("2006-01-02")]; ok {
+			store.AddRetained(cohort, day, users)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return store.FinishCohorts(cohorts), nil
+}
+
+// FetchNoticeTimeline 按时间倒序返回通知 groupId为空时返回机器人的所有通知 before为0时从最新开始
+func (s *Store) FetchNoticeTimeline(selfId string, groupId string, before int64, limit int) ([]structs.NoticeRecord, error) {
+	query := `SELECT notice_type, sub_type, CAST(group_id AS TEXT), CAST(user_id AS TEXT), CAST(operator_id AS TEXT), message_id, time
+              FROM notice_events
+              WHERE self_id = ?`
+	args := []interface{}{selfId}
+	if groupId != "" {
+		query += " AND group_id = ?"
+		args = append(args, groupId)
+	}
+	if before > 0 {
+		query += " AND time < ?"
+		args = append(args, before)
+	}
+	query += " ORDER BY time DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying notice timeline for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error querying notice timeline for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	var results []structs.NoticeRecord
+	for rows.Next() {
+		var record structs.NoticeRecord
+		if err := rows.Scan(&record.NoticeType, &record.SubType, &record.GroupID, &record.UserID, &record.OperatorID, &record.MessageID, &record.Time); err != nil {
+			log.Printf("Error reading notice timeline for selfId %s: %v", selfId, err)
+			return nil, fmt.Errorf("error reading notice timeline for selfId %s: %w", selfId, err)
+		}
+		results = append(results, record)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return nil, fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+
+	return results, nil
+}
+
+// 查询按群的用户统计 查询结果的列需与GroupUserStat的前九个字段一致
+func (s *Store) queryGroupUserStats(query string, args ...interface{}) ([]structs.GroupUserStat, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying group user stats: %v", err)
+		return nil, fmt.Errorf("error querying group user stats: %w", err)
+	}
+	defer rows.Close()
+
+	var results []structs.GroupUserStat
+	for rows.Next() {
+		var stat structs.GroupUserStat
+		if err := rows.Scan(&stat.SelfID, &stat.GroupID, &stat.UserID, &stat.Nickname, &stat.Card, &stat.Role,
+			&stat.MessagesSent, &stat.FirstMessageTimestamp, &stat.LastMessageTimestamp); err != nil {
+			log.Printf("Error reading group user stats: %v", err)
+			return nil, fmt.Errorf("error reading group user stats: %w", err)
+		}
+		results = append(results, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration: %v", err)
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+
+	return results, nil
+}
+
+// FetchGroupTopUsers 返回机器人某个群内累计发言最多的用户
+func (s *Store) FetchGroupTopUsers(selfId string, groupId string, rank int) ([]structs.GroupUserStat, error) {
+	query := `SELECT CAST(self_id AS TEXT), CAST(group_id AS TEXT), CAST(user_id AS TEXT), COALESCE(nickname, ''), COALESCE(card, ''), COALESCE(role, ''),
+                     total_messages_sent, first_message_timestamp, last_message_timestamp
+              FROM group_user_stats
+              WHERE self_id = ? AND group_id = ?
+              ORDER BY total_messages_sent DESC
+              LIMIT ?`
+	return s.queryGroupUserStats(query, selfId, groupId, rank)
+}
+
+// FetchDailyGroupTopUsers 返回机器人某个群内指定日期发言最多的用户
+func (s *Store) FetchDailyGroupTopUsers(selfId string, groupId string, date time.Time, rank int) ([]structs.GroupUserStat, error) {
+	query := `SELECT CAST(d.self_id AS TEXT), CAST(d.group_id AS TEXT), CAST(d.user_id AS TEXT), COALESCE(g.nickname, ''), COALESCE(g.card, ''), COALESCE(g.role, ''),
+                     d.messages_sent, COALESCE(g.first_message_timestamp, 0), d.last_message_timestamp
+              FROM daily_group_user_stats d
+              LEFT JOIN group_user_stats g ON g.self_id = d.self_id AND g.group_id = d.group_id AND g.user_id = d.user_id
+              WHERE d.self_id = ? AND d.group_id = ? AND d.date = ?
+              ORDER BY d.messages_sent DESC
+              LIMIT ?`
+	results, err := s.queryGroupUserStats(query, selfId, groupId, date.Format("2006-01-02"), rank)
+	for i := range results {
+		results[i].Date = date.Format("2006-01-02")
+	}
+	return results, err
+}
+
+// FetchUserGroups 返回用户发过言的群 最近发言的在前 selfId为空时包括所有机器人
+func (s *Store) FetchUserGroups(selfId string, userId string) ([]structs.GroupUserStat, error) {
+	query := `SELECT CAST(self_id AS TEXT), CAST(group_id AS TEXT), CAST(user_id AS TEXT), COALESCE(nickname, ''), COALESCE(card, ''), COALESCE(role, ''),
+                     total_messages_sent, first_message_timestamp, last_message_timestamp
+              FROM group_user_stats
+              WHERE user_id = ?`
+	args := []interface{}{userId}
+	if selfId != "" {
+		query += " AND self_id = ?"
+		args = append(args, selfId)
+	}
+	query += " ORDER BY last_message_timestamp DESC"
+	return s.queryGroupUserStats(query, args...)
+}
+
+// 查询日期范围内每小时的统计 groupId或command不为空时查询对应的表
+func (s *Store) fetchHourlyRange(selfId string, groupId string, command string, startDate string, endDate string, add func(date string, stat structs.HourlyStat)) error {
+	query := `SELECT date, hour, messages, active_users, active_groups, commands
+              FROM hourly_bot_stats
+              WHERE self_id = ? AND date BETWEEN ? AND ?`
+	args := []interface{}{selfId, startDate, endDate}
+	if groupId != "" {
+		query = `SELECT date, hour, messages_sent, 0, 0, 0
+              FROM hourly_group_stats
+              WHERE self_id = ? AND group_id = ? AND date BETWEEN ? AND ?`
+		args = []interface{}{selfId, groupId, startDate, endDate}
+	} else if command != "" {
+		query = `SELECT date, hour, 0, 0, 0, calls
+              FROM hourly_command_stats
+              WHERE self_id = ? AND command_name = ? AND date BETWEEN ? AND ?`
+		args = []interface{}{selfId, command, startDate, endDate}
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying hourly stats for selfId %s: %v", selfId, err)
+		return fmt.Errorf("error querying hourly stats for selfId %s: %w", selfId, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var stat structs.HourlyStat
+		var date time.Time
+		if err := rows.Scan(&date, &stat.Hour, &stat.Messages, &stat.ActiveUsers, &stat.ActiveGroups, &stat.Commands); err != nil {
+			log.Printf("Error reading hourly stats for selfId %s: %v", selfId, err)
+			return fmt.Errorf("error reading hourly stats for selfId %s: %w", selfId, err)
+		}
+		if stat.Hour < 0 || stat.Hour > 23 {
+			continue
+		}
+		add(date.Format("2006-01-02"), stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for selfId %s: %v", selfId, err)
+		return fmt.Errorf("error during rows iteration for selfId %s: %w", selfId, err)
+	}
+	return nil
+}
+
+// FetchHourlyStats 返回loc中某一天24小时的统计 groupId或command不为空时只统计该群的消息或该指令的调用
+func (s *Store) FetchHourlyStats(selfId string, groupId string, command string, date time.Time, loc *time.Location) ([]structs.HourlyStat, error) {
+	span := store.DaySpan(date, loc)
+	startDate, endDate := span.DateRange()
+	results := store.HourlyDay(span.Start)
+	err := s.fetchHourlyRange(selfId, groupId, command, startDate, endDate, func(date string, stat structs.HourlyStat) {
+		if t, ok := span.Locate(date, stat.Hour); ok {
+			results[t.Hour()].Add(stat)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// FetchWeekHourMatrix 返回loc中最近days天按星期几和小时合计的7x24矩阵 第一维为星期几
+func (s *Store) FetchWeekHourMatrix(selfId string, groupId string, command string, days int, loc *time.Location) ([][]structs.HourlyStat, error) {
+	span := store.RecentDaysSpan(days, loc)
+	startDate, endDate := span.DateRange()
+	matrix := store.WeekHourMatrix()
+	err := s.fetchHourlyRange(selfId, groupId, command, startDate, endDate, func(date string, stat structs.HourlyStat) {
+		if t, ok := span.Locate(date, stat.Hour); ok {
+			matrix[t.Weekday()][t.Hour()].Add(stat)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matrix, nil
+}
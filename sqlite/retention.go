@@ -0,0 +1,205 @@
+package sqlite
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// 每次删除的行数 分批删除避免长时间占用写锁
+const pruneBatchSize = 5000
+
+// 需要清理的表 condition中的?为截止日期 unix为true时为截止时间戳
+type retentionTable struct {
+	name      string
+	class     string
+	condition string
+	unix      bool
+}
+
+var retentionTables = []retentionTable{
+	{"messages", store.ClassRaw, "message_date < ?", false},
+	{"sent_messages", store.ClassRaw, "message_date < ?", false},
+	{"notice_events", store.ClassRaw, "notice_date < ?", false},
+	{"message_segments", store.ClassRaw, "message_date < ?", false},
+	{"robot_status", store.ClassDaily, "date < ?", false},
+	{"api_status", store.ClassDaily, "date < ?", false},
+	{"daily_user_stats", store.ClassDaily, "date < ?", false},
+	{"daily_group_stats", store.ClassDaily, "date < ?", false},
+	{"daily_group_user_stats", store.ClassDaily, "date < ?", false},
+	{"daily_command_stats", store.ClassDaily, "date < ?", false},
+	{"daily_reply_stats", store.ClassDaily, "date < ?", false},
+	{"daily_action_stats", store.ClassDaily, "date < ?", false},
+	{"daily_command_latency", store.ClassDaily, "date < ?", false},
+	{"daily_notice_stats", store.ClassDaily, "date < ?", false},
+	{"hourly_bot_stats", store.ClassDaily, "date < ?", false},
+	{"hourly_user_stats", store.ClassDaily, "date < ?", false},
+	{"hourly_group_stats", store.ClassDaily, "date < ?", false},
+	{"hourly_command_stats", store.ClassDaily, "date < ?", false},
+	{"daily_segment_stats", store.ClassDaily, "date < ?", false},
+	{"daily_message_kind_stats", store.ClassDaily, "date < ?", false},
+	{"request_events", store.ClassDaily, "request_date < ?", false},
+	// 未断开的会话不清理
+	{"connection_sessions", store.ClassDaily, "disconnected_at IS NOT NULL AND connected_at < ?", true},
+	{"cookies", store.ClassCookie, "expiration < ?", true},
+}
+
+// Prune 删除超过保留期限的数据和过期的cookie 然后归还空闲页
+func (s *Store) Prune(policy structs.RetentionPolicy) (*structs.PruneResult, error) {
+	start := time.Now()
+	result := &structs.PruneResult{
+		Time:    start.Unix(),
+		Deleted: make(map[string]int64),
+	}
+
+	for _, table := range retentionTables {
+		// 过期的cookie总是删除
+		days := 0
+		switch table.class {
+		case store.ClassRaw:
+			days = policy.RawDays
+		case store.ClassDaily:
+			days = policy.DailyDays
+		}
+		if table.class != store.ClassCookie && days <= 0 {
+			continue
+		}
+
+		var cutoff interface{} = store.RetentionCutoff(start, days)
+		if table.unix {
+			cutoff = start.AddDate(0, 0, -days).Unix()
+		}
+
+		deleted, err := s.deleteInBatches(table, cutoff)
+		if deleted > 0 {
+			result.Deleted[table.name] = deleted
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	freed, err := s.incrementalVacuum()
+	if err != nil {
+		return result, err
+	}
+	result.FreedPages = freed
+	result.DurationMs = time.Since(start).Milliseconds()
+
+	s.pruneMu.Lock()
+	s.lastPrune = result
+	s.pruneMu.Unlock()
+	return result, nil
+}
+
+func (s *Store) deleteInBatches(table retentionTable, cutoff interface{}) (int64, error) {
+	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE rowid IN (SELECT rowid FROM %s WHERE %s LIMIT %d)",
+		table.name, table.name, table.condition, pruneBatchSize)
+
+	var total int64
+	for {
+		res, err := s.db.Exec(deleteSQL, cutoff)
+		if err != nil {
+			return total, fmt.Errorf("error pruning %s: %w", table.name, err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return total, fmt.Errorf("error pruning %s: %w", table.name, err)
+		}
+		total += affected
+		if affected < pruneBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// 归还空闲页 未开启增量vacuum的数据库不会有变化
+func (s *Store) incrementalVacuum() (int64, error) {
+	before, err := s.pragmaInt("freelist_count")
+	if err != nil {
+		return 0, err
+	}
+	if before == 0 {
+		return 0, nil
+	}
+	// 每执行一步释放一页 需要读完所有结果才会执行完
+	rows, err := s.db.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return 0, fmt.Errorf("error running incremental vacuum: %w", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error running incremental vacuum: %w", err)
+	}
+	after, err := s.pragmaInt("freelist_count")
+	if err != nil {
+		return 0, err
+	}
+	return before - after, nil
+}
+
+func (s *Store) pragmaInt(name string) (int64, error) {
+	var value int64
+	if err := s.db.QueryRow("PRAGMA " + name).Scan(&value); err != nil {
+		return 0, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	return value, nil
+}
+
+// FetchStorageStats 返回每个表的行数和数据库的页占用
+func (s *Store) FetchStorageStats() (*structs.StorageStats, error) {
+	// 虚拟表的数据在其影子表中 未启用fts5时也无法读取
+	rows, err := s.db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND sql NOT LIKE 'CREATE VIRTUAL TABLE%' ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error listing tables: %w", err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	classes := make(map[string]string)
+	for _, table := range retentionTables {
+		classes[table.name] = table.class
+	}
+
+	stats := &structs.StorageStats{Backend: "sqlite"}
+	for _, name := range names {
+		table := structs.TableSize{Name: name, Class: classes[name]}
+		if err := s.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %q", name)).Scan(&table.Rows); err != nil {
+			return nil, fmt.Errorf("error counting rows of %s: %w", name, err)
+		}
+		stats.Tables = append(stats.Tables, table)
+	}
+	sort.SliceStable(stats.Tables, func(i, j int) bool { return stats.Tables[i].Rows > stats.Tables[j].Rows })
+
+	if stats.PageSize, err = s.pragmaInt("page_size"); err != nil {
+		return nil, err
+	}
+	if stats.PageCount, err = s.pragmaInt("page_count"); err != nil {
+		return nil, err
+	}
+	if stats.FreePages, err = s.pragmaInt("freelist_count"); err != nil {
+		return nil, err
+	}
+	stats.SizeBytes = stats.PageSize * stats.PageCount
+
+	s.pruneMu.Lock()
+	stats.LastPrune = s.lastPrune
+	s.pruneMu.Unlock()
+	return stats, nil
+}
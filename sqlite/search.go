@@ -0,0 +1,180 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// trigram分词的索引只能匹配至少三个字的词 更短的词逐条比较
+const minIndexedTermLength = 3
+
+// 保持索引与messages同步的触发器
+var messageSearchTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+        INSERT INTO messages_fts (rowid, raw_message) VALUES (new.message_id, new.raw_message);
+    END;`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+        INSERT INTO messages_fts (messages_fts, rowid, raw_message) VALUES ('delete', old.message_id, old.raw_message);
+    END;`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF raw_message ON messages BEGIN
+        INSERT INTO messages_fts (messages_fts, rowid, raw_message) VALUES ('delete', old.message_id, old.raw_message);
+        INSERT INTO messages_fts (rowid, raw_message) VALUES (new.message_id, new.raw_message);
+    END;`,
+}
+
+// EnsureMessageSearchIndex 编译时带有sqlite_fts5标签时为messages建立全文索引
+// 是否可用取决于编译选项而不是数据库版本 所以不放在migrate中 每次启动时检查
+// 不支持fts5时删除触发器 否则写入消息会失败 搜索退回逐条比较
+func EnsureMessageSearchIndex(db *sql.DB) error {
+	if !fts5Available(db) {
+		for _, name := range []string{"messages_fts_insert", "messages_fts_delete", "messages_fts_update"} {
+			if _, err := db.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				return fmt.Errorf("error dropping trigger %s: %w", name, err)
+			}
+		}
+		log.Println("sqlite未启用fts5 消息搜索将逐条比较 编译时加-tags sqlite_fts5可启用全文索引")
+		return nil
+	}
+
+	// 索引不存在 或不支持fts5时写入的消息没有进入索引 需要重建
+	var triggers int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'messages_fts_%'").Scan(&triggers); err != nil {
+		return fmt.Errorf("error checking message search triggers: %w", err)
+	}
+	if triggers == len(messageSearchTriggers) {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	statements := append([]string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+            raw_message, content='messages', content_rowid='message_id', tokenize='trigram'
+        );`,
+	}, messageSearchTriggers...)
+	statements = append(statements, "INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');")
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("error creating message search index: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing message search index: %w", err)
+	}
+	log.Println("Rebuilt message search index")
+	return nil
+}
+
+func fts5Available(db *sql.DB) bool {
+	var used bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&used); err != nil {
+		return false
+	}
+	return used
+}
+
+// 索引可用时才能使用MATCH
+func (s *Store) searchIndexReady() bool {
+	if !fts5Available(s.db) {
+		return false
+	}
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'messages_fts_%'").Scan(&count)
+	return err == nil && count == len(messageSearchTriggers)
+}
+
+// SearchMessages 搜索储存的消息 至少三个字的词使用全文索引 其余的词用LIKE比较
+func (s *Store) SearchMessages(search structs.MessageSearch) (*structs.MessageSearchResult, error) {
+	terms := store.SearchTerms(search.Keyword)
+
+	from := " FROM messages m"
+	where := " WHERE 1 = 1"
+	var args []interface{}
+
+	var phrases []string
+	indexed := s.searchIndexReady()
+	for _, term := range terms {
+		if indexed && utf8.RuneCountInString(term) >= minIndexedTermLength {
+			phrases = append(phrases, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+			continue
+		}
+		where += ` AND m.raw_message LIKE ? ESCAPE '\'`
+		args = append(args, "%"+escapeLike(term)+"%")
+	}
+	if len(phrases) > 0 {
+		from += " JOIN messages_fts ON messages_fts.rowid = m.message_id"
+		where += " AND messages_fts MATCH ?"
+		args = append(args, strings.Join(phrases, " "))
+	}
+
+	for _, filter := range []struct {
+		condition string
+		value     string
+	}{
+		{" AND m.self_id = ?", search.SelfID},
+		{" AND m.group_id = ?", search.GroupID},
+		{" AND m.user_id = ?", search.UserID},
+		{" AND m.message_date >= ?", search.StartDate},
+		{" AND m.message_date <= ?", search.EndDate},
+	} {
+		if filter.value != "" {
+			where += filter.condition
+			args = append(args, filter.value)
+		}
+	}
+
+	result := &structs.MessageSearchResult{Messages: []structs.MessageHit{}}
+	if err := s.db.QueryRow("SELECT COUNT(*)"+from+where, args...).Scan(&result.Total); err != nil {
+		log.Printf("Error counting messages for search %q: %v", search.Keyword, err)
+		return nil, fmt.Errorf("error counting messages for search %q: %w", search.Keyword, err)
+	}
+	if result.Total == 0 || search.Offset >= result.Total {
+		return result, nil
+	}
+
+	query := `SELECT COALESCE(m.original_id, CAST(m.message_id AS TEXT)), CAST(m.self_id AS TEXT), COALESCE(m.message_type, ''),
+              COALESCE(CAST(m.group_id AS TEXT), ''), COALESCE(CAST(m.user_id AS TEXT), ''),
+              COALESCE(m.raw_message, ''), m.time, m.message_date` + from + where +
+		" ORDER BY m.time DESC, m.message_id DESC LIMIT ? OFFSET ?"
+	rows, err := s.db.Query(query, append(args, search.Limit, search.Offset)...)
+	if err != nil {
+		log.Printf("Error searching messages for %q: %v", search.Keyword, err)
+		return nil, fmt.Errorf("error searching messages for %q: %w", search.Keyword, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hit structs.MessageHit
+		var date time.Time
+		if err := rows.Scan(&hit.MessageID, &hit.SelfID, &hit.MessageType, &hit.GroupID, &hit.UserID, &hit.RawMessage, &hit.Time, &date); err != nil {
+			log.Printf("Error reading searched message: %v", err)
+			return nil, fmt.Errorf("error reading searched message: %w", err)
+		}
+		hit.Date = date.Format("2006-01-02")
+		hit.Snippet = store.Snippet(hit.RawMessage, terms)
+		result.Messages = append(result.Messages, hit)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during rows iteration for search %q: %v", search.Keyword, err)
+		return nil, fmt.Errorf("error during rows iteration for search %q: %w", search.Keyword, err)
+	}
+
+	return result, nil
+}
+
+// 转义LIKE中的通配符
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term)
+}
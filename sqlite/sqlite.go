@@ -4,8 +4,76 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 )
 
+// 等待其他连接释放写锁的毫秒数
+const busyTimeoutMs = 5000
+
+// DSN 数据库文件的连接参数 不使用共享缓存 否则写入队列的事务未提交时其他连接的读写会立即失败
+// 事务开始时即获取写锁 等待写锁时受busy_timeout约束 WAL模式下读取不受写入影响
+func DSN(path string) string {
+	return fmt.Sprintf("file:%s?mode=rwc&_busy_timeout=%d&_txlock=immediate", path, busyTimeoutMs)
+}
+
+// 旧版本的表使用INTEGER PRIMARY KEY作为主键 该列是rowid的别名 只能存放整数
+// 为了支持onebot v12等非数字id 将这类表按新的建表语句重建 数据原样保留
+func rebuildRowidKeyTable(db *sql.DB, table, column, createTableSQL string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return fmt.Errorf("error reading %s table info: %w", table, err)
+	}
+	isRowidKey := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading %s table info: %w", table, err)
+		}
+		if name == column && pk == 1 && strings.EqualFold(columnType, "INTEGER") {
+			isRowidKey = true
+		}
+	}
+	rows.Close()
+	if !isRowidKey {
+		return nil
+	}
+
+	if err := rebuildTable(db, table, createTableSQL, fmt.Sprintf("SELECT * FROM %s_old", table)); err != nil {
+		return err
+	}
+
+	log.Printf("Rebuilt %s table to support non-numeric ids", table)
+	return nil
+}
+
+// 按新的建表语句重建表 selectSQL从<table>_old中选出写入新表的数据
+func rebuildTable(db *sql.DB, table, createTableSQL, selectSQL string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s_old;", table, table),
+		createTableSQL,
+		fmt.Sprintf("INSERT INTO %s %s;", table, selectSQL),
+		fmt.Sprintf("DROP TABLE %s_old;", table),
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			log.Printf("Error rebuilding %s table: %v", table, err)
+			return fmt.Errorf("error rebuilding %s table: %w", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error rebuilding %s table: %w", table, err)
+	}
+	return nil
+}
+
 // 网页登入cookie
 func EnsureCookieTablesExist(db *sql.DB) error {
 	createTableSQL := `
@@ -89,7 +157,7 @@ func EnsureUserStatsTableExists(db *sql.DB) error {
 	// Update user_stats table to store cumulative data only
 	createCumulativeTableSQL := `
     CREATE TABLE IF NOT EXISTS user_stats (
-        user_id INTEGER PRIMARY KEY,
+        user_id BIGINT PRIMARY KEY,
         self_id BIGINT,
         nickname TEXT,
         role TEXT,
@@ -102,6 +170,9 @@ func EnsureUserStatsTableExists(db *sql.DB) error {
 		log.Printf("Error creating cumulative user_stats table: %v", err)
 		return fmt.Errorf("error creating cumulative user_stats table: %w", err)
 	}
+	if err := rebuildRowidKeyTable(db, "user_stats", "user_id", createCumulativeTableSQL); err != nil {
+		return err
+	}
 
 	// Create a new table for daily statistics
 	createDailyTableSQL := `
@@ -140,7 +211,7 @@ func EnsureGroupStatsTableExists(db *sql.DB) error {
 	// Update group_stats table to store cumulative data only
 	createCumulativeTableSQL := `
     CREATE TABLE IF NOT EXISTS group_stats (
-        group_id INTEGER PRIMARY KEY,
+        group_id BIGINT PRIMARY KEY,
         self_id BIGINT,
         total_messages_sent INTEGER DEFAULT 0,
         last_message_timestamp INTEGER,
@@ -151,6 +222,9 @@ func EnsureGroupStatsTableExists(db *sql.DB) error {
 		log.Printf("Error creating cumulative group_stats table: %v", err)
 		return fmt.Errorf("error creating cumulative group_stats table: %w", err)
 	}
+	if err := rebuildRowidKeyTable(db, "group_stats", "group_id", createCumulativeTableSQL); err != nil {
+		return err
+	}
 
 	// Create a new table for daily statistics
 	createDailyTableSQL := `
@@ -249,3 +323,221 @@ func EnsureAPITableExists(db *sql.DB) error {
 	log.Println("Ensured that api_status table exists")
 	return nil
 }
+
+// 连接会话表
+func EnsureConnectionSessionsTableExists(db *sql.DB) error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS connection_sessions (
+        session_id INTEGER PRIMARY KEY AUTOINCREMENT,
+        self_id BIGINT,
+        role TEXT,
+        remote_ip TEXT,
+        implementation TEXT,
+        transport TEXT,
+        connected_at INTEGER NOT NULL,
+        disconnected_at INTEGER
+    );`
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Printf("Error creating connection_sessions table: %v", err)
+		return fmt.Errorf("error creating connection_sessions table: %w", err)
+	}
+
+	createIndexSQL := `CREATE INDEX IF NOT EXISTS idx_connection_self_id ON connection_sessions (self_id);`
+	if _, err := db.Exec(createIndexSQL); err != nil {
+		log.Printf("Error creating index on connection_sessions: %v", err)
+		return fmt.Errorf("error creating index on connection_sessions: %w", err)
+	}
+
+	log.Println("Ensured that connection_sessions table exists")
+	return nil
+}
+
+// 机器人发出的消息表和每日回复统计表
+func EnsureReplyStatsTablesExist(db *sql.DB) error {
+	// 发出的消息 仅在storeMsgs开启时写入
+	createSentMessagesTableSQL := `
+    CREATE TABLE IF NOT EXISTS sent_messages (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        message_id TEXT,
+        message_type TEXT,
+        time INTEGER,
+        self_id BIGINT,
+        raw_message TEXT,
+        user_id BIGINT,
+        group_id BIGINT,
+        reply_to TEXT,
+        command_name TEXT,
+        message_date DATE
+    );`
+	if _, err := db.Exec(createSentMessagesTableSQL); err != nil {
+		log.Printf("Error creating sent_messages table: %v", err)
+		return fmt.Errorf("error creating sent_messages table: %w", err)
+	}
+
+	// 每日回复数 按群和触发回复的指令拆分 无法对应到指令时command_name为空
+	createDailyReplyTableSQL := `
+    CREATE TABLE IF NOT EXISTS daily_reply_stats (
+        self_id BIGINT,
+        date DATE NOT NULL,
+        group_id BIGINT,
+        command_name TEXT,
+        replies INTEGER DEFAULT 0,
+        last_reply_timestamp INTEGER,
+        PRIMARY KEY (self_id, date, group_id, command_name)
+    );`
+	if _, err := db.Exec(createDailyReplyTableSQL); err != nil {
+		log.Printf("Error creating daily_reply_stats table: %v", err)
+		return fmt.Errorf("error creating daily_reply_stats table: %w", err)
+	}
+
+	indexesSQL := []string{
+		"CREATE INDEX IF NOT EXISTS idx_sent_self_id ON sent_messages(self_id);",
+		"CREATE INDEX IF NOT EXISTS idx_sent_message_date ON sent_messages(message_date);",
+		"CREATE INDEX IF NOT EXISTS idx_daily_reply_date ON daily_reply_stats(date);",
+	}
+	for _, sql := range indexesSQL {
+		if _, err := db.Exec(sql); err != nil {
+			log.Printf("Error creating index: %v", err)
+			return fmt.Errorf("error creating index: %w", err)
+		}
+	}
+
+	log.Println("Ensured that sent_messages and daily_reply_stats tables exist")
+	return nil
+}
+
+// 中继模式下的action统计表
+func EnsureActionStatsTableExists(db *sql.DB) error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS daily_action_stats (
+        self_id BIGINT,
+        date DATE NOT NULL,
+        action TEXT,
+        calls INTEGER DEFAULT 0,
+        failures INTEGER DEFAULT 0,
+        total_latency_ms INTEGER DEFAULT 0,
+        max_latency_ms INTEGER DEFAULT 0,
+        PRIMARY KEY (self_id, date, action)
+    );`
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Printf("Error creating daily_action_stats table: %v", err)
+		return fmt.Errorf("error creating daily_action_stats table: %w", err)
+	}
+	log.Println("Ensured that daily_action_stats table exists")
+	return nil
+}
+
+// 指令响应耗时表 由messages和sent_messages定期汇总 耗时单位为秒
+func EnsureCommandLatencyTableExists(db *sql.DB) error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS daily_command_latency (
+        command_name TEXT,
+        self_id BIGINT,
+        date DATE NOT NULL,
+        samples INTEGER DEFAULT 0,
+        avg_latency REAL DEFAULT 0,
+        p50 INTEGER DEFAULT 0,
+        p90 INTEGER DEFAULT 0,
+        p99 INTEGER DEFAULT 0,
+        max_latency INTEGER DEFAULT 0,
+        PRIMARY KEY (command_name, self_id, date)
+    );`
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Printf("Error creating daily_command_latency table: %v", err)
+		return fmt.Errorf("error creating daily_command_latency table: %w", err)
+	}
+
+	createIndexSQL := `CREATE INDEX IF NOT EXISTS idx_daily_latency_date ON daily_command_latency (date);`
+	if _, err := db.Exec(createIndexSQL); err != nil {
+		log.Printf("Error creating index on daily_command_latency: %v", err)
+		return fmt.Errorf("error creating index on daily_command_latency: %w", err)
+	}
+
+	log.Println("Ensured that daily_command_latency table exists")
+	return nil
+}
+
+// 好友请求与加群邀请 joined_at和first_message_at用于统计 邀请->入群->首条消息 的转化
+func EnsureRequestEventsTableExists(db *sql.DB) error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS request_events (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        self_id BIGINT,
+        request_type TEXT,
+        sub_type TEXT,
+        user_id BIGINT,
+        group_id BIGINT,
+        comment TEXT,
+        time INTEGER,
+        request_date DATE,
+        joined_at INTEGER,
+        first_message_at INTEGER
+    );`
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Printf("Error creating request_events table: %v", err)
+		return fmt.Errorf("error creating request_events table: %w", err)
+	}
+
+	indexesSQL := []string{
+		"CREATE INDEX IF NOT EXISTS idx_request_self_date ON request_events (self_id, request_date);",
+		"CREATE INDEX IF NOT EXISTS idx_request_group ON request_events (self_id, group_id);",
+		"CREATE INDEX IF NOT EXISTS idx_request_user ON request_events (self_id, user_id);",
+	}
+	for _, indexSQL := range indexesSQL {
+		if _, err := db.Exec(indexSQL); err != nil {
+			log.Printf("Error creating index on request_events: %v", err)
+			return fmt.Errorf("error creating index on request_events: %w", err)
+		}
+	}
+
+	log.Println("Ensured that request_events table exists")
+	return nil
+}
+
+// 所有通知事件的明细和每日按类型的汇总
+func EnsureNoticeEventsTablesExist(db *sql.DB) error {
+	createTablesSQL := []string{
+		`CREATE TABLE IF NOT EXISTS notice_events (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            self_id BIGINT,
+            notice_type TEXT,
+            sub_type TEXT,
+            group_id BIGINT,
+            user_id BIGINT,
+            operator_id BIGINT,
+            message_id TEXT,
+            time INTEGER,
+            notice_date DATE
+        );`,
+		`CREATE TABLE IF NOT EXISTS daily_notice_stats (
+            self_id BIGINT,
+            date DATE NOT NULL,
+            notice_type TEXT,
+            sub_type TEXT,
+            count INTEGER DEFAULT 0,
+            last_notice_timestamp INTEGER,
+            PRIMARY KEY (self_id, date, notice_type, sub_type)
+        );`,
+	}
+	for _, createSQL := range createTablesSQL {
+		if _, err := db.Exec(createSQL); err != nil {
+			log.Printf("Error creating notice tables: %v", err)
+			return fmt.Errorf("error creating notice tables: %w", err)
+		}
+	}
+
+	indexesSQL := []string{
+		"CREATE INDEX IF NOT EXISTS idx_notice_self_time ON notice_events (self_id, time);",
+		"CREATE INDEX IF NOT EXISTS idx_notice_group_time ON notice_events (self_id, group_id, time);",
+		"CREATE INDEX IF NOT EXISTS idx_daily_notice_date ON daily_notice_stats (date);",
+	}
+	for _, indexSQL := range indexesSQL {
+		if _, err := db.Exec(indexSQL); err != nil {
+			log.Printf("Error creating index on notice tables: %v", err)
+			return fmt.Errorf("error creating index on notice tables: %w", err)
+		}
+	}
+
+	log.Println("Ensured that notice_events and daily_notice_stats tables exist")
+	return nil
+}
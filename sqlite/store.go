@@ -0,0 +1,124 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// Store 基于sqlite的存储 表结构由migrate维护
+type Store struct {
+	db     *sql.DB
+	config config.Config
+	writer *Writer
+
+	pruneMu   sync.Mutex
+	lastPrune *structs.PruneResult
+}
+
+var _ store.Store = (*Store)(nil)
+
+// NewStore 使用已完成结构变更的数据库创建存储
+func NewStore(db *sql.DB, config config.Config) *Store {
+	return &Store{db: db, config: config}
+}
+
+// Close 等待写入队列中的事件全部写入 数据库连接由调用方关闭
+func (s *Store) Close() error {
+	if s.writer != nil {
+		s.writer.close()
+	}
+	return nil
+}
+
+// RecordAPICheck 记录一次api存活检测的结果
+func (s *Store) RecordAPICheck(apiURL string, date string, success bool) error {
+	var sqlStr string
+	if success {
+		// 更新已存在的行，或者插入一个新行，增加成功请求的次数
+		sqlStr = `
+        INSERT INTO api_status (api_url, date, online, checks_performed, response_time, checks_failed)
+        VALUES (?, ?, TRUE, 1, 1, 0)
+        ON CONFLICT(api_url, date) DO UPDATE SET
+            online = TRUE,
+            checks_performed = checks_performed + 1,
+            response_time = response_time + 1`
+	} else {
+		// 更新已存在的行，或者插入一个新行，增加失败的请求次数
+		sqlStr = `
+        INSERT INTO api_status (api_url, date, online, checks_performed, checks_failed)
+        VALUES (?, ?, FALSE, 1, 1)
+        ON CONFLICT(api_url, date) DO UPDATE SET
+            online = FALSE,
+            checks_performed = checks_performed + 1,
+            checks_failed = checks_failed + 1`
+	}
+
+	if _, err := s.db.Exec(sqlStr, apiURL, date); err != nil {
+		return fmt.Errorf("error updating or inserting API status for %s on %s: %w", apiURL, date, err)
+	}
+	return nil
+}
+
+// FetchAPIStatuses 返回一个api最近days天每天的检测结果
+func (s *Store) FetchAPIStatuses(apiURL string, days int) ([]structs.APIStatus, error) {
+	endDate := store.Now()
+	startDate := endDate.AddDate(0, 0, -days)
+
+	query := `
+        SELECT date, online, COALESCE(response_time, 0), checks_performed, checks_failed
+        FROM api_status
+        WHERE api_url = ? AND date BETWEEN ? AND ?
+        ORDER BY date DESC`
+	rows, err := s.db.Query(query, apiURL, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	if err != nil {
+		log.Printf("Error querying api_status for %s: %v", apiURL, err)
+		return nil, fmt.Errorf("error querying api_status for %s: %w", apiURL, err)
+	}
+	defer rows.Close()
+
+	var results []structs.APIStatus
+	for rows.Next() {
+		var status structs.APIStatus
+		var date time.Time
+		if err := rows.Scan(&date, &status.Online, &status.ResponseTime, &status.ChecksPerformed, &status.ChecksFailed); err != nil {
+			log.Printf("Error reading api status rows for %s: %v", apiURL, err)
+			return nil, fmt.Errorf("error reading api status rows for %s: %w", apiURL, err)
+		}
+		status.Date = date.Format("2006-01-02")
+		results = append(results, status)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during rows iteration for %s: %w", apiURL, err)
+	}
+
+	return results, nil
+}
+
+// SaveCookie 保存登录cookie
+func (s *Store) SaveCookie(cookie string, expiration int64) error {
+	if _, err := s.db.Exec("INSERT INTO cookies (cookie_id, expiration) VALUES (?, ?)", cookie, expiration); err != nil {
+		return fmt.Errorf("error inserting cookie: %w", err)
+	}
+	return nil
+}
+
+// FetchCookieExpiration 返回cookie的过期时间 不存在时返回store.ErrNotFound
+func (s *Store) FetchCookieExpiration(cookie string) (int64, error) {
+	var expiration int64
+	err := s.db.QueryRow("SELECT expiration FROM cookies WHERE cookie_id = ?", cookie).Scan(&expiration)
+	if err == sql.ErrNoRows {
+		return 0, store.ErrNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error querying cookie: %w", err)
+	}
+	return expiration, nil
+}
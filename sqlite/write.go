@@ -2,222 +2,256 @@ package sqlite
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
-	"strings"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
 )
 
-// lastActivityMap stores the last activity time for each self_id.
-var lastActivityMap sync.Map
+type recentCommandInfo struct {
+	commandName string
+	time        int64
+}
 
-func init() {
-	go func() {
-		for {
-			time.Sleep(30 * time.Second)
-			checkAndUpdateRobotStatus()
-		}
-	}()
+// recentCommands 每个会话(群或私聊)最近一次收到的指令 用于将机器人的回复归属到指令
+// 由写入队列持有 只在写入goroutine中访问 批次提交后才更新
+type recentCommands struct {
+	commands map[string]recentCommandInfo
+	latest   int64 // 已记录的最新指令时间 早于它超过回复窗口的指令不再需要
+}
+
+func newRecentCommands() *recentCommands {
+	return &recentCommands{commands: make(map[string]recentCommandInfo)}
 }
 
-func checkAndUpdateRobotStatus() {
-	now := time.Now()
-	lastActivityMap.Range(func(key, value interface{}) bool {
-		selfID := key.(int64)
-		lastActivity := value.(time.Time)
-		if now.Sub(lastActivity) > time.Minute { // Check if last activity was more than a minute ago
-			updateRobotOffline(selfID) // Update online status to false
+// 写入已提交批次中的指令 并清理超出回复窗口的旧指令
+func (r *recentCommands) apply(commands map[string]recentCommandInfo) {
+	for key, info := range commands {
+		if current, ok := r.commands[key]; !ok || info.time >= current.time {
+			r.commands[key] = info
 		}
-		return true
-	})
+		if info.time > r.latest {
+			r.latest = info.time
+		}
+	}
+	for key, info := range r.commands {
+		if r.latest-info.time > store.ReplyWindow {
+			delete(r.commands, key)
+		}
+	}
 }
 
-func updateRobotOffline(selfID int64) {
-	db, err := sql.Open("sqlite3", "file:mydb.sqlite?cache=shared&mode=rwc")
-	if err != nil {
-		log.Printf("Error opening database: %v", err)
+// 会话标识 群消息按群 私聊按对方
+func sceneKey(event structs.Event) string {
+	if event.GroupID != "" {
+		return event.SelfID + ":group:" + event.GroupID
+	}
+	return event.SelfID + ":private:" + event.UserID
+}
+
+// 记录会话中最近的指令 闲聊不覆盖之前的指令 事件失败回滚时丢弃
+func (b *batch) rememberCommand(event structs.Event, commandName string) {
+	if commandName == "" {
 		return
 	}
-	defer db.Close()
+	b.eventCommand = &recentCommand{key: sceneKey(event), info: recentCommandInfo{commandName: commandName, time: event.Time}}
+}
 
-	_, err = db.Exec("UPDATE robot_status SET online = ? WHERE self_id = ?", false, selfID)
-	if err != nil {
-		log.Printf("Error setting robot status offline: %v", err)
+// 查找回复对应的指令 优先使用reply段引用的原消息 其次使用同一会话窗口内最近的指令
+func (b *batch) replyCommandName(event structs.Event, replyTo string) string {
+	if replyTo != "" {
+		var rawMessage string
+		err := b.tx.QueryRow("SELECT raw_message FROM messages WHERE self_id = ? AND original_id = ?", event.SelfID, replyTo).Scan(&rawMessage)
+		if err == nil {
+			return store.ParseCommandName(event.SelfID, rawMessage)
+		}
+	}
+	info, ok := b.recentCommands[sceneKey(event)]
+	if !ok && b.recent != nil {
+		info, ok = b.recent.commands[sceneKey(event)]
 	}
+	if ok && event.Time-info.time <= store.ReplyWindow {
+		return info.commandName
+	}
+	return ""
 }
 
-// 用于解析RawMessage以提取指令名
-func parseCommandName(rawMessage string) string {
-	parts := strings.SplitN(rawMessage, " ", 2)
-	if len(parts) > 0 {
-		return parts[0]
+// 消息表的主键 v11的数字id可直接作为主键 v12等非数字id使用之前保存该消息的行 没有时交给自增主键
+func (b *batch) messageRowID(selfID string, messageID string) (interface{}, error) {
+	if id, err := strconv.ParseInt(messageID, 10, 64); err == nil {
+		return id, nil
+	}
+	if messageID == "" {
+		return nil, nil
+	}
+	var rowID int64
+	err := b.tx.QueryRow("SELECT message_id FROM messages WHERE self_id = ? AND original_id = ?", selfID, messageID).Scan(&rowID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error looking up message %s: %v", messageID, err)
 	}
-	return rawMessage
+	return rowID, nil
 }
 
 // 处理消息事件
-func ProcessMessageEvent(db *sql.DB, event structs.MessageEvent, config config.Config) error {
-	// 当前时间戳和日期，提前计算
-	currentDate := time.Unix(event.Time, 0).Format("2006-01-02")
+func (b *batch) processMessageEvent(event structs.Event, config config.Config) error {
+	// 当前时间戳和日期，提前计算 连续天数在sql中按统计时区的偏移计算日期
+	currentDate := store.EventDate(event)
+	offset := store.UTCOffset(event.Time)
 	// // 获取当前时间
 	// currentTime := time.Now()
 	// // 转换为10位时间戳（秒）
 	// tenDigitTimestamp := currentTime.Unix() // Unix方法返回一个int64类型的10位时间戳
 
+	// 消息所在场景的计数为1 其余为0
+	scene := event.Scene()
+	private, group, guild := sceneCount(scene)
+
 	// 更新或插入每日用户统计
 	dailyUserSQL := `
 	INSERT INTO daily_user_stats 
-		(user_id, self_id, date, nickname, role, messages_sent, last_message_timestamp, included_in_group_count)
+		(user_id, self_id, date, nickname, role, messages_sent, last_message_timestamp, included_in_group_count,
+		 private_messages, group_messages, guild_messages)
 	VALUES 
-		(?, ?, ?, ?, ?, 1, ?, TRUE)
-	ON CONFLICT(user_id, date) DO UPDATE SET
+		(?, ?, ?, ?, ?, 1, ?, TRUE, ?, ?, ?)
+	ON CONFLICT(user_id, self_id, date) DO UPDATE SET
 		messages_sent = daily_user_stats.messages_sent + 1,
 		last_message_timestamp = excluded.last_message_timestamp,
 		included_in_group_count = CASE
 			WHEN daily_user_stats.messages_sent = 0 THEN TRUE
 			ELSE daily_user_stats.included_in_group_count
-		END
+		END,
+		private_messages = daily_user_stats.private_messages + excluded.private_messages,
+		group_messages = daily_user_stats.group_messages + excluded.group_messages,
+		guild_messages = daily_user_stats.guild_messages + excluded.guild_messages
 	`
-	if _, err := db.Exec(dailyUserSQL, event.UserID, event.SelfID, currentDate, event.Sender.Nickname, event.Sender.Role, event.Time, event.Time); err != nil {
+	if _, err := b.tx.Exec(dailyUserSQL, event.UserID, event.SelfID, currentDate, event.Sender.Nickname, event.Sender.Role, event.Time, private, group, guild); err != nil {
 		log.Printf("Error updating daily user stats: %v", err)
 		return err
 	}
 
 	// 更新总用户统计
 	userSQL := `
-	INSERT INTO user_stats (user_id, self_id, nickname, role, total_messages_sent, last_message_timestamp, consecutive_message_days)
-	VALUES (?, ?, ?, ?, 1, ?, 1)
-	ON CONFLICT(user_id) DO UPDATE SET
+	INSERT INTO user_stats (user_id, self_id, nickname, role, total_messages_sent, last_message_timestamp, consecutive_message_days,
+		private_messages, group_messages, guild_messages)
+	VALUES (?, ?, ?, ?, 1, ?, 1, ?, ?, ?)
+	ON CONFLICT(user_id, self_id) DO UPDATE SET
 		nickname = excluded.nickname,
 		role = excluded.role,
 		total_messages_sent = user_stats.total_messages_sent + 1,
+		private_messages = user_stats.private_messages + excluded.private_messages,
+		group_messages = user_stats.group_messages + excluded.group_messages,
+		guild_messages = user_stats.guild_messages + excluded.guild_messages,
 		last_message_timestamp = excluded.last_message_timestamp,
 		consecutive_message_days = CASE 
-			WHEN date(user_stats.last_message_timestamp, 'unixepoch', '+1 day') = date(?, 'unixepoch') THEN user_stats.consecutive_message_days + 1 
-			WHEN date(user_stats.last_message_timestamp, 'unixepoch') < date(?, 'unixepoch') THEN 1
+			WHEN date(user_stats.last_message_timestamp + ?, 'unixepoch', '+1 day') = ? THEN user_stats.consecutive_message_days + 1 
+			WHEN date(user_stats.last_message_timestamp + ?, 'unixepoch') < ? THEN 1
 			ELSE consecutive_message_days
 		END
 	`
-	if _, err := db.Exec(userSQL, event.UserID, event.SelfID, event.Sender.Nickname, event.Sender.Role, event.Time, event.Time, event.Time); err != nil {
+	if _, err := b.tx.Exec(userSQL, event.UserID, event.SelfID, event.Sender.Nickname, event.Sender.Role, event.Time, private, group, guild, offset, currentDate, offset, currentDate); err != nil {
 		log.Printf("Error updating user stats: %v", err)
 		return err
 	}
 
 	// 获取用户的 included_in_group_count 状态
 	var includedInGroupCount bool
-	err := db.QueryRow("SELECT included_in_group_count FROM daily_user_stats WHERE user_id = ? AND date = ?", event.UserID, currentDate).Scan(&includedInGroupCount)
+	err := b.tx.QueryRow("SELECT included_in_group_count FROM daily_user_stats WHERE user_id = ? AND self_id = ? AND date = ?", event.UserID, event.SelfID, currentDate).Scan(&includedInGroupCount)
 	if err != nil {
 		log.Printf("Error fetching included_in_group_count: %v", err)
 		return fmt.Errorf("error fetching included_in_group_count: %v", err)
 	}
 
-	// 开启事务
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("error starting transaction: %v", err)
-	}
-
-	// 尝试在事务中完成所有数据库操作
-	defer func() {
-		if p := recover(); p != nil {
-			tx.Rollback()
-			panic(p) // re-throw panic after Rollback
-		} else if err != nil {
-			tx.Rollback() // err is non-nil; don't change it
-		} else {
-			err = tx.Commit() // err is nil; if Commit returns error update err
-		}
-	}()
-
+	segments := event.Segments()
 	if config.StoreMsgs {
 		// 插入或更新消息到 messages 表
 		messageSQL := `
-		INSERT INTO messages (message_id, message_type, time, self_id, raw_message, user_id, group_id, message_date)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (message_id, message_type, time, self_id, raw_message, user_id, group_id, message_date, original_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(message_id) DO UPDATE SET
+			original_id = excluded.original_id,
 			message_type = excluded.message_type,
 			time = excluded.time,
 			raw_message = excluded.raw_message,
 			user_id = excluded.user_id,
 			group_id = excluded.group_id,
-			message_date = excluded.message_date;`
-		if _, err = tx.Exec(messageSQL, event.MessageID, event.MessageType, event.Time, event.SelfID, event.RawMessage, event.UserID, event.GroupID, currentDate); err != nil {
+			message_date = excluded.message_date
+		RETURNING message_id;`
+		messageRowID, err := b.messageRowID(event.SelfID, event.MessageID)
+		if err != nil {
+			return err
+		}
+		var rowID int64
+		if err = b.tx.QueryRow(messageSQL, messageRowID, event.DetailType, event.Time, event.SelfID, event.RawMessage, event.UserID, event.GroupID, currentDate, event.MessageID).Scan(&rowID); err != nil {
 			return fmt.Errorf("error inserting message: %v", err)
 		}
+		if err = b.storeSegments(rowID, event.SelfID, segments, currentDate); err != nil {
+			return err
+		}
 	}
 
-	// 处理指令统计
-	commandName := parseCommandName(event.RawMessage)
-
-	// 更新总指令统计
-	commandTotalSQL := `
-    INSERT INTO command_stats (command_name, self_id, total_calls, last_call_timestamp)
-    VALUES (?, ?, 1, ?)
-    ON CONFLICT(command_name, self_id) DO UPDATE SET
-        total_calls = command_stats.total_calls + 1,
-        last_call_timestamp = ?;`
-	if _, err := tx.Exec(commandTotalSQL, commandName, event.SelfID, event.Time, event.Time); err != nil {
-		return fmt.Errorf("error updating command total stats: %v", err)
-	}
-
-	// 更新每日指令统计
-	commandDailySQL := `
-    INSERT INTO daily_command_stats (command_name, self_id, date, calls, last_call_timestamp)
-    VALUES (?, ?, ?, 1, ?)
-    ON CONFLICT(command_name, self_id, date) DO UPDATE SET
-        calls = daily_command_stats.calls + 1,
-        last_call_timestamp = ?;`
-	if _, err := tx.Exec(commandDailySQL, commandName, event.SelfID, currentDate, event.Time, event.Time); err != nil {
-		return fmt.Errorf("error updating daily command stats: %v", err)
-	}
-
-	// 更新 群发信息条数 每日
-	updateMessagesSQL := `
-	INSERT INTO daily_group_stats (group_id, self_id, date, messages_sent)
-	VALUES (?, ?, ?, 1)
-	ON CONFLICT(group_id, date) DO UPDATE SET
-		messages_sent = daily_group_stats.messages_sent + 1;
-	`
-	if _, err := tx.Exec(updateMessagesSQL, event.GroupID, event.SelfID, currentDate); err != nil {
-		return fmt.Errorf("error updating messages sent in daily group stats: %v", err)
+	// 入群或成为好友后的第一条消息 完成请求的转化
+	firstMessageSQL := `
+	UPDATE request_events SET first_message_at = ?
+	WHERE self_id = ? AND joined_at IS NOT NULL AND first_message_at IS NULL
+		AND ((request_type = 'group' AND group_id = ?) OR (request_type = 'friend' AND ? = 'private' AND user_id = ?));`
+	if _, err = b.tx.Exec(firstMessageSQL, event.Time, event.SelfID, event.GroupID, event.DetailType, event.UserID); err != nil {
+		return fmt.Errorf("error updating request first message: %v", err)
 	}
 
-	// 更新 群发信息条数 总
+	// 处理指令统计
+	commandName := store.ParseCommandName(event.SelfID, event.RawMessage)
+	b.rememberCommand(event, commandName)
+
+	// 更新 群发信息条数 总 每个机器人的私聊合计为一行 频道按子频道区分
 	updateSQL := `
-	INSERT INTO group_stats (group_id, self_id, total_messages_sent, last_message_timestamp, consecutive_message_days)
-	VALUES (?, ?, 1, ?, 1)
-	ON CONFLICT(group_id) DO UPDATE SET
+	INSERT INTO group_stats (group_id, self_id, message_type, guild_id, channel_id, total_messages_sent, last_message_timestamp, consecutive_message_days)
+	VALUES (?, ?, ?, ?, ?, 1, ?, 1)
+	ON CONFLICT(self_id, group_id, guild_id, channel_id) DO UPDATE SET
 		total_messages_sent = group_stats.total_messages_sent + 1,
 		last_message_timestamp = excluded.last_message_timestamp,
 		consecutive_message_days = CASE
-			WHEN date(group_stats.last_message_timestamp, 'unixepoch') = date(?, 'unixepoch', '-1 day') THEN group_stats.consecutive_message_days + 1
-			WHEN date(group_stats.last_message_timestamp, 'unixepoch') < date(?, 'unixepoch') THEN 1
+			WHEN date(group_stats.last_message_timestamp + ?, 'unixepoch', '+1 day') = ? THEN group_stats.consecutive_message_days + 1
+			WHEN date(group_stats.last_message_timestamp + ?, 'unixepoch') < ? THEN 1
 			ELSE group_stats.consecutive_message_days
 		END;
 	`
-	_, err = tx.Exec(updateSQL, event.GroupID, event.SelfID, event.Time, event.Time, event.Time)
+	_, err = b.tx.Exec(updateSQL, event.GroupID, event.SelfID, scene, event.GuildID, event.ChannelID, event.Time, offset, currentDate, offset, currentDate)
 	if err != nil {
 		log.Printf("Error updating group stats: %v", err)
 		return fmt.Errorf("error updating group stats: %w", err)
 	}
 
-	// 下方分支 每个用户每天仅第一次调用会统计
-	if includedInGroupCount {
-
+	// 群消息按群记录用户统计 用户在该群当天的第一条消息计入群日活
+	// 私聊没有群 仍按用户当天的第一条消息计入
+	firstInGroupToday := includedInGroupCount
+	if event.GroupID != "" {
+		if firstInGroupToday, err = b.updateGroupUserStats(event, currentDate); err != nil {
+			return err
+		}
+	}
+	if firstInGroupToday {
 		// 更新每日群组日活统计
 		updateActiveMembersSQL := `
-		INSERT INTO daily_group_stats (group_id, self_id, date, active_members)
-		VALUES (?, ?, ?, 1)
-		ON CONFLICT(group_id, date) DO UPDATE SET
+		INSERT INTO daily_group_stats (group_id, self_id, message_type, guild_id, channel_id, date, active_members)
+		VALUES (?, ?, ?, ?, ?, ?, 1)
+		ON CONFLICT(self_id, group_id, guild_id, channel_id, date) DO UPDATE SET
 			active_members = daily_group_stats.active_members + 1;
 		`
-		if _, err := tx.Exec(updateActiveMembersSQL, event.GroupID, event.SelfID, currentDate); err != nil {
+		if _, err := b.tx.Exec(updateActiveMembersSQL, event.GroupID, event.SelfID, scene, event.GuildID, event.ChannelID, currentDate); err != nil {
 			return fmt.Errorf("error updating active members in daily group stats: %v", err)
 		}
+	}
+
+	// 下方分支 每个用户每天仅第一次调用会统计
+	if includedInGroupCount {
 
 		// 更新机器人状态表，每接收到一个当日新用户，活跃度（daily_dau）加1
 		updateRobotStatsSQL := `
@@ -227,15 +261,15 @@ func ProcessMessageEvent(db *sql.DB, event structs.MessageEvent, config config.C
 			last_message_time = ?
 		WHERE self_id = ? AND date = ?;`
 
-		if result, err := tx.Exec(updateRobotStatsSQL, event.Time, event.SelfID, currentDate); err != nil {
+		if result, err := b.tx.Exec(updateRobotStatsSQL, event.Time, event.SelfID, currentDate); err != nil {
 			return fmt.Errorf("error updating robot status: %v", err)
 		} else if affected, _ := result.RowsAffected(); affected == 0 {
-			log.Printf("No rows updated for self_id %d on date %s", event.SelfID, currentDate)
+			log.Printf("No rows updated for self_id %s on date %s", event.SelfID, currentDate)
 			// 插入新记录，因为当天没有现有记录
 			insertSQL := `
         INSERT INTO robot_status (self_id, date, online, message_received, message_sent, last_message_time, daily_dau)
         VALUES (?, ?, TRUE, 0, 0, ?, 1)`
-			if _, err = tx.Exec(insertSQL, event.SelfID, currentDate, event.Time); err != nil {
+			if _, err = b.tx.Exec(insertSQL, event.SelfID, currentDate, event.Time); err != nil {
 				return fmt.Errorf("error inserting new robot status: %v", err)
 			}
 		}
@@ -244,36 +278,122 @@ func ProcessMessageEvent(db *sql.DB, event structs.MessageEvent, config config.C
 		updateUserGroupCountSQL := `
 		UPDATE daily_user_stats 
 		SET included_in_group_count = FALSE 
-		WHERE user_id = ? AND date = ?`
-		if _, err := tx.Exec(updateUserGroupCountSQL, event.UserID, currentDate); err != nil {
+		WHERE user_id = ? AND self_id = ? AND date = ?`
+		if _, err := b.tx.Exec(updateUserGroupCountSQL, event.UserID, event.SelfID, currentDate); err != nil {
 			return fmt.Errorf("error updating user included_in_group_count: %v", err)
 		}
 
 	}
 
+	// 指令和群消息数只做累加 在批次提交前合并写入 不是指令的消息不计入指令统计
+	if commandName != "" {
+		b.countCommand(commandName, event.SelfID, scene, currentDate, event.Time)
+	}
+	b.countMessageKind(commandName, event.GroupID, event.SelfID, currentDate)
+	b.countGroupMessage(event, currentDate)
+	b.countHourly(event, commandName, currentDate)
+	b.countSegments(event, segments, currentDate)
+	b.countFirstSeen(event.SelfID, event.UserID, currentDate)
+
 	return nil
 }
 
-// ProcessMetaEvent updates or inserts the robot status in the database based on MetaEvent data.
-func ProcessMetaEvent(db *sql.DB, event structs.MetaEvent) error {
-	currentDate := time.Now().Format("2006-01-02") // Get current date in YYYY-MM-DD format
+// 场景对应的私聊 群和频道计数
+func sceneCount(scene string) (private, group, guild int) {
+	switch scene {
+	case structs.ScenePrivate:
+		private = 1
+	case structs.SceneGroup:
+		group = 1
+	case structs.SceneGuild:
+		guild = 1
+	}
+	return
+}
+
+// 保存消息的消息段 同一message_id的消息更新时替换原有的消息段
+func (b *batch) storeSegments(messageID int64, selfID string, segments []structs.MessageSegment, date string) error {
+	if _, err := b.tx.Exec("DELETE FROM message_segments WHERE message_id = ?", messageID); err != nil {
+		return fmt.Errorf("error deleting message segments: %v", err)
+	}
+	insertSQL := `
+	INSERT INTO message_segments (message_id, seq, self_id, segment_type, data, message_date)
+	VALUES (?, ?, ?, ?, ?, ?)`
+	for seq, segment := range segments {
+		data, err := json.Marshal(segment.Data)
+		if err != nil {
+			return fmt.Errorf("error encoding message segment: %v", err)
+		}
+		if _, err := b.tx.Exec(insertSQL, messageID, seq, selfID, segment.Type, string(data), date); err != nil {
+			return fmt.Errorf("error inserting message segment: %v", err)
+		}
+	}
+	return nil
+}
+
+// 更新用户在群内的统计 昵称 群名片和身份按群记录 返回是否为该用户当天在该群的第一条消息
+func (b *batch) updateGroupUserStats(event structs.Event, currentDate string) (bool, error) {
+	groupUserSQL := `
+	INSERT INTO group_user_stats (self_id, group_id, user_id, nickname, card, role, total_messages_sent, first_message_timestamp, last_message_timestamp)
+	VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?)
+	ON CONFLICT(self_id, group_id, user_id) DO UPDATE SET
+		nickname = excluded.nickname,
+		card = excluded.card,
+		role = excluded.role,
+		total_messages_sent = group_user_stats.total_messages_sent + 1,
+		last_message_timestamp = excluded.last_message_timestamp;`
+	if _, err := b.tx.Exec(groupUserSQL, event.SelfID, event.GroupID, event.UserID, event.Sender.Nickname, event.Sender.Card, event.Sender.Role, event.Time, event.Time); err != nil {
+		log.Printf("Error updating group user stats: %v", err)
+		return false, fmt.Errorf("error updating group user stats: %w", err)
+	}
+
+	dailyGroupUserSQL := `
+	INSERT INTO daily_group_user_stats (self_id, group_id, user_id, date, messages_sent, last_message_timestamp)
+	VALUES (?, ?, ?, ?, 1, ?)
+	ON CONFLICT(self_id, group_id, user_id, date) DO UPDATE SET
+		messages_sent = daily_group_user_stats.messages_sent + 1,
+		last_message_timestamp = excluded.last_message_timestamp
+	RETURNING messages_sent;`
+	var messagesSent int
+	if err := b.tx.QueryRow(dailyGroupUserSQL, event.SelfID, event.GroupID, event.UserID, currentDate, event.Time).Scan(&messagesSent); err != nil {
+		log.Printf("Error updating daily group user stats: %v", err)
+		return false, fmt.Errorf("error updating daily group user stats: %w", err)
+	}
+	return messagesSent == 1, nil
+}
+
+// processMetaEvent updates or inserts the robot status in the database based on MetaEvent data.
+func (b *batch) processMetaEvent(event structs.Event) error {
+	currentDate := store.EventDate(event) // Get event date in YYYY-MM-DD format
+
+	// v12心跳和status_update不携带收发统计 只保证当日记录存在
+	if event.Status == nil {
+		insertSQL := `
+		INSERT INTO robot_status (self_id, date, online, message_received, message_sent)
+		VALUES (?, ?, TRUE, 0, 0)
+		ON CONFLICT(self_id, date) DO NOTHING;`
+		if _, err := b.tx.Exec(insertSQL, event.SelfID, currentDate); err != nil {
+			log.Printf("Error inserting new robot status: %v", err)
+			return fmt.Errorf("error inserting new robot status: %w", err)
+		}
+		return nil
+	}
 
 	// Use INSERT OR REPLACE to handle the primary key constraint of self_id and date
 	// 尝试Upsert更新现有记录
+	// 在线状态由连接状态决定 这里只更新计数
 	updateSQL := `
 	UPDATE robot_status
 	SET
-		online = ?,
 		message_received = ?,
 		message_sent = ?,
 		last_message_time = ?
 	WHERE self_id = ? AND date = ?;`
 
-	result, err := db.Exec(updateSQL,
-		event.Status.Online,
-		event.Status.Stat.MessageReceived,
-		event.Status.Stat.MessageSent,
-		event.Status.Stat.LastMessageTime,
+	result, err := b.tx.Exec(updateSQL,
+		event.Status.MessageReceived,
+		event.Status.MessageSent,
+		event.Status.LastMessageTime,
 		event.SelfID,
 		currentDate)
 
@@ -292,15 +412,14 @@ func ProcessMetaEvent(db *sql.DB, event structs.MetaEvent) error {
 	if affected == 0 {
 		insertSQL := `
 		INSERT INTO robot_status (self_id, date, online, message_received, message_sent, last_message_time)
-		VALUES (?, ?, ?, ?, ?, ?);`
+		VALUES (?, ?, TRUE, ?, ?, ?);`
 
-		_, err = db.Exec(insertSQL,
+		_, err = b.tx.Exec(insertSQL,
 			event.SelfID,
 			currentDate,
-			event.Status.Online,
-			event.Status.Stat.MessageReceived,
-			event.Status.Stat.MessageSent,
-			event.Status.Stat.LastMessageTime)
+			event.Status.MessageReceived,
+			event.Status.MessageSent,
+			event.Status.LastMessageTime)
 
 		if err != nil {
 			log.Printf("Error inserting new robot status: %v", err)
@@ -315,29 +434,34 @@ func ProcessMetaEvent(db *sql.DB, event structs.MetaEvent) error {
 
 }
 
-// ProcessNoticeEvent 基于事件记录机器人信息
-func ProcessNoticeEvent(db *sql.DB, event structs.NoticeEvent, config config.Config) error {
-	currentDate := time.Now().Format("2006-01-02") // 获取当前日期
+// processNoticeEvent 基于事件记录机器人信息
+func (b *batch) processNoticeEvent(event structs.Event) error {
+	currentDate := store.EventDate(event) // 获取事件日期
+
+	// 记录所有通知 group_decrease的sub_type区分主动退群(leave) 被踢(kick)和机器人被踢(kick_me)
+	if err := b.recordNoticeEvent(event, currentDate); err != nil {
+		return err
+	}
 
-	if event.NoticeType == "group_increase" && event.SubType == "invite" {
+	if event.DetailType == "group_increase" && event.SubType == "invite" {
 		// 当收到邀请通知时增加邀请次数
 		updateSQL := `
         UPDATE robot_status
         SET invites_received = invites_received + 1
         WHERE self_id = ? AND date = ?;`
-		_, err := db.Exec(updateSQL, event.SelfID, currentDate)
+		_, err := b.tx.Exec(updateSQL, event.SelfID, currentDate)
 		if err != nil {
 			log.Printf("Error updating invites received count: %v", err)
 			return fmt.Errorf("error updating invites received count: %w", err)
 		}
 		log.Println("Updated invites received count successfully for SelfID:", event.SelfID)
-	} else if event.NoticeType == "group_decrease" && event.SubType == "kick_me" {
+	} else if event.DetailType == "group_decrease" && event.SubType == "kick_me" {
 		// 当收到被踢通知时增加被踢次数
 		updateSQL := `
         UPDATE robot_status
         SET kicks_received = kicks_received + 1
         WHERE self_id = ? AND date = ?;`
-		_, err := db.Exec(updateSQL, event.SelfID, currentDate)
+		_, err := b.tx.Exec(updateSQL, event.SelfID, currentDate)
 		if err != nil {
 			log.Printf("Error updating kicks received count: %v", err)
 			return fmt.Errorf("error updating kicks received count: %w", err)
@@ -345,5 +469,172 @@ func ProcessNoticeEvent(db *sql.DB, event structs.NoticeEvent, config config.Con
 		log.Println("Updated kicks received count successfully for SelfID:", event.SelfID)
 	}
 
+	// 机器人入群或添加好友后 标记对应的请求已加入
+	if event.DetailType == "group_increase" && event.UserID == event.SelfID {
+		if err := b.markRequestJoined(event, "group", "group_id", event.GroupID); err != nil {
+			return err
+		}
+	} else if event.DetailType == "friend_add" {
+		if err := b.markRequestJoined(event, "friend", "user_id", event.UserID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 写入通知明细并更新每日汇总
+func (b *batch) recordNoticeEvent(event structs.Event, currentDate string) error {
+	insertSQL := `
+	INSERT INTO notice_events (self_id, notice_type, sub_type, group_id, user_id, operator_id, message_id, time, notice_date)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	if _, err := b.tx.Exec(insertSQL, event.SelfID, event.DetailType, event.SubType, event.GroupID, event.UserID, event.OperatorID, event.MessageID, event.Time, currentDate); err != nil {
+		log.Printf("Error inserting notice event: %v", err)
+		return fmt.Errorf("error inserting notice event: %w", err)
+	}
+
+	dailySQL := `
+	INSERT INTO daily_notice_stats (self_id, date, notice_type, sub_type, count, last_notice_timestamp)
+	VALUES (?, ?, ?, ?, 1, ?)
+	ON CONFLICT(self_id, date, notice_type, sub_type) DO UPDATE SET
+		count = daily_notice_stats.count + 1,
+		last_notice_timestamp = excluded.last_notice_timestamp;`
+	if _, err := b.tx.Exec(dailySQL, event.SelfID, currentDate, event.DetailType, event.SubType, event.Time); err != nil {
+		log.Printf("Error updating daily notice stats: %v", err)
+		return fmt.Errorf("error updating daily notice stats: %w", err)
+	}
+
+	return nil
+}
+
+// 将最近一条尚未加入的请求标记为已加入 column为匹配请求使用的列
+func (b *batch) markRequestJoined(event structs.Event, requestType string, column string, id string) error {
+	updateSQL := `
+	UPDATE request_events SET joined_at = ?
+	WHERE id = (
+		SELECT id FROM request_events
+		WHERE self_id = ? AND request_type = ? AND ` + column + ` = ? AND joined_at IS NULL
+		ORDER BY time DESC LIMIT 1);`
+	if _, err := b.tx.Exec(updateSQL, event.Time, event.SelfID, requestType, id); err != nil {
+		log.Printf("Error marking %s request joined: %v", requestType, err)
+		return fmt.Errorf("error marking %s request joined: %w", requestType, err)
+	}
+	return nil
+}
+
+// processRequestEvent 记录好友请求和加群邀请
+func (b *batch) processRequestEvent(event structs.Event) error {
+	currentDate := store.EventDate(event)
+
+	insertSQL := `
+	INSERT INTO request_events (self_id, request_type, sub_type, user_id, group_id, comment, time, request_date)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+	if _, err := b.tx.Exec(insertSQL, event.SelfID, event.DetailType, event.SubType, event.UserID, event.GroupID, event.Comment, event.Time, currentDate); err != nil {
+		log.Printf("Error inserting request event: %v", err)
+		return fmt.Errorf("error inserting request event: %w", err)
+	}
+	return nil
+}
+
+// processSentMessage 记录机器人发出的消息 来源为message_sent事件或中继时捕获的发送action
+func (b *batch) processSentMessage(event structs.Event, config config.Config) error {
+	currentDate := store.EventDate(event)
+	replyTo := event.ReplyID()
+	commandName := b.replyCommandName(event, replyTo)
+
+	if config.StoreMsgs {
+		sentSQL := `
+		INSERT INTO sent_messages (message_id, message_type, time, self_id, raw_message, user_id, group_id, reply_to, command_name, message_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+		if _, err := b.tx.Exec(sentSQL, event.MessageID, event.DetailType, event.Time, event.SelfID, event.RawMessage, event.UserID, event.GroupID, replyTo, commandName, currentDate); err != nil {
+			return fmt.Errorf("error inserting sent message: %v", err)
+		}
+	}
+
+	// 更新每日回复统计
+	replySQL := `
+	INSERT INTO daily_reply_stats (self_id, date, group_id, command_name, replies, last_reply_timestamp)
+	VALUES (?, ?, ?, ?, 1, ?)
+	ON CONFLICT(self_id, date, group_id, command_name) DO UPDATE SET
+		replies = daily_reply_stats.replies + 1,
+		last_reply_timestamp = excluded.last_reply_timestamp;`
+	if _, err := b.tx.Exec(replySQL, event.SelfID, currentDate, event.GroupID, commandName, event.Time); err != nil {
+		return fmt.Errorf("error updating daily reply stats: %v", err)
+	}
+
+	return nil
+}
+
+// RecordActionResult 记录一次action的耗时和结果
+func (s *Store) RecordActionResult(selfID string, action string, latencyMs int64, success bool) error {
+	currentDate := store.Now().Format("2006-01-02")
+	failures := 0
+	if !success {
+		failures = 1
+	}
+
+	upsertSQL := `
+	INSERT INTO daily_action_stats (self_id, date, action, calls, failures, total_latency_ms, max_latency_ms)
+	VALUES (?, ?, ?, 1, ?, ?, ?)
+	ON CONFLICT(self_id, date, action) DO UPDATE SET
+		calls = daily_action_stats.calls + 1,
+		failures = daily_action_stats.failures + excluded.failures,
+		total_latency_ms = daily_action_stats.total_latency_ms + excluded.total_latency_ms,
+		max_latency_ms = MAX(daily_action_stats.max_latency_ms, excluded.max_latency_ms);`
+	if _, err := s.db.Exec(upsertSQL, selfID, currentDate, action, failures, latencyMs, latencyMs); err != nil {
+		log.Printf("Error updating action stats: %v", err)
+		return fmt.Errorf("error updating action stats: %w", err)
+	}
+	return nil
+}
+
+// SetRobotOnline 根据连接状态更新机器人当日的在线状态
+func (s *Store) SetRobotOnline(selfID string, online bool) error {
+	currentDate := store.Now().Format("2006-01-02")
+
+	upsertSQL := `
+	INSERT INTO robot_status (self_id, date, online, message_received, message_sent)
+	VALUES (?, ?, ?, 0, 0)
+	ON CONFLICT(self_id, date) DO UPDATE SET
+		online = excluded.online;`
+	if _, err := s.db.Exec(upsertSQL, selfID, currentDate, online); err != nil {
+		log.Printf("Error updating robot online status: %v", err)
+		return fmt.Errorf("error updating robot online status: %w", err)
+	}
+	return nil
+}
+
+// OpenConnectionSession 记录一次新的连接会话 返回会话id
+func (s *Store) OpenConnectionSession(selfID string, role, remoteIP, implementation, transport string, connectedAt int64) (int64, error) {
+	insertSQL := `
+	INSERT INTO connection_sessions (self_id, role, remote_ip, implementation, transport, connected_at)
+	VALUES (?, ?, ?, ?, ?, ?);`
+	result, err := s.db.Exec(insertSQL, selfID, role, remoteIP, implementation, transport, connectedAt)
+	if err != nil {
+		log.Printf("Error inserting connection session: %v", err)
+		return 0, fmt.Errorf("error inserting connection session: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+// CloseConnectionSession 记录会话的断开时间
+func (s *Store) CloseConnectionSession(sessionID int64, disconnectedAt int64) error {
+	_, err := s.db.Exec("UPDATE connection_sessions SET disconnected_at = ? WHERE session_id = ?", disconnectedAt, sessionID)
+	if err != nil {
+		log.Printf("Error closing connection session: %v", err)
+		return fmt.Errorf("error closing connection session: %w", err)
+	}
+	return nil
+}
+
+// ResetConnectionState 启动时关闭上次运行遗留的会话 并将所有机器人标记为离线
+func (s *Store) ResetConnectionState() error {
+	now := time.Now().Unix()
+	if _, err := s.db.Exec("UPDATE connection_sessions SET disconnected_at = ? WHERE disconnected_at IS NULL", now); err != nil {
+		return fmt.Errorf("error closing stale connection sessions: %w", err)
+	}
+	if _, err := s.db.Exec("UPDATE robot_status SET online = FALSE WHERE online = TRUE"); err != nil {
+		return fmt.Errorf("error resetting robot online status: %w", err)
+	}
 	return nil
 }
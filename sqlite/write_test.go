@@ -0,0 +1,142 @@
+package sqlite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// v12的非数字message_id保存在original_id中 回复按它找到原消息
+func TestStringMessageIDReply(t *testing.T) {
+	db := openTestDB(t)
+	cfg := config.Config{StoreMsgs: true}
+
+	message := testMessage("a1b2-c3", "1", "/help")
+	sent := structs.Event{
+		PostType:   "message_sent",
+		DetailType: "group",
+		Time:       message.Time + 1,
+		SelfID:     "10",
+		MessageID:  "d4e5",
+		GroupID:    "100",
+		RawMessage: "帮助",
+		Message: []interface{}{
+			map[string]interface{}{"type": "reply", "data": map[string]interface{}{"message_id": "a1b2-c3"}},
+			map[string]interface{}{"type": "text", "data": map[string]interface{}{"text": "帮助"}},
+		},
+	}
+	// 同一id的消息再次收到时更新原有的行
+	events := []structs.Event{message, message, sent}
+	if failed, err := processBatch(db, events, cfg, nil); err != nil || failed != 0 {
+		t.Fatalf("processBatch failed %d events: %v", failed, err)
+	}
+
+	var rows int
+	var originalID string
+	if err := db.QueryRow("SELECT COUNT(*), MAX(original_id) FROM messages").Scan(&rows, &originalID); err != nil {
+		t.Fatalf("read messages: %v", err)
+	}
+	if rows != 1 || originalID != "a1b2-c3" {
+		t.Fatalf("messages = %d rows with original_id %q, want 1 row with a1b2-c3", rows, originalID)
+	}
+
+	var commandName string
+	if err := db.QueryRow("SELECT command_name FROM sent_messages WHERE reply_to = ?", "a1b2-c3").Scan(&commandName); err != nil {
+		t.Fatalf("read sent message: %v", err)
+	}
+	if commandName != "/help" {
+		t.Fatalf("reply command = %q, want /help", commandName)
+	}
+
+	hits, err := NewStore(db, cfg).SearchMessages(structs.MessageSearch{Keyword: "help", Limit: 10})
+	if err != nil {
+		t.Fatalf("search messages: %v", err)
+	}
+	if len(hits.Messages) != 1 || hits.Messages[0].MessageID != "a1b2-c3" {
+		t.Fatalf("search hits = %+v, want message a1b2-c3", hits.Messages)
+	}
+}
+
+// 每个机器人的私聊和共同所在的群各自统计 不合并到先写入的机器人
+func TestGroupStatsPerBot(t *testing.T) {
+	db := openTestDB(t)
+	cfg := config.Config{}
+
+	private := func(messageID, selfID string) structs.Event {
+		event := testMessage(messageID, "1", "hello")
+		event.DetailType = "private"
+		event.SelfID = selfID
+		event.GroupID = ""
+		return event
+	}
+	shared := testMessage("4", "1", "hello")
+	shared.SelfID = "20"
+	events := []structs.Event{private("1", "10"), private("2", "20"), private("3", "20"), testMessage("5", "1", "hello"), shared}
+	if failed, err := processBatch(db, events, cfg, nil); err != nil || failed != 0 {
+		t.Fatalf("processBatch failed %d events: %v", failed, err)
+	}
+
+	st := NewStore(db, cfg)
+	for selfID, want := range map[string]int{"10": 1, "20": 2} {
+		groups, err := st.FetchTopGroups(selfID, "private", 10)
+		if err != nil {
+			t.Fatalf("FetchTopGroups(%s): %v", selfID, err)
+		}
+		if len(groups) != 1 || groups[0].SelfID != selfID || groups[0].TotalMessagesSent != want {
+			t.Fatalf("private groups of %s = %+v, want one row with %d messages", selfID, groups, want)
+		}
+		daily, err := st.FetchTopDailyGroups(selfID, "group", store.Now(), 10)
+		if err != nil {
+			t.Fatalf("FetchTopDailyGroups(%s): %v", selfID, err)
+		}
+		if len(daily) != 1 || daily[0].SelfID != selfID || daily[0].MessagesSent != 1 {
+			t.Fatalf("daily groups of %s = %+v, want group 100 with 1 message", selfID, daily)
+		}
+	}
+}
+
+// 闲聊不覆盖会话中的指令 跨批次的回复仍归属到之前的指令 超出回复窗口的指令被清理
+func TestReplyCommandSkipsChat(t *testing.T) {
+	if err := store.SetCommandRules([]config.CommandRule{{Prefixes: []string{"/"}}}); err != nil {
+		t.Fatalf("SetCommandRules: %v", err)
+	}
+	t.Cleanup(func() { store.SetCommandRules(nil) })
+
+	db := openTestDB(t)
+	cfg := config.Config{StoreMsgs: true}
+	recent := newRecentCommands()
+	base := time.Now().Unix()
+	at := func(message structs.Event, offset int64) structs.Event {
+		message.Time = base + offset
+		return message
+	}
+
+	batches := [][]structs.Event{
+		{at(testMessage("1", "1", "/help"), 0), at(testMessage("2", "2", "hello"), 1)},
+		{testReply("s1", "", base+2)},
+	}
+	for _, events := range batches {
+		if failed, err := processBatch(db, events, cfg, recent); err != nil || failed != 0 {
+			t.Fatalf("processBatch failed %d events: %v", failed, err)
+		}
+	}
+	var commandName string
+	if err := db.QueryRow("SELECT command_name FROM sent_messages WHERE message_id = 's1'").Scan(&commandName); err != nil {
+		t.Fatalf("read sent message: %v", err)
+	}
+	if commandName != "help" {
+		t.Fatalf("reply command = %q, want help", commandName)
+	}
+
+	other := at(testMessage("3", "1", "/sign"), store.ReplyWindow+10)
+	other.GroupID = "200"
+	if _, err := processBatch(db, []structs.Event{other}, cfg, recent); err != nil {
+		t.Fatalf("processBatch: %v", err)
+	}
+	if len(recent.commands) != 1 {
+		t.Fatalf("recent commands = %v, want only the latest conversation", recent.commands)
+	}
+}
@@ -0,0 +1,603 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// batch 一个事务内处理的一批事件 只做累加的计数先在内存中合并 提交前一次写入
+type batch struct {
+	tx            *sql.Tx
+	commands      map[commandKey]*commandCount
+	groupMessages map[groupKey]int
+
+	// 按小时的计数 id为用户 群或指令名
+	hourlyUsers    map[hourlyKey]int
+	hourlyGroups   map[hourlyKey]int
+	hourlyCommands map[hourlyKey]int
+	hourlyBots     map[hourlyKey]*hourlyCount
+
+	// 每天每个群每种消息段的计数 私聊的群为空
+	segments map[segmentKey]*structs.SegmentStat
+
+	// 每天每个群指令和闲聊的消息数 私聊的群为空
+	messageKinds map[groupKey]*kindCount
+
+	// 本批次中每个用户最早发言的日期
+	firstSeen map[userKey]string
+
+	// 本批次中每个会话最近的指令 提交后写入recent
+	recentCommands map[string]recentCommandInfo
+	eventCommand   *recentCommand
+	recent         *recentCommands
+}
+
+type recentCommand struct {
+	key  string
+	info recentCommandInfo
+}
+
+type commandKey struct {
+	commandName string
+	selfID      string
+	date        string
+}
+
+type commandCount struct {
+	calls    int
+	lastCall int64
+
+	// 按场景的调用次数
+	privateCalls int
+	groupCalls   int
+	guildCalls   int
+}
+
+// 群消息数按场景和子频道区分 指令与闲聊的计数只按群区分
+type groupKey struct {
+	groupID   string
+	selfID    string
+	date      string
+	scene     string
+	guildID   string
+	channelID string
+}
+
+type userKey struct {
+	selfID string
+	userID string
+}
+
+type hourlyKey struct {
+	selfID string
+	id     string
+	date   string
+	hour   int
+}
+
+type segmentKey struct {
+	selfID      string
+	groupID     string
+	date        string
+	segmentType string
+}
+
+type kindCount struct {
+	commands int
+	chats    int
+}
+
+type hourlyCount struct {
+	messages     int
+	activeUsers  int
+	activeGroups int
+	commands     int
+}
+
+func newBatch(tx *sql.Tx) *batch {
+	return &batch{
+		tx:             tx,
+		commands:       make(map[commandKey]*commandCount),
+		groupMessages:  make(map[groupKey]int),
+		hourlyUsers:    make(map[hourlyKey]int),
+		hourlyGroups:   make(map[hourlyKey]int),
+		hourlyCommands: make(map[hourlyKey]int),
+		hourlyBots:     make(map[hourlyKey]*hourlyCount),
+		segments:       make(map[segmentKey]*structs.SegmentStat),
+		messageKinds:   make(map[groupKey]*kindCount),
+		firstSeen:      make(map[userKey]string),
+		recentCommands: make(map[string]recentCommandInfo),
+	}
+}
+
+func (b *batch) countCommand(commandName string, selfID string, scene string, date string, timestamp int64) {
+	key := commandKey{commandName: commandName, selfID: selfID, date: date}
+	count, ok := b.commands[key]
+	if !ok {
+		count = &commandCount{}
+		b.commands[key] = count
+	}
+	count.calls++
+	private, group, guild := sceneCount(scene)
+	count.privateCalls += private
+	count.groupCalls += group
+	count.guildCalls += guild
+	if timestamp > count.lastCall {
+		count.lastCall = timestamp
+	}
+}
+
+// 记录用户最早发言的日期 回放历史数据时日期可能早于已记录的日期
+func (b *batch) countFirstSeen(selfID string, userID string, date string) {
+	key := userKey{selfID: selfID, userID: userID}
+	if first, ok := b.firstSeen[key]; !ok || date < first {
+		b.firstSeen[key] = date
+	}
+}
+
+// 按是否提取到指令名 累加指令或闲聊的消息数
+func (b *batch) countMessageKind(commandName string, groupID string, selfID string, date string) {
+	key := groupKey{groupID: groupID, selfID: selfID, date: date}
+	count, ok := b.messageKinds[key]
+	if !ok {
+		count = &kindCount{}
+		b.messageKinds[key] = count
+	}
+	if commandName != "" {
+		count.commands++
+	} else {
+		count.chats++
+	}
+}
+
+func (b *batch) countGroupMessage(event structs.Event, date string) {
+	b.groupMessages[groupKey{
+		groupID:   event.GroupID,
+		selfID:    event.SelfID,
+		date:      date,
+		scene:     event.Scene(),
+		guildID:   event.GuildID,
+		channelID: event.ChannelID,
+	}]++
+}
+
+// 累加一条消息在所在小时的计数 活跃用户和群数在写入时根据是否为新行计算
+func (b *batch) countHourly(event structs.Event, commandName string, date string) {
+	hour := store.EventHour(event)
+	b.hourlyUsers[hourlyKey{selfID: event.SelfID, id: event.UserID, date: date, hour: hour}]++
+	if event.GroupID != "" {
+		b.hourlyGroups[hourlyKey{selfID: event.SelfID, id: event.GroupID, date: date, hour: hour}]++
+	}
+	count := b.hourlyBot(event.SelfID, date, hour)
+	count.messages++
+	if commandName != "" {
+		b.hourlyCommands[hourlyKey{selfID: event.SelfID, id: commandName, date: date, hour: hour}]++
+		count.commands++
+	}
+}
+
+func (b *batch) hourlyBot(selfID string, date string, hour int) *hourlyCount {
+	key := hourlyKey{selfID: selfID, date: date, hour: hour}
+	count, ok := b.hourlyBots[key]
+	if !ok {
+		count = &hourlyCount{}
+		b.hourlyBots[key] = count
+	}
+	return count
+}
+
+// 累加一条消息中每种消息段的计数
+func (b *batch) countSegments(event structs.Event, segments []structs.MessageSegment, date string) {
+	for segmentType, count := range store.SegmentCounts(event.SelfID, segments) {
+		key := segmentKey{selfID: event.SelfID, groupID: event.GroupID, date: date, segmentType: segmentType}
+		if total, ok := b.segments[key]; ok {
+			total.Add(*count)
+		} else {
+			b.segments[key] = count
+		}
+	}
+}
+
+// 处理一个事件 每个事件使用独立的保存点 失败时只回滚该事件
+func (b *batch) processEvent(event structs.Event, config config.Config) error {
+	if _, err := b.tx.Exec("SAVEPOINT event"); err != nil {
+		return fmt.Errorf("error creating savepoint: %w", err)
+	}
+	b.eventCommand = nil
+
+	var err error
+	switch event.PostType {
+	case "message":
+		err = b.processMessageEvent(event, config)
+	case "message_sent":
+		err = b.processSentMessage(event, config)
+	case "notice":
+		err = b.processNoticeEvent(event)
+	case "request":
+		err = b.processRequestEvent(event)
+	case "meta_event":
+		err = b.processMetaEvent(event)
+	}
+
+	if err != nil {
+		b.tx.Exec("ROLLBACK TO event")
+	} else if b.eventCommand != nil {
+		b.recentCommands[b.eventCommand.key] = b.eventCommand.info
+	}
+	b.tx.Exec("RELEASE event")
+	return err
+}
+
+// 写入内存中合并的计数
+func (b *batch) flushCounters() error {
+	commandTotalSQL := `
+    INSERT INTO command_stats (command_name, self_id, total_calls, last_call_timestamp, private_calls, group_calls, guild_calls)
+    VALUES (?, ?, ?, ?, ?, ?, ?)
+    ON CONFLICT(command_name, self_id) DO UPDATE SET
+        total_calls = command_stats.total_calls + excluded.total_calls,
+        last_call_timestamp = MAX(command_stats.last_call_timestamp, excluded.last_call_timestamp),
+        private_calls = command_stats.private_calls + excluded.private_calls,
+        group_calls = command_stats.group_calls + excluded.group_calls,
+        guild_calls = command_stats.guild_calls + excluded.guild_calls;`
+	commandDailySQL := `
+    INSERT INTO daily_command_stats (command_name, self_id, date, calls, last_call_timestamp, private_calls, group_calls, guild_calls)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    ON CONFLICT(command_name, self_id, date) DO UPDATE SET
+        calls = daily_command_stats.calls + excluded.calls,
+        last_call_timestamp = MAX(daily_command_stats.last_call_timestamp, excluded.last_call_timestamp),
+        private_calls = daily_command_stats.private_calls + excluded.private_calls,
+        group_calls = daily_command_stats.group_calls + excluded.group_calls,
+        guild_calls = daily_command_stats.guild_calls + excluded.guild_calls;`
+	for key, count := range b.commands {
+		if _, err := b.tx.Exec(commandTotalSQL, key.commandName, key.selfID, count.calls, count.lastCall,
+			count.privateCalls, count.groupCalls, count.guildCalls); err != nil {
+			return fmt.Errorf("error updating command total stats: %v", err)
+		}
+		if _, err := b.tx.Exec(commandDailySQL, key.commandName, key.selfID, key.date, count.calls, count.lastCall,
+			count.privateCalls, count.groupCalls, count.guildCalls); err != nil {
+			return fmt.Errorf("error updating daily command stats: %v", err)
+		}
+	}
+
+	// 更新 群发信息条数 每日
+	updateMessagesSQL := `
+	INSERT INTO daily_group_stats (group_id, self_id, message_type, guild_id, channel_id, date, messages_sent)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(self_id, group_id, guild_id, channel_id, date) DO UPDATE SET
+		messages_sent = daily_group_stats.messages_sent + excluded.messages_sent;`
+	for key, messages := range b.groupMessages {
+		if _, err := b.tx.Exec(updateMessagesSQL, key.groupID, key.selfID, key.scene, key.guildID, key.channelID, key.date, messages); err != nil {
+			return fmt.Errorf("error updating messages sent in daily group stats: %v", err)
+		}
+	}
+
+	if err := b.flushHourlyCounters(); err != nil {
+		return err
+	}
+
+	segmentSQL := `
+	INSERT INTO daily_segment_stats (self_id, group_id, date, segment_type, segments, messages, at_self)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(self_id, group_id, date, segment_type) DO UPDATE SET
+		segments = daily_segment_stats.segments + excluded.segments,
+		messages = daily_segment_stats.messages + excluded.messages,
+		at_self = daily_segment_stats.at_self + excluded.at_self;`
+	for key, count := range b.segments {
+		if _, err := b.tx.Exec(segmentSQL, key.selfID, key.groupID, key.date, key.segmentType, count.Segments, count.Messages, count.AtSelf); err != nil {
+			return fmt.Errorf("error updating daily segment stats: %v", err)
+		}
+	}
+
+	messageKindSQL := `
+	INSERT INTO daily_message_kind_stats (self_id, group_id, date, commands, chats)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(self_id, group_id, date) DO UPDATE SET
+		commands = daily_message_kind_stats.commands + excluded.commands,
+		chats = daily_message_kind_stats.chats + excluded.chats;`
+	for key, count := range b.messageKinds {
+		if _, err := b.tx.Exec(messageKindSQL, key.selfID, key.groupID, key.date, count.commands, count.chats); err != nil {
+			return fmt.Errorf("error updating daily message kind stats: %v", err)
+		}
+	}
+
+	firstSeenSQL := `
+	INSERT INTO user_first_seen (self_id, user_id, first_date)
+	VALUES (?, ?, ?)
+	ON CONFLICT(self_id, user_id) DO UPDATE SET
+		first_date = excluded.first_date
+	WHERE excluded.first_date < user_first_seen.first_date;`
+	for key, date := range b.firstSeen {
+		if _, err := b.tx.Exec(firstSeenSQL, key.selfID, key.userID, date); err != nil {
+			return fmt.Errorf("error updating user first seen: %v", err)
+		}
+	}
+	return nil
+}
+
+// 写入按小时的计数 用户和群的行在本批次新建时 计入该小时的活跃用户和活跃群
+func (b *batch) flushHourlyCounters() error {
+	hourlyUserSQL := `
+	INSERT INTO hourly_user_stats (self_id, user_id, date, hour, messages_sent)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(self_id, user_id, date, hour) DO UPDATE SET
+		messages_sent = hourly_user_stats.messages_sent + excluded.messages_sent
+	RETURNING messages_sent;`
+	for key, messages := range b.hourlyUsers {
+		var total int
+		if err := b.tx.QueryRow(hourlyUserSQL, key.selfID, key.id, key.date, key.hour, messages).Scan(&total); err != nil {
+			return fmt.Errorf("error updating hourly user stats: %v", err)
+		}
+		if total == messages {
+			b.hourlyBot(key.selfID, key.date, key.hour).activeUsers++
+		}
+	}
+
+	hourlyGroupSQL := `
+	INSERT INTO hourly_group_stats (self_id, group_id, date, hour, messages_sent)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(self_id, group_id, date, hour) DO UPDATE SET
+		messages_sent = hourly_group_stats.messages_sent + excluded.messages_sent
+	RETURNING messages_sent;`
+	for key, messages := range b.hourlyGroups {
+		var total int
+		if err := b.tx.QueryRow(hourlyGroupSQL, key.selfID, key.id, key.date, key.hour, messages).Scan(&total); err != nil {
+			return fmt.Errorf("error updating hourly group stats: %v", err)
+		}
+		if total == messages {
+			b.hourlyBot(key.selfID, key.date, key.hour).activeGroups++
+		}
+	}
+
+	hourlyCommandSQL := `
+	INSERT INTO hourly_command_stats (self_id, command_name, date, hour, calls)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(self_id, command_name, date, hour) DO UPDATE SET
+		calls = hourly_command_stats.calls + excluded.calls;`
+	for key, calls := range b.hourlyCommands {
+		if _, err := b.tx.Exec(hourlyCommandSQL, key.selfID, key.id, key.date, key.hour, calls); err != nil {
+			return fmt.Errorf("error updating hourly command stats: %v", err)
+		}
+	}
+
+	hourlyBotSQL := `
+	INSERT INTO hourly_bot_stats (self_id, date, hour, messages, active_users, active_groups, commands)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(self_id, date, hour) DO UPDATE SET
+		messages = hourly_bot_stats.messages + excluded.messages,
+		active_users = hourly_bot_stats.active_users + excluded.active_users,
+		active_groups = hourly_bot_stats.active_groups + excluded.active_groups,
+		commands = hourly_bot_stats.commands + excluded.commands;`
+	for key, count := range b.hourlyBots {
+		if _, err := b.tx.Exec(hourlyBotSQL, key.selfID, key.date, key.hour, count.messages, count.activeUsers, count.activeGroups, count.commands); err != nil {
+			return fmt.Errorf("error updating hourly bot stats: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// 在一个事务中处理一批事件 单个事件失败不影响其他事件 返回失败的事件数
+// 返回错误时整批都未写入
+func processBatch(db *sql.DB, events []structs.Event, config config.Config, recent *recentCommands) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return len(events), fmt.Errorf("error starting transaction: %v", err)
+	}
+
+	b := newBatch(tx)
+	b.recent = recent
+	failed := 0
+	for _, event := range events {
+		if err := b.processEvent(event, config); err != nil {
+			log.Printf("Error processing %s event from %s: %v", event.PostType, event.SelfID, err)
+			failed++
+		}
+	}
+
+	if err := b.flushCounters(); err != nil {
+		tx.Rollback()
+		return len(events), err
+	}
+	if err := tx.Commit(); err != nil {
+		return len(events), fmt.Errorf("error committing batch: %v", err)
+	}
+	if recent != nil {
+		recent.apply(b.recentCommands)
+	}
+	return failed, nil
+}
+
+// Writer 异步批量写入事件 事件先进入有界队列 由单独的goroutine每隔一段时间或攒够一批后在一个事务中写入
+type Writer struct {
+	db            *sql.DB
+	config        config.Config
+	queue         chan structs.Event
+	batchSize     int
+	flushInterval time.Duration
+	dropWhenFull  bool
+	recent        *recentCommands
+
+	closeMu sync.RWMutex
+	closed  bool
+	done    chan struct{}
+
+	enqueued    int64
+	dropped     int64
+	blocked     int64
+	failed      int64
+	retries     int64
+	batches     int64
+	lastBatch   int64
+	lastFlushMs int64
+	maxFlushMs  int64
+	maxQueued   int64
+}
+
+// StartWriter 启动异步写入 未启动时事件会同步写入
+func (s *Store) StartWriter() {
+	s.config.FixWriteSettings()
+	s.writer = &Writer{
+		db:            s.db,
+		config:        s.config,
+		queue:         make(chan structs.Event, s.config.WriteQueueSize),
+		batchSize:     s.config.WriteBatchSize,
+		flushInterval: time.Duration(s.config.WriteFlushMs) * time.Millisecond,
+		dropWhenFull:  s.config.WriteDropWhenFull,
+		recent:        newRecentCommands(),
+		done:          make(chan struct{}),
+	}
+	go s.writer.run()
+}
+
+// 停止接收新事件 并等待队列中的事件全部写入
+func (w *Writer) close() {
+	w.closeMu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.closeMu.Unlock()
+	<-w.done
+}
+
+// SubmitEvent 写入一个事件 开启异步写入时进入队列 否则直接写入
+func (s *Store) SubmitEvent(event structs.Event) error {
+	if s.writer == nil {
+		if _, err := processBatch(s.db, []structs.Event{event}, s.config, nil); err != nil {
+			return err
+		}
+		return nil
+	}
+	return s.writer.submit(event)
+}
+
+func (w *Writer) submit(event structs.Event) error {
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+	if w.closed {
+		return fmt.Errorf("writer closed, %s event dropped", event.PostType)
+	}
+
+	select {
+	case w.queue <- event:
+	default:
+		if w.dropWhenFull {
+			atomic.AddInt64(&w.dropped, 1)
+			return fmt.Errorf("write queue full, %s event dropped", event.PostType)
+		}
+		// 队列已满 等待写入goroutine腾出空间 读取连接的速度会随之降低
+		atomic.AddInt64(&w.blocked, 1)
+		w.queue <- event
+	}
+
+	atomic.AddInt64(&w.enqueued, 1)
+	if queued := int64(len(w.queue)); queued > atomic.LoadInt64(&w.maxQueued) {
+		atomic.StoreInt64(&w.maxQueued, queued)
+	}
+	return nil
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	pending := make([]structs.Event, 0, w.batchSize)
+	for {
+		select {
+		case event, ok := <-w.queue:
+			if !ok {
+				w.flush(pending)
+				return
+			}
+			pending = append(pending, event)
+			if len(pending) >= w.batchSize {
+				w.flush(pending)
+				pending = pending[:0]
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				w.flush(pending)
+				pending = pending[:0]
+			}
+		}
+	}
+}
+
+// 整批写入失败时的重试间隔上限
+const maxRetryInterval = 5 * time.Second
+
+// 退出时整批写入仍失败的最多重试次数 超过后放弃该批事件
+const closeRetries = 3
+
+func (w *Writer) flush(events []structs.Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	start := time.Now()
+	// 开始事务 合并写入或提交失败时整批回滚 等待后重试该批 不丢弃事件
+	// 队列在重试期间继续积累 已满时按writeDropWhenFull等待或丢弃
+	failed, err := processBatch(w.db, events, w.config, w.recent)
+	interval := w.flushInterval
+	for attempt := 1; err != nil; attempt++ {
+		if w.isClosed() && attempt > closeRetries {
+			log.Printf("Error writing batch of %d events, giving up: %v", len(events), err)
+			failed = len(events)
+			break
+		}
+		log.Printf("Error writing batch of %d events, retrying in %v: %v", len(events), interval, err)
+		atomic.AddInt64(&w.retries, 1)
+		time.Sleep(interval)
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+		failed, err = processBatch(w.db, events, w.config, w.recent)
+	}
+	elapsed := time.Since(start).Milliseconds()
+
+	atomic.AddInt64(&w.failed, int64(failed))
+	atomic.AddInt64(&w.batches, 1)
+	atomic.StoreInt64(&w.lastBatch, int64(len(events)))
+	atomic.StoreInt64(&w.lastFlushMs, elapsed)
+	if elapsed > atomic.LoadInt64(&w.maxFlushMs) {
+		atomic.StoreInt64(&w.maxFlushMs, elapsed)
+	}
+}
+
+func (w *Writer) isClosed() bool {
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+	return w.closed
+}
+
+// FetchWriterStats 返回写入队列的状态 未开启异步写入时返回nil
+func (s *Store) FetchWriterStats() *structs.WriterStats {
+	w := s.writer
+	if w == nil {
+		return nil
+	}
+	return &structs.WriterStats{
+		QueueLength:   len(w.queue),
+		QueueCapacity: cap(w.queue),
+		MaxQueued:     atomic.LoadInt64(&w.maxQueued),
+		Enqueued:      atomic.LoadInt64(&w.enqueued),
+		Dropped:       atomic.LoadInt64(&w.dropped),
+		Blocked:       atomic.LoadInt64(&w.blocked),
+		Failed:        atomic.LoadInt64(&w.failed),
+		Retries:       atomic.LoadInt64(&w.retries),
+		Batches:       atomic.LoadInt64(&w.batches),
+		LastBatchSize: atomic.LoadInt64(&w.lastBatch),
+		LastFlushMs:   atomic.LoadInt64(&w.lastFlushMs),
+		MaxFlushMs:    atomic.LoadInt64(&w.maxFlushMs),
+	}
+}
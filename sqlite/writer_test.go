@@ -0,0 +1,151 @@
+package sqlite
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// 与main中相同的方式打开一个临时数据库
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", DSN(filepath.Join(t.TempDir(), "test.sqlite")))
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("PRAGMA journal_mode=WAL;"); err != nil {
+		t.Fatalf("set WAL mode: %v", err)
+	}
+	if err := MigrateUp(db, 0); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+	return db
+}
+
+func testMessage(messageID string, userID string, raw string) structs.Event {
+	return structs.Event{
+		PostType:   "message",
+		DetailType: "group",
+		Time:       time.Now().Unix(),
+		SelfID:     "10",
+		MessageID:  messageID,
+		UserID:     userID,
+		GroupID:    "100",
+		RawMessage: raw,
+		Sender:     structs.EventSender{Nickname: "n" + userID},
+	}
+}
+
+// 写入队列的事务未提交时 面板的查询和其他连接的写入不应失败
+func TestDashboardDuringOpenBatch(t *testing.T) {
+	db := openTestDB(t)
+	st := NewStore(db, config.Config{})
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("begin batch: %v", err)
+	}
+	b := newBatch(tx)
+	if err := b.processEvent(testMessage("1", "1", "/help"), config.Config{}); err != nil {
+		t.Fatalf("process event: %v", err)
+	}
+	if err := b.flushCounters(); err != nil {
+		t.Fatalf("flush counters: %v", err)
+	}
+
+	// 读取不等待写锁 只能看到已提交的数据
+	users, err := st.FetchTopUsers("10", "", 10)
+	if err != nil {
+		t.Fatalf("read during open batch: %v", err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("read during open batch saw %d uncommitted users", len(users))
+	}
+	if _, err := st.FetchRobotStatuses(time.Now()); err != nil {
+		t.Fatalf("read robot statuses during open batch: %v", err)
+	}
+
+	// 直接写入等待批次提交后执行
+	committed := make(chan error, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		committed <- tx.Commit()
+	}()
+	if err := st.SetRobotOnline("10", false); err != nil {
+		t.Fatalf("write during open batch: %v", err)
+	}
+	if err := <-committed; err != nil {
+		t.Fatalf("commit batch: %v", err)
+	}
+
+	users, err = st.FetchTopUsers("10", "", 10)
+	if err != nil {
+		t.Fatalf("read after batch: %v", err)
+	}
+	if len(users) != 1 || users[0].TotalMessagesSent != 1 {
+		t.Fatalf("read after batch = %+v, want one user with one message", users)
+	}
+}
+
+// 整批写入因数据库被占用失败时 写入队列重试该批 不丢弃事件
+func TestWriterRetriesFailedBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sqlite")
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=rwc&_busy_timeout=50&_txlock=immediate")
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := MigrateUp(db, 0); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+
+	st := NewStore(db, config.Config{StoreMsgs: true, WriteQueueSize: 10, WriteBatchSize: 1, WriteFlushMs: 20})
+	st.StartWriter()
+
+	// 另一个写事务占用数据库超过忙等待时间
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if err := st.SubmitEvent(testMessage("1", "1", "/help")); err != nil {
+		t.Fatalf("submit event: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	st.Close()
+
+	stats := st.FetchWriterStats()
+	if stats.Retries == 0 || stats.Failed != 0 {
+		t.Fatalf("writer stats = %+v, want retries without failed events", stats)
+	}
+	var messages int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&messages); err != nil {
+		t.Fatalf("count messages: %v", err)
+	}
+	if messages != 1 {
+		t.Fatalf("messages = %d, want 1", messages)
+	}
+}
+
+// 写入队列的参数小于等于0时使用默认值 不会在启动时panic
+func TestWriterInvalidSettings(t *testing.T) {
+	db := openTestDB(t)
+	st := NewStore(db, config.Config{StoreMsgs: true, WriteQueueSize: -1, WriteBatchSize: 0, WriteFlushMs: -500})
+	st.StartWriter()
+	if err := st.SubmitEvent(testMessage("1", "1", "/help")); err != nil {
+		t.Fatalf("submit event: %v", err)
+	}
+	st.Close()
+
+	if stats := st.FetchWriterStats(); stats.QueueCapacity <= 0 || stats.Batches != 1 {
+		t.Fatalf("writer stats = %+v, want a default sized queue with one batch", stats)
+	}
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// RetentionPeriods 计算次日 7日和30日留存需要的天数
+const RetentionPeriods = 30
+
+// DayOffset 从from到to经过的天数 日期格式为2006-01-02
+func DayOffset(from string, to string) int {
+	start, err := time.Parse("2006-01-02", from)
+	if err != nil {
+		return -1
+	}
+	end, err := time.Parse("2006-01-02", to)
+	if err != nil {
+		return -1
+	}
+	return int(end.Sub(start).Hours() / 24)
+}
+
+// NewCohort 第一次发言日期为date的空队列 只包含到today为止已经过去的天数 最多periods天
+func NewCohort(date string, today string, periods int) *structs.Cohort {
+	days := DayOffset(date, today)
+	if days > periods {
+		days = periods
+	}
+	if days < 0 {
+		days = 0
+	}
+	return &structs.Cohort{Date: date, Retained: make([]int, days+1)}
+}
+
+// AddRetained 累加第一次发言后第day天发言的人数 超出队列天数的忽略
+func AddRetained(cohort *structs.Cohort, day int, users int) {
+	if day > 0 && day < len(cohort.Retained) {
+		cohort.Retained[day] += users
+	}
+}
+
+// FinishCohorts 计算每天的留存比例 按日期从新到旧返回
+func FinishCohorts(cohorts map[string]*structs.Cohort) []structs.Cohort {
+	results := make([]structs.Cohort, 0, len(cohorts))
+	for _, cohort := range cohorts {
+		cohort.Retained[0] = cohort.NewUsers
+		cohort.Rates = make([]float64, len(cohort.Retained))
+		for day, users := range cohort.Retained {
+			if cohort.NewUsers > 0 {
+				cohort.Rates[day] = float64(users) / float64(cohort.NewUsers)
+			}
+		}
+		results = append(results, *cohort)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Date > results[j].Date })
+	return results
+}
+
+// CohortRetention 队列的次日 7日和30日留存 队列中没有的天数为nil
+func CohortRetention(cohort structs.Cohort) structs.Retention {
+	retention := structs.Retention{Date: cohort.Date, NewUsers: cohort.NewUsers}
+	day := func(n int) (*int, *float64) {
+		if n >= len(cohort.Retained) {
+			return nil, nil
+		}
+		return &cohort.Retained[n], &cohort.Rates[n]
+	}
+	retention.Day1, retention.Day1Rate = day(1)
+	retention.Day7, retention.Day7Rate = day(7)
+	retention.Day30, retention.Day30Rate = day(30)
+	return retention
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+)
+
+// 编译后的指令提取规则
+type commandRule struct {
+	prefixes    []string
+	patterns    []*regexp.Regexp
+	aliases     map[string]string
+	commands    map[string]bool
+	ignore      map[string]bool
+	keepLeading bool
+}
+
+// 按机器人的规则 空字符串为默认规则 启动时由配置的commandRules设置
+var commandRules = map[string]*commandRule{"": {}}
+
+// 消息开头的@和回复
+var leadingSegmentRegexp = regexp.MustCompile(`^(?:\s*\[CQ:(?:at|reply),[^\]]*\])+\s*`)
+
+// SetCommandRules 编译并设置指令提取规则
+func SetCommandRules(rules []config.CommandRule) error {
+	compiled := map[string]*commandRule{"": {}}
+	for _, rule := range rules {
+		if _, ok := compiled[rule.SelfID]; ok && rule.SelfID != "" {
+			return fmt.Errorf("duplicate command rule for selfId %s", rule.SelfID)
+		}
+		c := &commandRule{
+			prefixes:    rule.Prefixes,
+			aliases:     rule.Aliases,
+			commands:    make(map[string]bool, len(rule.Commands)),
+			ignore:      make(map[string]bool, len(rule.Ignore)),
+			keepLeading: rule.KeepLeading,
+		}
+		for _, pattern := range rule.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid command pattern %s: %w", pattern, err)
+			}
+			c.patterns = append(c.patterns, re)
+		}
+		for _, name := range rule.Commands {
+			c.commands[name] = true
+		}
+		for _, name := range rule.Ignore {
+			c.ignore[name] = true
+		}
+		compiled[rule.SelfID] = c
+	}
+	commandRules = compiled
+	return nil
+}
+
+// ParseCommandName 按机器人的规则从RawMessage中提取指令名 不是指令时返回空字符串
+func ParseCommandName(selfID string, rawMessage string) string {
+	rule := ruleFor(selfID)
+
+	text := rawMessage
+	if !rule.keepLeading {
+		text = leadingSegmentRegexp.ReplaceAllString(text, "")
+	}
+
+	name, matched := "", false
+	for _, re := range rule.patterns {
+		if match := re.FindStringSubmatch(text); match != nil {
+			name, matched = match[0], true
+			if len(match) > 1 {
+				name = match[1]
+			}
+			break
+		}
+	}
+
+	// 没有前缀时 设置了前缀或指令名的规则只认指令名中的词
+	mustKnow := false
+	if !matched {
+		prefix := commandPrefix(text, rule.prefixes)
+		text = text[len(prefix):]
+		name = firstWord(text)
+		mustKnow = prefix == "" && (len(rule.prefixes) > 0 || len(rule.commands) > 0)
+	}
+
+	if canonical, ok := rule.aliases[name]; ok {
+		name = canonical
+	}
+	if rule.ignore[name] || (mustKnow && !rule.commands[name]) {
+		return ""
+	}
+	return name
+}
+
+// IsCommandName 已统计的指令名按当前规则是否仍是指令 用于排除规则修改前计入的闲聊
+// 只有被忽略 或规则只认指令名且不在其中时才不是指令 其余的需要用recompute-commands重新统计
+func IsCommandName(selfID string, name string) bool {
+	rule := ruleFor(selfID)
+	if rule.ignore[name] {
+		return false
+	}
+	if len(rule.commands) > 0 && len(rule.prefixes) == 0 && len(rule.patterns) == 0 {
+		return rule.commands[name]
+	}
+	return true
+}
+
+// 机器人使用的规则 没有单独设置时使用默认规则
+func ruleFor(selfID string) *commandRule {
+	if rule, ok := commandRules[selfID]; ok {
+		return rule
+	}
+	return commandRules[""]
+}
+
+// 文本开头最长的前缀
+func commandPrefix(text string, prefixes []string) string {
+	longest := ""
+	for _, prefix := range prefixes {
+		if len(prefix) > len(longest) && strings.HasPrefix(text, prefix) {
+			longest = prefix
+		}
+	}
+	return longest
+}
+
+// 第一个词 去掉/help@bot中的@bot和紧跟的CQ码
+func firstWord(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return ""
+	}
+	word := fields[0]
+	if index := strings.Index(word, "[CQ:"); index >= 0 {
+		word = word[:index]
+	}
+	if index := strings.Index(word, "@"); index > 0 {
+		word = word[:index]
+	}
+	return word
+}
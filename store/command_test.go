@@ -0,0 +1,178 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+)
+
+func setTestCommandRules(t *testing.T, rules []config.CommandRule) {
+	t.Helper()
+	if err := SetCommandRules(rules); err != nil {
+		t.Fatalf("SetCommandRules: %v", err)
+	}
+	t.Cleanup(func() { SetCommandRules(nil) })
+}
+
+func TestParseCommandName(t *testing.T) {
+	type parseCase struct {
+		selfID string
+		raw    string
+		want   string
+	}
+	tests := []struct {
+		name  string
+		rules []config.CommandRule
+		cases []parseCase
+	}{
+		{
+			// 没有规则时与旧版本一致 第一个词就是指令
+			name:  "no rules",
+			rules: nil,
+			cases: []parseCase{
+				{"10", "hello world", "hello"},
+				{"10", "/help", "/help"},
+				{"10", "", ""},
+				{"10", "[CQ:at,qq=10] 签到", "签到"},
+			},
+		},
+		{
+			name:  "default prefixes",
+			rules: []config.CommandRule{{Prefixes: []string{"/", "#"}}},
+			cases: []parseCase{
+				{"10", "/help", "help"},
+				{"10", "#签到 今天", "签到"},
+				{"10", "help", ""},
+				{"10", "今天天气不错", ""},
+				{"10", "/", ""},
+				{"10", "", ""},
+				{"10", "/help@bot", "help"},
+				{"10", "/help[CQ:image,file=a.png]", "help"},
+				{"10", "[CQ:at,qq=10] /help", "help"},
+				{"10", "[CQ:reply,id=1][CQ:at,qq=10] /help", "help"},
+			},
+		},
+		{
+			name:  "longest prefix",
+			rules: []config.CommandRule{{Prefixes: []string{"/", "//"}}},
+			cases: []parseCase{
+				{"10", "//help", "help"},
+				{"10", "/help", "help"},
+			},
+		},
+		{
+			// 别名在前缀之后转换 指令名和忽略都按转换后的名称比较
+			name: "prefixes with commands aliases and ignore",
+			rules: []config.CommandRule{{
+				Prefixes: []string{"/"},
+				Commands: []string{"签到"},
+				Aliases:  map[string]string{"帮助": "help", "sign": "签到", "p": "ping"},
+				Ignore:   []string{"ping"},
+			}},
+			cases: []parseCase{
+				{"10", "签到", "签到"},
+				{"10", "sign", "签到"},
+				{"10", "/sign", "签到"},
+				{"10", "/帮助", "help"},
+				{"10", "帮助", ""},
+				{"10", "hello", ""},
+				{"10", "/ping", ""},
+				{"10", "/p", ""},
+			},
+		},
+		{
+			// 正则优先于前缀 有捕获组时取第一个捕获组
+			name: "patterns",
+			rules: []config.CommandRule{{
+				Prefixes: []string{"/"},
+				Patterns: []string{`^(?:菜单|menu)$`, `^([a-z]+)!$`},
+			}},
+			cases: []parseCase{
+				{"10", "菜单", "菜单"},
+				{"10", "roll!", "roll"},
+				{"10", "/roll", "roll"},
+				{"10", "roll", ""},
+				{"10", "[CQ:at,qq=10] menu", "menu"},
+			},
+		},
+		{
+			name:  "keep leading segments",
+			rules: []config.CommandRule{{Prefixes: []string{"/"}, KeepLeading: true}},
+			cases: []parseCase{
+				{"10", "/help", "help"},
+				{"10", "[CQ:at,qq=10] /help", ""},
+			},
+		},
+		{
+			// 单独设置的机器人不使用默认规则 只设置指令名时其他消息都是闲聊
+			name: "per bot rules",
+			rules: []config.CommandRule{
+				{Prefixes: []string{"/"}},
+				{SelfID: "20", Commands: []string{"签到"}},
+				{SelfID: "30", Prefixes: []string{"."}},
+			},
+			cases: []parseCase{
+				{"10", "/help", "help"},
+				{"10", ".help", ""},
+				{"20", "签到", "签到"},
+				{"20", "/help", ""},
+				{"20", "help", ""},
+				{"30", ".help", "help"},
+				{"30", "/help", ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestCommandRules(t, tt.rules)
+			for _, c := range tt.cases {
+				if got := ParseCommandName(c.selfID, c.raw); got != c.want {
+					t.Errorf("ParseCommandName(%q, %q) = %q, want %q", c.selfID, c.raw, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestIsCommandName(t *testing.T) {
+	setTestCommandRules(t, []config.CommandRule{
+		{Prefixes: []string{"/"}, Ignore: []string{"ping"}},
+		{SelfID: "20", Commands: []string{"签到"}},
+		{SelfID: "30", Prefixes: []string{"/"}, Commands: []string{"签到"}},
+	})
+	tests := []struct {
+		selfID string
+		name   string
+		want   bool
+	}{
+		{"10", "help", true},
+		{"10", "ping", false},
+		// 只认指令名的规则 不在其中的已统计指令名不再是指令
+		{"20", "签到", true},
+		{"20", "help", false},
+		// 还有前缀时之前带前缀计入的指令名仍是指令
+		{"30", "help", true},
+	}
+	for _, tt := range tests {
+		if got := IsCommandName(tt.selfID, tt.name); got != tt.want {
+			t.Errorf("IsCommandName(%q, %q) = %v, want %v", tt.selfID, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetCommandRulesErrors(t *testing.T) {
+	t.Cleanup(func() { SetCommandRules(nil) })
+	tests := []struct {
+		name  string
+		rules []config.CommandRule
+	}{
+		{"duplicate selfId", []config.CommandRule{{SelfID: "10"}, {SelfID: "10"}}},
+		{"invalid pattern", []config.CommandRule{{Patterns: []string{"("}}}},
+	}
+	for _, tt := range tests {
+		if err := SetCommandRules(tt.rules); err == nil {
+			t.Errorf("SetCommandRules(%s) returned nil error", tt.name)
+		}
+	}
+}
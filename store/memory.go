@@ -0,0 +1,1680 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// Memory 不落盘的内存存储 用于测试和临时部署 重启后数据丢失
+// 与sqlite存储的统计口径一致 指令耗时在查询时根据储存的消息计算
+type Memory struct {
+	mu     sync.Mutex
+	config config.Config
+
+	robots          map[string]*structs.RobotStatus   // self_id date
+	users           map[string]*structs.UserStat      // self_id user_id
+	dailyUsers      map[string]*structs.UserStat      // self_id user_id date
+	groups          map[string]*structs.GroupStat     // self_id group_id guild_id channel_id
+	dailyGroups     map[string]*structs.GroupStat     // self_id group_id guild_id channel_id date
+	groupUsers      map[string]*structs.GroupUserStat // self_id group_id user_id
+	dailyGroupUsers map[string]*structs.GroupUserStat // self_id group_id user_id date
+	commands        map[string]*structs.CommandStat   // self_id command_name
+	dailyCommands   map[string]*structs.CommandStat   // self_id command_name date
+	replies         map[string]*memoryReply           // self_id date group_id command_name
+	actions         map[string]*structs.ActionStat    // self_id date action
+	apiStatuses     map[string]*structs.APIStatus     // api_url date
+	dailyNotices    map[string]*structs.NoticeStat    // self_id date notice_type sub_type
+	hourlyBots      map[string]*memoryHourly          // self_id 空id date hour
+	hourlyUsers     map[string]*memoryHourly          // self_id user_id date hour
+	hourlyGroups    map[string]*memoryHourly          // self_id group_id date hour
+	hourlyCommands  map[string]*memoryHourly          // self_id command_name date hour
+	dailySegments   map[string]*structs.SegmentStat   // self_id group_id date segment_type
+	dailyKinds      map[string]*structs.CommandRatio  // self_id group_id date
+	firstSeen       map[string]string                 // self_id user_id 第一次发言的日期
+
+	sessions       []*structs.ConnectionSession
+	lastSessionID  int64
+	requests       []*memoryRequest
+	notices        []memoryNotice
+	messages       []memoryMessage
+	messageIndex   map[string]int // self_id message_id 对应messages的下标
+	sentMessages   []memoryMessage
+	recentCommands map[string]memoryCommand // 会话 最近一次收到的指令
+	cookies        map[string]int64
+	lastPrune      *structs.PruneResult
+}
+
+type memoryReply struct {
+	selfID      string
+	date        string
+	groupID     string
+	commandName string
+	replies     int
+	lastReplyAt int64
+}
+
+type memoryRequest struct {
+	selfID string
+	date   string
+	structs.RequestRecord
+}
+
+type memoryNotice struct {
+	selfID string
+	date   string
+	structs.NoticeRecord
+}
+
+type memoryMessage struct {
+	selfID      string
+	messageID   string
+	userID      string
+	groupID     string
+	rawMessage  string
+	messageType string
+	segments    []structs.MessageSegment
+	replyTo     string
+	time        int64
+	date        string
+}
+
+// 一个小时的计数 id为用户 群或指令名 机器人的统计id为空
+type memoryHourly struct {
+	selfID string
+	id     string
+	date   string
+	structs.HourlyStat
+}
+
+type memoryCommand struct {
+	commandName string
+	time        int64
+}
+
+var _ Store = (*Memory)(nil)
+
+// NewMemory 创建一个空的内存存储
+func NewMemory(config config.Config) *Memory {
+	return &Memory{
+		config:          config,
+		robots:          make(map[string]*structs.RobotStatus),
+		users:           make(map[string]*structs.UserStat),
+		dailyUsers:      make(map[string]*structs.UserStat),
+		groups:          make(map[string]*structs.GroupStat),
+		dailyGroups:     make(map[string]*structs.GroupStat),
+		groupUsers:      make(map[string]*structs.GroupUserStat),
+		dailyGroupUsers: make(map[string]*structs.GroupUserStat),
+		commands:        make(map[string]*structs.CommandStat),
+		dailyCommands:   make(map[string]*structs.CommandStat),
+		replies:         make(map[string]*memoryReply),
+		actions:         make(map[string]*structs.ActionStat),
+		apiStatuses:     make(map[string]*structs.APIStatus),
+		dailyNotices:    make(map[string]*structs.NoticeStat),
+		hourlyBots:      make(map[string]*memoryHourly),
+		hourlyUsers:     make(map[string]*memoryHourly),
+		hourlyGroups:    make(map[string]*memoryHourly),
+		hourlyCommands:  make(map[string]*memoryHourly),
+		dailySegments:   make(map[string]*structs.SegmentStat),
+		dailyKinds:      make(map[string]*structs.CommandRatio),
+		firstSeen:       make(map[string]string),
+		messageIndex:    make(map[string]int),
+		recentCommands:  make(map[string]memoryCommand),
+		cookies:         make(map[string]int64),
+	}
+}
+
+// 多列组成的map键
+func key(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
+
+// 最近days天的日期范围 与sqlite存储的BETWEEN一致
+func dateRange(days int) (string, string) {
+	now := Now()
+	return now.AddDate(0, 0, -days).Format("2006-01-02"), now.Format("2006-01-02")
+}
+
+func inRange(date string, startDate string, endDate string) bool {
+	return date >= startDate && date <= endDate
+}
+
+// 会话标识 群消息按群 私聊按对方
+func memorySceneKey(event structs.Event) string {
+	if event.GroupID != "" {
+		return key(event.SelfID, "group", event.GroupID)
+	}
+	return key(event.SelfID, "private", event.UserID)
+}
+
+// Close 内存存储没有需要写入的数据
+func (m *Memory) Close() error {
+	return nil
+}
+
+// FetchWriterStats 内存存储同步写入 没有写入队列
+func (m *Memory) FetchWriterStats() *structs.WriterStats {
+	return nil
+}
+
+// SubmitEvent 同步更新内存中的统计
+func (m *Memory) SubmitEvent(event structs.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch event.PostType {
+	case "message":
+		m.processMessageEvent(event)
+	case "message_sent":
+		m.processSentMessage(event)
+	case "notice":
+		m.processNoticeEvent(event)
+	case "request":
+		m.processRequestEvent(event)
+	case "meta_event":
+		m.processMetaEvent(event)
+	}
+	return nil
+}
+
+// 取得机器人当天的状态 不存在时按在线创建
+func (m *Memory) robot(selfID string, date string) *structs.RobotStatus {
+	robot, ok := m.robots[key(selfID, date)]
+	if !ok {
+		robot = &structs.RobotStatus{SelfID: selfID, Date: date, Online: true}
+		m.robots[key(selfID, date)] = robot
+	}
+	return robot
+}
+
+func (m *Memory) processMessageEvent(event structs.Event) {
+	currentDate := EventDate(event)
+	scene := event.Scene()
+
+	// 每日用户统计 昵称和身份只在当天第一条消息时记录
+	dailyUser, ok := m.dailyUsers[key(event.SelfID, event.UserID, currentDate)]
+	if !ok {
+		dailyUser = &structs.UserStat{
+			UserID:               event.UserID,
+			SelfID:               event.SelfID,
+			Nickname:             event.Sender.Nickname,
+			Role:                 event.Sender.Role,
+			IncludedInGroupCount: true,
+			Date:                 currentDate,
+		}
+		m.dailyUsers[key(event.SelfID, event.UserID, currentDate)] = dailyUser
+	}
+	dailyUser.MessagesSent++
+	dailyUser.AddSceneMessage(scene)
+	if first, ok := m.firstSeen[key(event.SelfID, event.UserID)]; !ok || currentDate < first {
+		m.firstSeen[key(event.SelfID, event.UserID)] = currentDate
+	}
+	dailyUser.LastMessageTimestamp = event.Time
+	includedInGroupCount := dailyUser.IncludedInGroupCount
+
+	// 总用户统计
+	user, ok := m.users[key(event.SelfID, event.UserID)]
+	if !ok {
+		user = &structs.UserStat{UserID: event.UserID, SelfID: event.SelfID, ConsecutiveMessageDays: 1}
+		m.users[key(event.SelfID, event.UserID)] = user
+	} else {
+		user.ConsecutiveMessageDays = nextConsecutiveDays(user.LastMessageTimestamp, event.Time, user.ConsecutiveMessageDays)
+	}
+	user.Nickname = event.Sender.Nickname
+	user.Role = event.Sender.Role
+	user.TotalMessagesSent++
+	user.AddSceneMessage(scene)
+	user.LastMessageTimestamp = event.Time
+
+	segments := event.Segments()
+	if m.config.StoreMsgs {
+		message := memoryMessage{
+			selfID:      event.SelfID,
+			messageID:   event.MessageID,
+			userID:      event.UserID,
+			groupID:     event.GroupID,
+			rawMessage:  event.RawMessage,
+			messageType: event.DetailType,
+			segments:    segments,
+			time:        event.Time,
+			date:        currentDate,
+		}
+		// 与sqlite存储一致 同一message_id的消息只保留最新的一条
+		if index, ok := m.messageIndex[key(event.SelfID, event.MessageID)]; ok {
+			m.messages[index] = message
+		} else {
+			if event.MessageID != "" {
+				m.messageIndex[key(event.SelfID, event.MessageID)] = len(m.messages)
+			}
+			m.messages = append(m.messages, message)
+		}
+	}
+
+	// 入群或成为好友后的第一条消息 完成请求的转化
+	for _, request := range m.requests {
+		if request.selfID != event.SelfID || request.JoinedAt == 0 || request.FirstMessageAt != 0 {
+			continue
+		}
+		if (request.RequestType == "group" && request.GroupID == event.GroupID) ||
+			(request.RequestType == "friend" && event.DetailType == "private" && request.UserID == event.UserID) {
+			request.FirstMessageAt = event.Time
+		}
+	}
+
+	// 闲聊不覆盖会话中之前的指令
+	commandName := ParseCommandName(event.SelfID, event.RawMessage)
+	if commandName != "" {
+		m.recentCommands[memorySceneKey(event)] = memoryCommand{commandName: commandName, time: event.Time}
+	}
+
+	// 群累计统计 私聊合计为一行 频道按子频道区分
+	groupKey := key(event.SelfID, event.GroupID, event.GuildID, event.ChannelID)
+	group, ok := m.groups[groupKey]
+	if !ok {
+		group = &structs.GroupStat{
+			GroupID:                event.GroupID,
+			SelfID:                 event.SelfID,
+			MessageType:            scene,
+			GuildID:                event.GuildID,
+			ChannelID:              event.ChannelID,
+			ConsecutiveMessageDays: 1,
+		}
+		m.groups[groupKey] = group
+	} else {
+		group.ConsecutiveMessageDays = nextConsecutiveDays(group.LastMessageTimestamp, event.Time, group.ConsecutiveMessageDays)
+	}
+	group.TotalMessagesSent++
+	group.LastMessageTimestamp = event.Time
+
+	// 群消息按群记录用户统计 用户在该群当天的第一条消息计入群日活
+	firstInGroupToday := includedInGroupCount
+	if event.GroupID != "" {
+		firstInGroupToday = m.updateGroupUserStats(event, currentDate)
+	}
+	dailyGroup, ok := m.dailyGroups[key(groupKey, currentDate)]
+	if !ok {
+		dailyGroup = &structs.GroupStat{
+			GroupID:     event.GroupID,
+			SelfID:      event.SelfID,
+			MessageType: scene,
+			GuildID:     event.GuildID,
+			ChannelID:   event.ChannelID,
+			Date:        currentDate,
+		}
+		m.dailyGroups[key(groupKey, currentDate)] = dailyGroup
+	}
+	dailyGroup.MessagesSent++
+	if firstInGroupToday {
+		dailyGroup.ActiveMembers++
+	}
+
+	// 每个用户每天仅第一条消息计入机器人日活
+	if includedInGroupCount {
+		robot := m.robot(event.SelfID, currentDate)
+		robot.DailyDAU++
+		robot.LastMessageTime = event.Time
+		dailyUser.IncludedInGroupCount = false
+	}
+
+	// 不是指令的消息不计入指令统计
+	if commandName != "" {
+		countCommand(m.commands, key(event.SelfID, commandName), commandName, event)
+		countCommand(m.dailyCommands, key(event.SelfID, commandName, currentDate), commandName, event)
+	}
+	m.countMessageKind(event.SelfID, event.GroupID, currentDate, commandName)
+	m.countHourly(event, commandName, currentDate)
+	for segmentType, count := range SegmentCounts(event.SelfID, segments) {
+		segmentKey := key(event.SelfID, event.GroupID, currentDate, segmentType)
+		if stat, ok := m.dailySegments[segmentKey]; ok {
+			stat.Add(*count)
+		} else {
+			count.Date = currentDate
+			m.dailySegments[segmentKey] = count
+		}
+	}
+}
+
+// 按是否提取到指令名 累加指令或闲聊的消息数
+func (m *Memory) countMessageKind(selfID string, groupID string, date string, commandName string) {
+	kindKey := key(selfID, groupID, date)
+	stat, ok := m.dailyKinds[kindKey]
+	if !ok {
+		stat = &structs.CommandRatio{Date: date, GroupID: groupID}
+		m.dailyKinds[kindKey] = stat
+	}
+	if commandName != "" {
+		stat.Add(structs.CommandRatio{Commands: 1})
+	} else {
+		stat.Add(structs.CommandRatio{Chats: 1})
+	}
+}
+
+// 按小时的计数 用户或群在该小时的第一条消息计入活跃用户或活跃群
+func (m *Memory) countHourly(event structs.Event, commandName string, currentDate string) {
+	hour := EventHour(event)
+	bot := hourlyCounter(m.hourlyBots, event.SelfID, "", currentDate, hour)
+	bot.Messages++
+
+	user := hourlyCounter(m.hourlyUsers, event.SelfID, event.UserID, currentDate, hour)
+	if user.Messages == 0 {
+		bot.ActiveUsers++
+	}
+	user.Messages++
+	if event.GroupID != "" {
+		group := hourlyCounter(m.hourlyGroups, event.SelfID, event.GroupID, currentDate, hour)
+		if group.Messages == 0 {
+			bot.ActiveGroups++
+		}
+		group.Messages++
+	}
+	if commandName != "" {
+		bot.Commands++
+		hourlyCounter(m.hourlyCommands, event.SelfID, commandName, currentDate, hour).Commands++
+	}
+}
+
+func hourlyCounter(counters map[string]*memoryHourly, selfID string, id string, date string, hour int) *memoryHourly {
+	counterKey := key(selfID, id, date, strconv.Itoa(hour))
+	counter, ok := counters[counterKey]
+	if !ok {
+		counter = &memoryHourly{selfID: selfID, id: id, date: date, HourlyStat: structs.HourlyStat{Hour: hour}}
+		counters[counterKey] = counter
+	}
+	return counter
+}
+
+// 累加指令的调用次数
+func countCommand(commands map[string]*structs.CommandStat, commandKey string, commandName string, event structs.Event) {
+	command, ok := commands[commandKey]
+	if !ok {
+		command = &structs.CommandStat{CommandName: commandName, SelfID: event.SelfID}
+		commands[commandKey] = command
+	}
+	command.AddCall(event.Scene())
+	if event.Time > command.LastCallTimestamp {
+		command.LastCallTimestamp = event.Time
+	}
+}
+
+// 连续发言天数 前一天发过言时加一 更早时重新计数 同一天不变
+func nextConsecutiveDays(lastTimestamp int64, timestamp int64, days int) int {
+	lastDate := UnixDate(lastTimestamp)
+	currentDate := UnixDate(timestamp)
+	if time.Unix(lastTimestamp, 0).In(location).AddDate(0, 0, 1).Format("2006-01-02") == currentDate {
+		return days + 1
+	}
+	if lastDate < currentDate {
+		return 1
+	}
+	return days
+}
+
+// 更新用户在群内的统计 返回是否为该用户当天在该群的第一条消息
+func (m *Memory) updateGroupUserStats(event structs.Event, currentDate string) bool {
+	groupUser, ok := m.groupUsers[key(event.SelfID, event.GroupID, event.UserID)]
+	if !ok {
+		groupUser = &structs.GroupUserStat{
+			SelfID:                event.SelfID,
+			GroupID:               event.GroupID,
+			UserID:                event.UserID,
+			FirstMessageTimestamp: event.Time,
+		}
+		m.groupUsers[key(event.SelfID, event.GroupID, event.UserID)] = groupUser
+	}
+	groupUser.Nickname = event.Sender.Nickname
+	groupUser.Card = event.Sender.Card
+	groupUser.Role = event.Sender.Role
+	groupUser.MessagesSent++
+	groupUser.LastMessageTimestamp = event.Time
+
+	dailyGroupUser, ok := m.dailyGroupUsers[key(event.SelfID, event.GroupID, event.UserID, currentDate)]
+	if !ok {
+		dailyGroupUser = &structs.GroupUserStat{SelfID: event.SelfID, GroupID: event.GroupID, UserID: event.UserID, Date: currentDate}
+		m.dailyGroupUsers[key(event.SelfID, event.GroupID, event.UserID, currentDate)] = dailyGroupUser
+	}
+	dailyGroupUser.MessagesSent++
+	dailyGroupUser.LastMessageTimestamp = event.Time
+	return dailyGroupUser.MessagesSent == 1
+}
+
+func (m *Memory) processMetaEvent(event structs.Event) {
+	robot := m.robot(event.SelfID, EventDate(event))
+
+	// v12心跳和status_update不携带收发统计 只保证当日记录存在
+	if event.Status == nil {
+		return
+	}
+	robot.MessageReceived = event.Status.MessageReceived
+	robot.MessageSent = event.Status.MessageSent
+	robot.LastMessageTime = event.Status.LastMessageTime
+}
+
+func (m *Memory) processNoticeEvent(event structs.Event) {
+	currentDate := EventDate(event)
+
+	m.notices = append(m.notices, memoryNotice{
+		selfID: event.SelfID,
+		date:   currentDate,
+		NoticeRecord: structs.NoticeRecord{
+			NoticeType: event.DetailType,
+			SubType:    event.SubType,
+			GroupID:    event.GroupID,
+			UserID:     event.UserID,
+			OperatorID: event.OperatorID,
+			MessageID:  event.MessageID,
+			Time:       event.Time,
+		},
+	})
+
+	stat, ok := m.dailyNotices[key(event.SelfID, currentDate, event.DetailType, event.SubType)]
+	if !ok {
+		stat = &structs.NoticeStat{Date: currentDate, NoticeType: event.DetailType, SubType: event.SubType}
+		m.dailyNotices[key(event.SelfID, currentDate, event.DetailType, event.SubType)] = stat
+	}
+	stat.Count++
+	stat.LastNoticeTimestamp = event.Time
+
+	// 只更新已存在的当日状态 与sqlite存储一致
+	if robot, ok := m.robots[key(event.SelfID, currentDate)]; ok {
+		if event.DetailType == "group_increase" && event.SubType == "invite" {
+			robot.InvitesReceived++
+		} else if event.DetailType == "group_decrease" && event.SubType == "kick_me" {
+			robot.KicksReceived++
+		}
+	}
+
+	// 机器人入群或添加好友后 将最近一条尚未加入的请求标记为已加入
+	var joined *memoryRequest
+	for _, request := range m.requests {
+		if request.selfID != event.SelfID || request.JoinedAt != 0 {
+			continue
+		}
+		matched := (event.DetailType == "group_increase" && event.UserID == event.SelfID && request.RequestType == "group" && request.GroupID == event.GroupID) ||
+			(event.DetailType == "friend_add" && request.RequestType == "friend" && request.UserID == event.UserID)
+		if matched && (joined == nil || request.Time >= joined.Time) {
+			joined = request
+		}
+	}
+	if joined != nil {
+		joined.JoinedAt = event.Time
+	}
+}
+
+func (m *Memory) processRequestEvent(event structs.Event) {
+	m.requests = append(m.requests, &memoryRequest{
+		selfID: event.SelfID,
+		date:   EventDate(event),
+		RequestRecord: structs.RequestRecord{
+			RequestType: event.DetailType,
+			SubType:     event.SubType,
+			UserID:      event.UserID,
+			GroupID:     event.GroupID,
+			Comment:     event.Comment,
+			Time:        event.Time,
+		},
+	})
+}
+
+func (m *Memory) processSentMessage(event structs.Event) {
+	currentDate := EventDate(event)
+	replyTo := event.ReplyID()
+
+	// 优先使用reply段引用的原消息 其次使用同一会话窗口内最近的指令
+	commandName := ""
+	if index, ok := m.messageIndex[key(event.SelfID, replyTo)]; ok && replyTo != "" {
+		commandName = ParseCommandName(event.SelfID, m.messages[index].rawMessage)
+	} else if recent, ok := m.recentCommands[memorySceneKey(event)]; ok && event.Time-recent.time <= ReplyWindow {
+		commandName = recent.commandName
+	}
+
+	if m.config.StoreMsgs {
+		m.sentMessages = append(m.sentMessages, memoryMessage{
+			selfID:     event.SelfID,
+			messageID:  event.MessageID,
+			userID:     event.UserID,
+			groupID:    event.GroupID,
+			rawMessage: event.RawMessage,
+			replyTo:    replyTo,
+			time:       event.Time,
+			date:       currentDate,
+		})
+	}
+
+	reply, ok := m.replies[key(event.SelfID, currentDate, event.GroupID, commandName)]
+	if !ok {
+		reply = &memoryReply{selfID: event.SelfID, date: currentDate, groupID: event.GroupID, commandName: commandName}
+		m.replies[key(event.SelfID, currentDate, event.GroupID, commandName)] = reply
+	}
+	reply.replies++
+	reply.lastReplyAt = event.Time
+}
+
+// RecordActionResult 记录一次action的耗时和结果
+func (m *Memory) RecordActionResult(selfID string, action string, latencyMs int64, success bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	currentDate := Now().Format("2006-01-02")
+	stat, ok := m.actions[key(selfID, currentDate, action)]
+	if !ok {
+		stat = &structs.ActionStat{Action: action}
+		m.actions[key(selfID, currentDate, action)] = stat
+	}
+	stat.Calls++
+	if !success {
+		stat.Failures++
+	}
+	stat.TotalLatencyMs += latencyMs
+	if latencyMs > stat.MaxLatencyMs {
+		stat.MaxLatencyMs = latencyMs
+	}
+	return nil
+}
+
+// RecordAPICheck 记录一次api存活检测的结果
+func (m *Memory) RecordAPICheck(apiURL string, date string, success bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status, ok := m.apiStatuses[key(apiURL, date)]
+	if !ok {
+		status = &structs.APIStatus{APIPaths: apiURL, Date: date}
+		m.apiStatuses[key(apiURL, date)] = status
+	}
+	status.Online = success
+	status.ChecksPerformed++
+	if success {
+		status.ResponseTime++
+	} else {
+		status.ChecksFailed++
+	}
+	return nil
+}
+
+// SetRobotOnline 根据连接状态更新机器人当日的在线状态
+func (m *Memory) SetRobotOnline(selfID string, online bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.robot(selfID, Now().Format("2006-01-02")).Online = online
+	return nil
+}
+
+// OpenConnectionSession 记录一次新的连接会话 返回会话id
+func (m *Memory) OpenConnectionSession(selfID string, role, remoteIP, implementation, transport string, connectedAt int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := &structs.ConnectionSession{
+		SessionID:      m.lastSessionID + 1,
+		SelfID:         selfID,
+		Role:           role,
+		RemoteIP:       remoteIP,
+		Implementation: implementation,
+		Transport:      transport,
+		ConnectedAt:    connectedAt,
+		Online:         true,
+	}
+	m.sessions = append(m.sessions, session)
+	m.lastSessionID = session.SessionID
+	return session.SessionID, nil
+}
+
+// CloseConnectionSession 记录会话的断开时间
+func (m *Memory) CloseConnectionSession(sessionID int64, disconnectedAt int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// 会话可能已被清理
+	for _, session := range m.sessions {
+		if session.SessionID == sessionID {
+			session.DisconnectedAt = disconnectedAt
+			session.Online = false
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// ResetConnectionState 关闭遗留的会话 并将所有机器人标记为离线
+func (m *Memory) ResetConnectionState() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+	for _, session := range m.sessions {
+		if session.Online {
+			session.DisconnectedAt = now
+			session.Online = false
+		}
+	}
+	for _, robot := range m.robots {
+		robot.Online = false
+	}
+	return nil
+}
+
+// SaveCookie 保存登录cookie
+func (m *Memory) SaveCookie(cookie string, expiration int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cookies[cookie] = expiration
+	return nil
+}
+
+// FetchCookieExpiration 返回cookie的过期时间 不存在时返回ErrNotFound
+func (m *Memory) FetchCookieExpiration(cookie string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expiration, ok := m.cookies[cookie]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return expiration, nil
+}
+
+// FetchRobotStatuses 返回指定日期所有机器人的状态
+func (m *Memory) FetchRobotStatuses(date time.Time) ([]structs.RobotStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var robots []structs.RobotStatus
+	for _, robot := range m.robots {
+		if robot.Date == date.Format("2006-01-02") {
+			robots = append(robots, *robot)
+		}
+	}
+	sort.Slice(robots, func(i, j int) bool { return robots[i].SelfID < robots[j].SelfID })
+	return robots, nil
+}
+
+// 最近days天机器人的状态 最新的在前
+func (m *Memory) robotHistory(selfID string, days int) []structs.RobotStatus {
+	startDate, endDate := dateRange(days)
+	var robots []structs.RobotStatus
+	for _, robot := range m.robots {
+		if robot.SelfID == selfID && inRange(robot.Date, startDate, endDate) {
+			robots = append(robots, *robot)
+		}
+	}
+	sort.Slice(robots, func(i, j int) bool { return robots[i].Date > robots[j].Date })
+	return robots
+}
+
+// FetchFieldValuesForRobot 返回机器人最近days天某一列的值 列名与robot_status表一致
+func (m *Memory) FetchFieldValuesForRobot(selfID string, days int, fieldType string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var values []string
+	for _, robot := range m.robotHistory(selfID, days) {
+		var value string
+		switch fieldType {
+		case "self_id":
+			value = robot.SelfID
+		case "date":
+			value = robot.Date
+		case "online":
+			value = "0"
+			if robot.Online {
+				value = "1"
+			}
+		case "message_received":
+			value = strconv.Itoa(robot.MessageReceived)
+		case "message_sent":
+			value = strconv.Itoa(robot.MessageSent)
+		case "last_message_time":
+			value = strconv.FormatInt(robot.LastMessageTime, 10)
+		case "invites_received":
+			value = strconv.Itoa(robot.InvitesReceived)
+		case "kicks_received":
+			value = strconv.Itoa(robot.KicksReceived)
+		case "daily_dau":
+			value = strconv.Itoa(robot.DailyDAU)
+		default:
+			return nil, fmt.Errorf("no such column: %s", fieldType)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// FetchAllFieldsForRobot 返回机器人最近days天的状态
+func (m *Memory) FetchAllFieldsForRobot(selfID string, days int) ([]structs.RobotStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.robotHistory(selfID, days), nil
+}
+
+// FetchAPIStatuses 返回一个api最近days天每天的检测结果
+func (m *Memory) FetchAPIStatuses(apiURL string, days int) ([]structs.APIStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	startDate, endDate := dateRange(days)
+	var results []structs.APIStatus
+	for _, status := range m.apiStatuses {
+		if status.APIPaths == apiURL && inRange(status.Date, startDate, endDate) {
+			results = append(results, *status)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Date > results[j].Date })
+	return results, nil
+}
+
+// 按排序取前rank个
+func topN[T any](items []T, rank int, less func(a, b T) bool) []T {
+	sort.SliceStable(items, func(i, j int) bool { return less(items[i], items[j]) })
+	if rank >= 0 && len(items) > rank {
+		items = items[:rank]
+	}
+	return items
+}
+
+// scene不为空时只保留该场景有调用的指令 按该场景的调用次数排序
+func (m *Memory) FetchTopCommands(selfId string, scene string, rank int) ([]structs.CommandStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.CommandStat
+	for _, command := range m.commands {
+		if command.SelfID == selfId && command.SceneCalls(scene) > 0 && IsCommandName(selfId, command.CommandName) {
+			results = append(results, *command)
+		}
+	}
+	return topN(results, rank, func(a, b structs.CommandStat) bool { return a.SceneCalls(scene) > b.SceneCalls(scene) }), nil
+}
+
+func (m *Memory) FetchTopDailyCommands(selfId string, scene string, date time.Time, rank int) ([]structs.CommandStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.CommandStat
+	for k, command := range m.dailyCommands {
+		if command.SelfID == selfId && k == key(selfId, command.CommandName, date.Format("2006-01-02")) &&
+			command.SceneCalls(scene) > 0 && IsCommandName(selfId, command.CommandName) {
+			results = append(results, *command)
+		}
+	}
+	return topN(results, rank, func(a, b structs.CommandStat) bool { return a.SceneCalls(scene) > b.SceneCalls(scene) }), nil
+}
+
+func (m *Memory) FetchTopGroups(selfId string, scene string, rank int) ([]structs.GroupStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.GroupStat
+	for _, group := range m.groups {
+		if group.SelfID == selfId && (scene == "" || group.MessageType == scene) {
+			results = append(results, *group)
+		}
+	}
+	return topN(results, rank, func(a, b structs.GroupStat) bool { return a.TotalMessagesSent > b.TotalMessagesSent }), nil
+}
+
+func (m *Memory) FetchTopDailyGroups(selfId string, scene string, date time.Time, rank int) ([]structs.GroupStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.GroupStat
+	for _, group := range m.dailyGroups {
+		if group.SelfID == selfId && group.Date == date.Format("2006-01-02") && (scene == "" || group.MessageType == scene) {
+			results = append(results, *group)
+		}
+	}
+	return topN(results, rank, func(a, b structs.GroupStat) bool { return a.MessagesSent > b.MessagesSent }), nil
+}
+
+// scene不为空时只保留该场景有消息的用户 按该场景的消息数排序
+func (m *Memory) FetchTopUsers(selfId string, scene string, rank int) ([]structs.UserStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.UserStat
+	for _, user := range m.users {
+		if user.SelfID == selfId && (scene == "" || user.SceneMessages(scene) > 0) {
+			results = append(results, *user)
+		}
+	}
+	if scene != "" {
+		return topN(results, rank, func(a, b structs.UserStat) bool { return a.SceneMessages(scene) > b.SceneMessages(scene) }), nil
+	}
+	return topN(results, rank, func(a, b structs.UserStat) bool { return a.TotalMessagesSent > b.TotalMessagesSent }), nil
+}
+
+func (m *Memory) FetchTopDailyUsers(selfId string, scene string, date time.Time, rank int) ([]structs.UserStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.UserStat
+	for _, user := range m.dailyUsers {
+		if user.SelfID == selfId && user.Date == date.Format("2006-01-02") && (scene == "" || user.SceneMessages(scene) > 0) {
+			results = append(results, *user)
+		}
+	}
+	if scene != "" {
+		return topN(results, rank, func(a, b structs.UserStat) bool { return a.SceneMessages(scene) > b.SceneMessages(scene) }), nil
+	}
+	return topN(results, rank, func(a, b structs.UserStat) bool { return a.MessagesSent > b.MessagesSent }), nil
+}
+
+// FetchGroupTopUsers 返回机器人某个群内累计发言最多的用户
+func (m *Memory) FetchGroupTopUsers(selfId string, groupId string, rank int) ([]structs.GroupUserStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.GroupUserStat
+	for _, groupUser := range m.groupUsers {
+		if groupUser.SelfID == selfId && groupUser.GroupID == groupId {
+			results = append(results, *groupUser)
+		}
+	}
+	return topN(results, rank, func(a, b structs.GroupUserStat) bool { return a.MessagesSent > b.MessagesSent }), nil
+}
+
+// FetchDailyGroupTopUsers 返回机器人某个群内指定日期发言最多的用户
+func (m *Memory) FetchDailyGroupTopUsers(selfId string, groupId string, date time.Time, rank int) ([]structs.GroupUserStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.GroupUserStat
+	for _, daily := range m.dailyGroupUsers {
+		if daily.SelfID != selfId || daily.GroupID != groupId || daily.Date != date.Format("2006-01-02") {
+			continue
+		}
+		stat := *daily
+		if groupUser, ok := m.groupUsers[key(daily.SelfID, daily.GroupID, daily.UserID)]; ok {
+			stat.Nickname = groupUser.Nickname
+			stat.Card = groupUser.Card
+			stat.Role = groupUser.Role
+			stat.FirstMessageTimestamp = groupUser.FirstMessageTimestamp
+		}
+		results = append(results, stat)
+	}
+	return topN(results, rank, func(a, b structs.GroupUserStat) bool { return a.MessagesSent > b.MessagesSent }), nil
+}
+
+// FetchUserGroups 返回用户发过言的群 最近发言的在前 selfId为空时包括所有机器人
+func (m *Memory) FetchUserGroups(selfId string, userId string) ([]structs.GroupUserStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.GroupUserStat
+	for _, groupUser := range m.groupUsers {
+		if groupUser.UserID == userId && (selfId == "" || groupUser.SelfID == selfId) {
+			results = append(results, *groupUser)
+		}
+	}
+	return topN(results, -1, func(a, b structs.GroupUserStat) bool { return a.LastMessageTimestamp > b.LastMessageTimestamp }), nil
+}
+
+// FetchConnectionSessions 返回最近的连接会话 selfId为空时返回所有机器人
+func (m *Memory) FetchConnectionSessions(selfId string, limit int) ([]structs.ConnectionSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.ConnectionSession
+	for _, session := range m.sessions {
+		if selfId == "" || session.SelfID == selfId {
+			results = append(results, *session)
+		}
+	}
+	return topN(results, limit, func(a, b structs.ConnectionSession) bool { return a.ConnectedAt > b.ConnectedAt }), nil
+}
+
+// FetchDailyReplies 返回最近days天每天的指令数 回复数和回复率
+func (m *Memory) FetchDailyReplies(selfId string, days int) ([]structs.ReplyStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	startDate, endDate := dateRange(days)
+	stats := make(map[string]*structs.ReplyStat)
+	for k, command := range m.dailyCommands {
+		if command.SelfID != selfId {
+			continue
+		}
+		date := k[strings.LastIndex(k, "\x00")+1:]
+		if !inRange(date, startDate, endDate) {
+			continue
+		}
+		if stats[date] == nil {
+			stats[date] = &structs.ReplyStat{Date: date}
+		}
+		stats[date].Calls += command.TotalCalls
+	}
+	for _, reply := range m.replies {
+		if stat, ok := stats[reply.date]; ok && reply.selfID == selfId {
+			stat.Replies += reply.replies
+		}
+	}
+
+	var results []structs.ReplyStat
+	for _, stat := range stats {
+		stat.CalculateRate()
+		results = append(results, *stat)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Date > results[j].Date })
+	return results, nil
+}
+
+// FetchDailyCommandReplies 返回指定日期每个指令的调用数和回复数
+func (m *Memory) FetchDailyCommandReplies(selfId string, date time.Time, rank int) ([]structs.ReplyStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	currentDate := date.Format("2006-01-02")
+	var results []structs.ReplyStat
+	for k, command := range m.dailyCommands {
+		if k != key(selfId, command.CommandName, currentDate) {
+			continue
+		}
+		stat := structs.ReplyStat{CommandName: command.CommandName, Calls: command.TotalCalls}
+		for _, reply := range m.replies {
+			if reply.selfID == selfId && reply.date == currentDate && reply.commandName == command.CommandName {
+				stat.Replies += reply.replies
+				if reply.lastReplyAt > stat.LastReplyAt {
+					stat.LastReplyAt = reply.lastReplyAt
+				}
+			}
+		}
+		stat.CalculateRate()
+		results = append(results, stat)
+	}
+	return topN(results, rank, func(a, b structs.ReplyStat) bool { return a.Calls > b.Calls }), nil
+}
+
+// FetchDailyGroupReplies 返回指定日期每个群收到的消息数和回复数
+func (m *Memory) FetchDailyGroupReplies(selfId string, date time.Time, rank int) ([]structs.ReplyStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	currentDate := date.Format("2006-01-02")
+	stats := make(map[string]*structs.ReplyStat)
+	for _, reply := range m.replies {
+		if reply.selfID != selfId || reply.date != currentDate {
+			continue
+		}
+		stat, ok := stats[reply.groupID]
+		if !ok {
+			stat = &structs.ReplyStat{GroupID: reply.groupID}
+			if group, ok := m.dailyGroups[key(selfId, reply.groupID, "", "", currentDate)]; ok {
+				stat.Calls = group.MessagesSent
+			}
+			stats[reply.groupID] = stat
+		}
+		stat.Replies += reply.replies
+		if reply.lastReplyAt > stat.LastReplyAt {
+			stat.LastReplyAt = reply.lastReplyAt
+		}
+	}
+
+	var results []structs.ReplyStat
+	for _, stat := range stats {
+		stat.CalculateRate()
+		results = append(results, *stat)
+	}
+	return topN(results, rank, func(a, b structs.ReplyStat) bool { return a.Replies > b.Replies }), nil
+}
+
+// FetchDailyActionStats 返回指定日期每个action的调用数 失败率和耗时
+func (m *Memory) FetchDailyActionStats(selfId string, date time.Time) ([]structs.ActionStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.ActionStat
+	for k, action := range m.actions {
+		if k != key(selfId, date.Format("2006-01-02"), action.Action) {
+			continue
+		}
+		stat := *action
+		if stat.Calls > 0 {
+			stat.FailureRate = float64(stat.Failures) / float64(stat.Calls)
+			stat.AvgLatencyMs = float64(stat.TotalLatencyMs) / float64(stat.Calls)
+		}
+		results = append(results, stat)
+	}
+	return topN(results, -1, func(a, b structs.ActionStat) bool { return a.Calls > b.Calls }), nil
+}
+
+// FetchDailyCommandLatency 根据储存的消息计算指定日期每个指令的响应耗时分布 单位为秒
+// 回复的对应方式与sqlite存储的汇总一致 每条指令只取机器人的第一条回复 闲聊不会被当作回复的对象
+func (m *Memory) FetchDailyCommandLatency(selfId string, date time.Time, rank int) ([]structs.CommandLatency, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	currentDate := date.Format("2006-01-02")
+	previousDate := date.AddDate(0, 0, -1).Format("2006-01-02")
+	// 前一天的回复只用于标记已回复的指令 不计入当天的耗时
+	var sent []memoryMessage
+	for _, message := range m.sentMessages {
+		if message.selfID == selfId && (message.date == currentDate || message.date == previousDate) {
+			sent = append(sent, message)
+		}
+	}
+	sort.SliceStable(sent, func(i, j int) bool { return sent[i].time < sent[j].time })
+
+	latencies := make(map[string][]int64)
+	answered := make(map[int]bool)
+	for _, reply := range sent {
+		index := m.replyTarget(reply, answered)
+		if index < 0 {
+			continue
+		}
+		answered[index] = true
+		if reply.date != currentDate {
+			continue
+		}
+
+		message := m.messages[index]
+		commandName := ParseCommandName(message.selfID, message.rawMessage)
+		latencies[commandName] = append(latencies[commandName], reply.time-message.time)
+	}
+
+	var results []structs.CommandLatency
+	for commandName, values := range latencies {
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		var total int64
+		for _, value := range values {
+			total += value
+		}
+		results = append(results, structs.CommandLatency{
+			CommandName: commandName,
+			SelfID:      selfId,
+			Date:        currentDate,
+			Samples:     len(values),
+			AvgLatency:  float64(total) / float64(len(values)),
+			P50:         Percentile(values, 50),
+			P90:         Percentile(values, 90),
+			P99:         Percentile(values, 99),
+			MaxLatency:  values[len(values)-1],
+		})
+	}
+	return topN(results, rank, func(a, b structs.CommandLatency) bool { return a.Samples > b.Samples }), nil
+}
+
+// 回复对应的指令消息下标 reply段引用的消息已储存时只对应该消息 引用的是闲聊或已回复的指令时返回-1
+// 否则为同一会话回复窗口内最近一条尚未回复的指令 没有时返回-1
+func (m *Memory) replyTarget(reply memoryMessage, answered map[int]bool) int {
+	isOpenCommand := func(index int) bool {
+		message := m.messages[index]
+		return !answered[index] && ParseCommandName(message.selfID, message.rawMessage) != ""
+	}
+	if reply.replyTo != "" {
+		if index, ok := m.messageIndex[key(reply.selfID, reply.replyTo)]; ok {
+			if !isOpenCommand(index) {
+				return -1
+			}
+			return index
+		}
+	}
+	target := -1
+	for index, message := range m.messages {
+		if message.selfID != reply.selfID || message.time > reply.time || message.time < reply.time-ReplyWindow {
+			continue
+		}
+		if reply.groupID != "" && message.groupID != reply.groupID {
+			continue
+		}
+		if reply.groupID == "" && (message.groupID != "" || message.userID != reply.userID) {
+			continue
+		}
+		if (target < 0 || message.time >= m.messages[target].time) && isOpenCommand(index) {
+			target = index
+		}
+	}
+	return target
+}
+
+// FetchDailyRequestFunnel 返回最近几天每种请求的数量 以及其中已加入和已发言的数量
+func (m *Memory) FetchDailyRequestFunnel(selfId string, days int) ([]structs.RequestFunnel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	startDate, endDate := dateRange(days)
+	funnels := make(map[string]*structs.RequestFunnel)
+	for _, request := range m.requests {
+		if request.selfID != selfId || !inRange(request.date, startDate, endDate) {
+			continue
+		}
+		funnel, ok := funnels[key(request.date, request.RequestType)]
+		if !ok {
+			funnel = &structs.RequestFunnel{Date: request.date, RequestType: request.RequestType}
+			funnels[key(request.date, request.RequestType)] = funnel
+		}
+		funnel.Requests++
+		if request.JoinedAt != 0 {
+			funnel.Joined++
+		}
+		if request.FirstMessageAt != 0 {
+			funnel.FirstMessaged++
+		}
+	}
+
+	var results []structs.RequestFunnel
+	for _, funnel := range funnels {
+		results = append(results, *funnel)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Date != results[j].Date {
+			return results[i].Date > results[j].Date
+		}
+		return results[i].RequestType < results[j].RequestType
+	})
+	return results, nil
+}
+
+// FetchRequestEvents 返回指定日期收到的请求 包括邀请人和群号
+func (m *Memory) FetchRequestEvents(selfId string, date time.Time) ([]structs.RequestRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.RequestRecord
+	for _, request := range m.requests {
+		if request.selfID == selfId && request.date == date.Format("2006-01-02") {
+			results = append(results, request.RequestRecord)
+		}
+	}
+	return topN(results, -1, func(a, b structs.RequestRecord) bool { return a.Time > b.Time }), nil
+}
+
+// FetchDailyNoticeStats 返回最近几天每种通知的数量
+func (m *Memory) FetchDailyNoticeStats(selfId string, days int) ([]structs.NoticeStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	startDate, endDate := dateRange(days)
+	var results []structs.NoticeStat
+	for k, stat := range m.dailyNotices {
+		if k == key(selfId, stat.Date, stat.NoticeType, stat.SubType) && inRange(stat.Date, startDate, endDate) {
+			results = append(results, *stat)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Date != results[j].Date {
+			return results[i].Date > results[j].Date
+		}
+		return results[i].Count > results[j].Count
+	})
+	return results, nil
+}
+
+// FetchDailySegmentStats 返回最近days天每天每种消息段的统计 groupId为空时合计机器人的所有消息
+func (m *Memory) FetchDailySegmentStats(selfId string, groupId string, days int) ([]structs.SegmentStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	startDate, endDate := dateRange(days)
+	totals := make(map[string]*structs.SegmentStat)
+	var results []*structs.SegmentStat
+	for k, stat := range m.dailySegments {
+		parts := strings.Split(k, "\x00")
+		if parts[0] != selfId || (groupId != "" && parts[1] != groupId) || !inRange(stat.Date, startDate, endDate) {
+			continue
+		}
+		total, ok := totals[key(stat.Date, stat.SegmentType)]
+		if !ok {
+			total = &structs.SegmentStat{Date: stat.Date, SegmentType: stat.SegmentType}
+			totals[key(stat.Date, stat.SegmentType)] = total
+			results = append(results, total)
+		}
+		total.Add(*stat)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Date != results[j].Date {
+			return results[i].Date > results[j].Date
+		}
+		return results[i].Segments > results[j].Segments
+	})
+	stats := make([]structs.SegmentStat, 0, len(results))
+	for _, stat := range results {
+		stats = append(stats, *stat)
+	}
+	return stats, nil
+}
+
+// FetchDailyCommandRatio 返回最近days天每天指令与闲聊的消息数 groupId为空时合计机器人的所有消息
+func (m *Memory) FetchDailyCommandRatio(selfId string, groupId string, days int) ([]structs.CommandRatio, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	startDate, endDate := dateRange(days)
+	totals := make(map[string]*structs.CommandRatio)
+	for k, stat := range m.dailyKinds {
+		parts := strings.Split(k, "\x00")
+		if parts[0] != selfId || (groupId != "" && parts[1] != groupId) || !inRange(stat.Date, startDate, endDate) {
+			continue
+		}
+		total, ok := totals[stat.Date]
+		if !ok {
+			total = &structs.CommandRatio{Date: stat.Date, GroupID: groupId}
+			totals[stat.Date] = total
+		}
+		total.Add(*stat)
+	}
+	results := make([]structs.CommandRatio, 0, len(totals))
+	for _, total := range totals {
+		results = append(results, *total)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Date > results[j].Date })
+	return results, nil
+}
+
+// FetchDailyGroupCommandRatio 返回某一天各群指令与闲聊的消息数 按消息数取前rank个群 不含私聊
+func (m *Memory) FetchDailyGroupCommandRatio(selfId string, date time.Time, rank int) ([]structs.CommandRatio, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.CommandRatio
+	for k, stat := range m.dailyKinds {
+		if stat.GroupID != "" && k == key(selfId, stat.GroupID, date.Format("2006-01-02")) {
+			results = append(results, *stat)
+		}
+	}
+	return topN(results, rank, func(a, b structs.CommandRatio) bool { return a.Messages > b.Messages }), nil
+}
+
+// FetchDailyUserActivity 返回最近days天每天的活跃用户数和其中的新用户数 新用户为当天第一次向该机器人发言的用户
+func (m *Memory) FetchDailyUserActivity(selfId string, days int) ([]structs.UserActivity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	startDate, endDate := dateRange(days)
+	totals := make(map[string]*structs.UserActivity)
+	for _, user := range m.dailyUsers {
+		if user.SelfID != selfId || !inRange(user.Date, startDate, endDate) {
+			continue
+		}
+		total, ok := totals[user.Date]
+		if !ok {
+			total = &structs.UserActivity{Date: user.Date}
+			totals[user.Date] = total
+		}
+		total.ActiveUsers++
+		if m.firstSeen[key(selfId, user.UserID)] == user.Date {
+			total.NewUsers++
+		} else {
+			total.ReturningUsers++
+		}
+	}
+	results := make([]structs.UserActivity, 0, len(totals))
+	for _, total := range totals {
+		results = append(results, *total)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Date > results[j].Date })
+	return results, nil
+}
+
+// FetchCohorts 返回最近days天每天的新用户在之后periods天内每天仍发言的人数
+func (m *Memory) FetchCohorts(selfId string, days int, periods int) ([]structs.Cohort, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	startDate, today := dateRange(days)
+	cohorts := make(map[string]*structs.Cohort)
+	for k, date := range m.firstSeen {
+		if strings.Split(k, "\x00")[0] != selfId || !inRange(date, startDate, today) {
+			continue
+		}
+		cohort, ok := cohorts[date]
+		if !ok {
+			cohort = NewCohort(date, today, periods)
+			cohorts[date] = cohort
+		}
+		cohort.NewUsers++
+	}
+	for _, user := range m.dailyUsers {
+		if user.SelfID != selfId {
+			continue
+		}
+		first := m.firstSeen[key(selfId, user.UserID)]
+		if cohort, ok := cohorts[first]; ok {
+			AddRetained(cohort, DayOffset(first, user.Date), 1)
+		}
+	}
+	return FinishCohorts(cohorts), nil
+}
+
+// FetchNoticeTimeline 按时间倒序返回通知 groupId为空时返回机器人的所有通知 before为0时从最新开始
+func (m *Memory) FetchNoticeTimeline(selfId string, groupId string, before int64, limit int) ([]structs.NoticeRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var results []structs.NoticeRecord
+	// 倒序遍历 同一时间的通知后收到的在前
+	for i := len(m.notices) - 1; i >= 0; i-- {
+		notice := m.notices[i]
+		if notice.selfID != selfId || (groupId != "" && notice.GroupID != groupId) || (before > 0 && notice.Time >= before) {
+			continue
+		}
+		results = append(results, notice.NoticeRecord)
+	}
+	return topN(results, limit, func(a, b structs.NoticeRecord) bool { return a.Time > b.Time }), nil
+}
+
+// 日期范围内每小时的统计 groupId或command不为空时使用对应的计数
+func (m *Memory) eachHourly(selfId string, groupId string, command string, startDate string, endDate string, add func(date string, stat structs.HourlyStat)) {
+	counters, id := m.hourlyBots, ""
+	if groupId != "" {
+		counters, id = m.hourlyGroups, groupId
+	} else if command != "" {
+		counters, id = m.hourlyCommands, command
+	}
+	for _, counter := range counters {
+		if counter.selfID == selfId && counter.id == id && inRange(counter.date, startDate, endDate) {
+			add(counter.date, counter.HourlyStat)
+		}
+	}
+}
+
+// FetchHourlyStats 返回loc中某一天24小时的统计 groupId或command不为空时只统计该群的消息或该指令的调用
+func (m *Memory) FetchHourlyStats(selfId string, groupId string, command string, date time.Time, loc *time.Location) ([]structs.HourlyStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	span := DaySpan(date, loc)
+	startDate, endDate := span.DateRange()
+	results := HourlyDay(span.Start)
+	m.eachHourly(selfId, groupId, command, startDate, endDate, func(date string, stat structs.HourlyStat) {
+		if t, ok := span.Locate(date, stat.Hour); ok {
+			results[t.Hour()].Add(stat)
+		}
+	})
+	return results, nil
+}
+
+// FetchWeekHourMatrix 返回loc中最近days天按星期几和小时合计的7x24矩阵 第一维为星期几
+func (m *Memory) FetchWeekHourMatrix(selfId string, groupId string, command string, days int, loc *time.Location) ([][]structs.HourlyStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	span := RecentDaysSpan(days, loc)
+	startDate, endDate := span.DateRange()
+	matrix := WeekHourMatrix()
+	m.eachHourly(selfId, groupId, command, startDate, endDate, func(date string, stat structs.HourlyStat) {
+		if t, ok := span.Locate(date, stat.Hour); ok {
+			matrix[t.Weekday()][t.Hour()].Add(stat)
+		}
+	})
+	return matrix, nil
+}
+
+// RecomputeCommandStats 按当前的指令规则用储存的消息重新统计指令
+// 每个机器人只重新统计最早一条储存的消息之后的日期 累计调用次数减去这些日期原有的次数后加上新的次数
+func (m *Memory) RecomputeCommandStats() (*structs.CommandRecompute, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	start := time.Now()
+	result := &structs.CommandRecompute{Since: make(map[string]string)}
+	for _, message := range m.messages {
+		if since, ok := result.Since[message.selfID]; !ok || message.date < since {
+			result.Since[message.selfID] = message.date
+		}
+	}
+	recomputed := func(selfID string, date string) bool {
+		since, ok := result.Since[selfID]
+		return ok && date >= since
+	}
+
+	// 先去掉这些日期原有的统计
+	for k, daily := range m.dailyCommands {
+		parts := strings.Split(k, "\x00")
+		if !recomputed(daily.SelfID, parts[len(parts)-1]) {
+			continue
+		}
+		if total, ok := m.commands[key(daily.SelfID, daily.CommandName)]; ok {
+			total.TotalCalls -= daily.TotalCalls
+			total.PrivateCalls -= daily.PrivateCalls
+			total.GroupCalls -= daily.GroupCalls
+			total.GuildCalls -= daily.GuildCalls
+		}
+		delete(m.dailyCommands, k)
+	}
+	for k, counter := range m.hourlyCommands {
+		if recomputed(counter.selfID, counter.date) {
+			delete(m.hourlyCommands, k)
+		}
+	}
+	for _, counter := range m.hourlyBots {
+		if recomputed(counter.selfID, counter.date) {
+			counter.Commands = 0
+		}
+	}
+	for k, stat := range m.dailyKinds {
+		if recomputed(strings.Split(k, "\x00")[0], stat.Date) {
+			delete(m.dailyKinds, k)
+		}
+	}
+
+	for _, message := range m.messages {
+		result.Messages++
+		commandName := ParseCommandName(message.selfID, message.rawMessage)
+		m.countMessageKind(message.selfID, message.groupID, message.date, commandName)
+		if commandName == "" {
+			continue
+		}
+		result.Commands++
+		event := structs.Event{SelfID: message.selfID, DetailType: message.messageType, GroupID: message.groupID, Time: message.time}
+		countCommand(m.commands, key(message.selfID, commandName), commandName, event)
+		countCommand(m.dailyCommands, key(message.selfID, commandName, message.date), commandName, event)
+		hour := EventHour(event)
+		hourlyCounter(m.hourlyCommands, message.selfID, commandName, message.date, hour).Commands++
+		hourlyCounter(m.hourlyBots, message.selfID, "", message.date, hour).Commands++
+	}
+
+	for k, total := range m.commands {
+		if total.TotalCalls <= 0 {
+			delete(m.commands, k)
+		}
+	}
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// SearchMessages 逐条匹配储存的消息 按时间从新到旧分页返回
+func (m *Memory) SearchMessages(search structs.MessageSearch) (*structs.MessageSearchResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	terms := SearchTerms(search.Keyword)
+	var hits []structs.MessageHit
+	// 倒序遍历 同一时间的消息后收到的在前
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		message := m.messages[i]
+		if (search.SelfID != "" && message.selfID != search.SelfID) ||
+			(search.GroupID != "" && message.groupID != search.GroupID) ||
+			(search.UserID != "" && message.userID != search.UserID) ||
+			(search.StartDate != "" && message.date < search.StartDate) ||
+			(search.EndDate != "" && message.date > search.EndDate) ||
+			!MatchTerms(message.rawMessage, terms) {
+			continue
+		}
+		hits = append(hits, structs.MessageHit{
+			MessageID:   message.messageID,
+			SelfID:      message.selfID,
+			MessageType: message.messageType,
+			GroupID:     message.groupID,
+			UserID:      message.userID,
+			RawMessage:  message.rawMessage,
+			Snippet:     Snippet(message.rawMessage, terms),
+			Time:        message.time,
+			Date:        message.date,
+		})
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Time > hits[j].Time })
+
+	result := &structs.MessageSearchResult{Total: len(hits), Messages: []structs.MessageHit{}}
+	if search.Offset < len(hits) {
+		end := search.Offset + search.Limit
+		if end > len(hits) {
+			end = len(hits)
+		}
+		result.Messages = hits[search.Offset:end]
+	}
+	return result, nil
+}
+
+// 删除键中第index列的日期早于cutoff的记录
+func pruneByDate[T any](items map[string]T, index int, cutoff string) int64 {
+	var deleted int64
+	for k := range items {
+		parts := strings.SplitN(k, "\x00", index+2)
+		if len(parts) > index && parts[index] < cutoff {
+			delete(items, k)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// 保留满足keep的元素 返回删除的数量
+func pruneSlice[T any](items []T, keep func(T) bool) ([]T, int64) {
+	kept := items[:0]
+	for _, item := range items {
+		if keep(item) {
+			kept = append(kept, item)
+		}
+	}
+	deleted := int64(len(items) - len(kept))
+	// 释放被删除元素的引用
+	var zero T
+	for i := len(kept); i < len(items); i++ {
+		items[i] = zero
+	}
+	return kept, deleted
+}
+
+// Prune 删除超过保留期限的数据和过期的cookie 表名与sqlite存储一致
+func (m *Memory) Prune(policy structs.RetentionPolicy) (*structs.PruneResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	start := time.Now()
+	result := &structs.PruneResult{
+		Time:    start.Unix(),
+		Deleted: make(map[string]int64),
+	}
+	record := func(table string, deleted int64) {
+		if deleted > 0 {
+			result.Deleted[table] = deleted
+		}
+	}
+
+	if cutoff := RetentionCutoff(start, policy.RawDays); cutoff != "" {
+		var deleted int64
+		segments := m.segmentCount()
+		m.messages, deleted = pruneSlice(m.messages, func(message memoryMessage) bool { return message.date >= cutoff })
+		record("messages", deleted)
+		record("message_segments", segments-m.segmentCount())
+		m.messageIndex = make(map[string]int)
+		for index, message := range m.messages {
+			if message.messageID != "" {
+				m.messageIndex[key(message.selfID, message.messageID)] = index
+			}
+		}
+		m.sentMessages, deleted = pruneSlice(m.sentMessages, func(message memoryMessage) bool { return message.date >= cutoff })
+		record("sent_messages", deleted)
+		m.notices, deleted = pruneSlice(m.notices, func(notice memoryNotice) bool { return notice.date >= cutoff })
+		record("notice_events", deleted)
+	}
+
+	if cutoff := RetentionCutoff(start, policy.DailyDays); cutoff != "" {
+		record("robot_status", pruneByDate(m.robots, 1, cutoff))
+		record("api_status", pruneByDate(m.apiStatuses, 1, cutoff))
+		record("daily_user_stats", pruneByDate(m.dailyUsers, 2, cutoff))
+		record("daily_group_stats", pruneByDate(m.dailyGroups, 4, cutoff))
+		record("daily_group_user_stats", pruneByDate(m.dailyGroupUsers, 3, cutoff))
+		record("daily_command_stats", pruneByDate(m.dailyCommands, 2, cutoff))
+		record("daily_reply_stats", pruneByDate(m.replies, 1, cutoff))
+		record("daily_action_stats", pruneByDate(m.actions, 1, cutoff))
+		record("daily_notice_stats", pruneByDate(m.dailyNotices, 1, cutoff))
+		record("hourly_bot_stats", pruneByDate(m.hourlyBots, 2, cutoff))
+		record("hourly_user_stats", pruneByDate(m.hourlyUsers, 2, cutoff))
+		record("hourly_group_stats", pruneByDate(m.hourlyGroups, 2, cutoff))
+		record("hourly_command_stats", pruneByDate(m.hourlyCommands, 2, cutoff))
+		record("daily_segment_stats", pruneByDate(m.dailySegments, 2, cutoff))
+		record("daily_message_kind_stats", pruneByDate(m.dailyKinds, 2, cutoff))
+
+		var deleted int64
+		m.requests, deleted = pruneSlice(m.requests, func(request *memoryRequest) bool { return request.date >= cutoff })
+		record("request_events", deleted)
+		sessionCutoff := start.AddDate(0, 0, -policy.DailyDays).Unix()
+		m.sessions, deleted = pruneSlice(m.sessions, func(session *structs.ConnectionSession) bool {
+			return session.Online || session.ConnectedAt >= sessionCutoff
+		})
+		record("connection_sessions", deleted)
+	}
+
+	var expired int64
+	for cookie, expiration := range m.cookies {
+		if expiration < start.Unix() {
+			delete(m.cookies, cookie)
+			expired++
+		}
+	}
+	record("cookies", expired)
+
+	result.DurationMs = time.Since(start).Milliseconds()
+	m.lastPrune = result
+	return result, nil
+}
+
+// 储存的消息中消息段的总数
+func (m *Memory) segmentCount() int64 {
+	var count int64
+	for _, message := range m.messages {
+		count += int64(len(message.segments))
+	}
+	return count
+}
+
+// FetchStorageStats 返回每个表的行数 表名与sqlite存储一致
+func (m *Memory) FetchStorageStats() (*structs.StorageStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := &structs.StorageStats{
+		Backend: "memory",
+		Tables: []structs.TableSize{
+			{Name: "messages", Class: ClassRaw, Rows: int64(len(m.messages))},
+			{Name: "sent_messages", Class: ClassRaw, Rows: int64(len(m.sentMessages))},
+			{Name: "notice_events", Class: ClassRaw, Rows: int64(len(m.notices))},
+			{Name: "message_segments", Class: ClassRaw, Rows: m.segmentCount()},
+			{Name: "robot_status", Class: ClassDaily, Rows: int64(len(m.robots))},
+			{Name: "api_status", Class: ClassDaily, Rows: int64(len(m.apiStatuses))},
+			{Name: "daily_user_stats", Class: ClassDaily, Rows: int64(len(m.dailyUsers))},
+			{Name: "daily_group_stats", Class: ClassDaily, Rows: int64(len(m.dailyGroups))},
+			{Name: "daily_group_user_stats", Class: ClassDaily, Rows: int64(len(m.dailyGroupUsers))},
+			{Name: "daily_command_stats", Class: ClassDaily, Rows: int64(len(m.dailyCommands))},
+			{Name: "daily_reply_stats", Class: ClassDaily, Rows: int64(len(m.replies))},
+			{Name: "daily_action_stats", Class: ClassDaily, Rows: int64(len(m.actions))},
+			{Name: "daily_notice_stats", Class: ClassDaily, Rows: int64(len(m.dailyNotices))},
+			{Name: "hourly_bot_stats", Class: ClassDaily, Rows: int64(len(m.hourlyBots))},
+			{Name: "hourly_user_stats", Class: ClassDaily, Rows: int64(len(m.hourlyUsers))},
+			{Name: "hourly_group_stats", Class: ClassDaily, Rows: int64(len(m.hourlyGroups))},
+			{Name: "hourly_command_stats", Class: ClassDaily, Rows: int64(len(m.hourlyCommands))},
+			{Name: "daily_segment_stats", Class: ClassDaily, Rows: int64(len(m.dailySegments))},
+			{Name: "daily_message_kind_stats", Class: ClassDaily, Rows: int64(len(m.dailyKinds))},
+			{Name: "request_events", Class: ClassDaily, Rows: int64(len(m.requests))},
+			{Name: "connection_sessions", Class: ClassDaily, Rows: int64(len(m.sessions))},
+			{Name: "cookies", Class: ClassCookie, Rows: int64(len(m.cookies))},
+			{Name: "user_stats", Rows: int64(len(m.users))},
+			{Name: "user_first_seen", Rows: int64(len(m.firstSeen))},
+			{Name: "group_stats", Rows: int64(len(m.groups))},
+			{Name: "group_user_stats", Rows: int64(len(m.groupUsers))},
+			{Name: "command_stats", Rows: int64(len(m.commands))},
+		},
+		LastPrune: m.lastPrune,
+	}
+	sort.SliceStable(stats.Tables, func(i, j int) bool { return stats.Tables[i].Rows > stats.Tables[j].Rows })
+	return stats, nil
+}
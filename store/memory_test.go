@@ -0,0 +1,109 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// 指令和回复之间有闲聊时 回复仍对应到尚未回复的指令 引用闲聊的回复不对应任何指令
+func TestMemoryCommandLatencySkipsChat(t *testing.T) {
+	setTestCommandRules(t, []config.CommandRule{{Prefixes: []string{"/"}}})
+
+	m := NewMemory(config.Config{StoreMsgs: true})
+	date := time.Date(2026, 1, 2, 12, 0, 0, 0, time.Local)
+	base := date.Unix()
+	message := func(messageID, userID, raw string, offset int64) structs.Event {
+		return structs.Event{PostType: "message", DetailType: "group", Time: base + offset, SelfID: "10",
+			MessageID: messageID, UserID: userID, GroupID: "100", RawMessage: raw}
+	}
+	reply := func(messageID, replyTo string, offset int64) structs.Event {
+		event := structs.Event{PostType: "message_sent", DetailType: "group", Time: base + offset, SelfID: "10",
+			MessageID: messageID, GroupID: "100", RawMessage: "ok"}
+		if replyTo != "" {
+			event.Message = []interface{}{
+				map[string]interface{}{"type": "reply", "data": map[string]interface{}{"id": replyTo}},
+			}
+		}
+		return event
+	}
+	for _, event := range []structs.Event{
+		message("1", "1", "/help", 0),
+		message("2", "2", "hello", 5),
+		reply("s1", "", 10),
+		reply("s2", "", 20),
+		message("3", "3", "/sign", 30),
+		message("4", "1", "lol", 31),
+		reply("s3", "4", 32),
+		reply("s4", "3", 33),
+	} {
+		if err := m.SubmitEvent(event); err != nil {
+			t.Fatalf("SubmitEvent: %v", err)
+		}
+	}
+
+	stats, err := m.FetchDailyCommandLatency("10", date, 10)
+	if err != nil {
+		t.Fatalf("FetchDailyCommandLatency: %v", err)
+	}
+	got := make(map[string][2]int64)
+	for _, stat := range stats {
+		got[stat.CommandName] = [2]int64{int64(stat.Samples), stat.MaxLatency}
+	}
+	want := map[string][2]int64{"help": {1, 10}, "sign": {1, 3}}
+	if len(got) != len(want) || got["help"] != want["help"] || got["sign"] != want["sign"] {
+		t.Fatalf("latencies (samples, max) = %v, want %v", got, want)
+	}
+}
+
+// 指令和回复之间的闲聊不覆盖会话中的指令
+func TestMemoryReplyCommandSkipsChat(t *testing.T) {
+	setTestCommandRules(t, []config.CommandRule{{Prefixes: []string{"/"}}})
+
+	m := NewMemory(config.Config{StoreMsgs: true})
+	date := time.Date(2026, 1, 2, 12, 0, 0, 0, time.Local)
+	base := date.Unix()
+	for _, event := range []structs.Event{
+		{PostType: "message", DetailType: "group", Time: base, SelfID: "10", MessageID: "1", UserID: "1", GroupID: "100", RawMessage: "/help"},
+		{PostType: "message", DetailType: "group", Time: base + 1, SelfID: "10", MessageID: "2", UserID: "2", GroupID: "100", RawMessage: "hello"},
+		{PostType: "message_sent", DetailType: "group", Time: base + 2, SelfID: "10", MessageID: "s1", GroupID: "100", RawMessage: "ok"},
+	} {
+		if err := m.SubmitEvent(event); err != nil {
+			t.Fatalf("SubmitEvent: %v", err)
+		}
+	}
+
+	stats, err := m.FetchDailyCommandReplies("10", date, 10)
+	if err != nil {
+		t.Fatalf("FetchDailyCommandReplies: %v", err)
+	}
+	if len(stats) != 1 || stats[0].CommandName != "help" || stats[0].Replies != 1 {
+		t.Fatalf("command replies = %+v, want one reply to help", stats)
+	}
+}
+
+// 前一天零点前已回复的指令 不会再被当天的第一条回复对应
+func TestMemoryCommandLatencyAcrossMidnight(t *testing.T) {
+	m := NewMemory(config.Config{StoreMsgs: true})
+	date := time.Date(2026, 1, 2, 0, 0, 0, 0, time.Local)
+	midnight := date.Unix()
+	for _, event := range []structs.Event{
+		{PostType: "message", DetailType: "group", Time: midnight - 60, SelfID: "10", MessageID: "1", UserID: "1", GroupID: "100", RawMessage: "/help"},
+		{PostType: "message_sent", DetailType: "group", Time: midnight - 50, SelfID: "10", MessageID: "s1", GroupID: "100", RawMessage: "ok"},
+		{PostType: "message_sent", DetailType: "group", Time: midnight + 30, SelfID: "10", MessageID: "s2", GroupID: "100", RawMessage: "ok"},
+	} {
+		if err := m.SubmitEvent(event); err != nil {
+			t.Fatalf("SubmitEvent: %v", err)
+		}
+	}
+
+	today, err := m.FetchDailyCommandLatency("10", date, 10)
+	if err != nil {
+		t.Fatalf("FetchDailyCommandLatency: %v", err)
+	}
+	if len(today) != 0 {
+		t.Fatalf("today latencies = %+v, want none", today)
+	}
+}
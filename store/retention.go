@@ -0,0 +1,62 @@
+package store
+
+import (
+	"log"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// 保留类别
+const (
+	ClassRaw    = "raw"
+	ClassDaily  = "daily"
+	ClassCookie = "cookie"
+)
+
+// PolicyFromConfig 根据配置生成保留策略
+func PolicyFromConfig(cfg config.Config) structs.RetentionPolicy {
+	return structs.RetentionPolicy{
+		RawDays:   cfg.RetainRawDays,
+		DailyDays: cfg.RetainDailyDays,
+	}
+}
+
+// RetentionCutoff 保留days天时 早于该日期的数据会被删除 days小于等于0时返回空
+func RetentionCutoff(now time.Time, days int) string {
+	if days <= 0 {
+		return ""
+	}
+	return now.In(location).AddDate(0, 0, -days).Format("2006-01-02")
+}
+
+// MonitorRetention 定期清理超过保留期限的数据
+func MonitorRetention(st Store, cfg config.Config) {
+	policy := PolicyFromConfig(cfg)
+	interval := time.Duration(cfg.PruneIntervalMin) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			result, err := st.Prune(policy)
+			if err != nil {
+				log.Printf("Error pruning expired data: %v", err)
+			} else {
+				var total int64
+				for _, deleted := range result.Deleted {
+					total += deleted
+				}
+				if total > 0 || result.FreedPages > 0 {
+					log.Printf("Pruned %d expired rows, freed %d pages in %dms", total, result.FreedPages, result.DurationMs)
+				}
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// 搜索结果每页的默认和最大条数
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+)
+
+// 片段在第一个关键词之前保留的字数和片段的总字数
+const (
+	snippetBefore = 20
+	snippetLength = 80
+)
+
+// SearchTerms 将关键词按空白拆分为多个词
+func SearchTerms(keyword string) []string {
+	return strings.Fields(keyword)
+}
+
+// MatchTerms 文本是否包含全部的词 不区分大小写
+func MatchTerms(text string, terms []string) bool {
+	lower := lowerRunes(text)
+	for _, term := range terms {
+		if indexRunes(lower, lowerRunes(term), 0) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Snippet 截取第一个词附近的一段文本 转义html后用<mark>标出所有的词
+func Snippet(text string, terms []string) string {
+	runes := []rune(text)
+	lower := lowerRunes(text)
+
+	// 标出每个词出现的位置
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		needle := lowerRunes(term)
+		if len(needle) == 0 {
+			continue
+		}
+		for i := indexRunes(lower, needle, 0); i >= 0; i = indexRunes(lower, needle, i+len(needle)) {
+			for j := i; j < i+len(needle); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start := 0
+	if first > snippetBefore {
+		start = first - snippetBefore
+	}
+	end := start + snippetLength
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		segment := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			b.WriteString("<mark>" + segment + "</mark>")
+		} else {
+			b.WriteString(segment)
+		}
+		i = j
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// 逐字转为小写 字数与原文一致 便于对应位置
+func lowerRunes(text string) []rune {
+	runes := []rune(text)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+func indexRunes(runes, needle []rune, from int) int {
+	for i := from; i+len(needle) <= len(runes); i++ {
+		match := true
+		for j, r := range needle {
+			if runes[i+j] != r {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// ErrNotFound 查询的记录不存在
+var ErrNotFound = errors.New("record not found")
+
+// Store 统计数据的存储 事件写入和面板的所有查询都通过它进行
+// 默认使用sqlite 也可以使用不落盘的内存存储
+type Store interface {
+	// SubmitEvent 写入一个事件 更新对应的统计
+	SubmitEvent(event structs.Event) error
+	// RecordActionResult 记录一次action的耗时和结果
+	RecordActionResult(selfID string, action string, latencyMs int64, success bool) error
+	// RecordAPICheck 记录一次api存活检测的结果
+	RecordAPICheck(apiURL string, date string, success bool) error
+	// SetRobotOnline 根据连接状态更新机器人当日的在线状态
+	SetRobotOnline(selfID string, online bool) error
+	// OpenConnectionSession 记录一次新的连接会话 返回会话id
+	OpenConnectionSession(selfID string, role, remoteIP, implementation, transport string, connectedAt int64) (int64, error)
+	// CloseConnectionSession 记录会话的断开时间
+	CloseConnectionSession(sessionID int64, disconnectedAt int64) error
+	// ResetConnectionState 关闭上次运行遗留的会话 并将所有机器人标记为离线
+	ResetConnectionState() error
+	// SaveCookie 保存登录cookie
+	SaveCookie(cookie string, expiration int64) error
+
+	FetchCookieExpiration(cookie string) (int64, error)
+	FetchRobotStatuses(date time.Time) ([]structs.RobotStatus, error)
+	FetchFieldValuesForRobot(selfID string, days int, fieldType string) ([]string, error)
+	FetchAllFieldsForRobot(selfID string, days int) ([]structs.RobotStatus, error)
+	FetchAPIStatuses(apiURL string, days int) ([]structs.APIStatus, error)
+	// 排行榜的scene为private group或guild时只统计该场景 按该场景的次数排序 为空时统计全部
+	FetchTopCommands(selfId string, scene string, rank int) ([]structs.CommandStat, error)
+	FetchTopDailyCommands(selfId string, scene string, date time.Time, rank int) ([]structs.CommandStat, error)
+	FetchTopGroups(selfId string, scene string, rank int) ([]structs.GroupStat, error)
+	FetchTopDailyGroups(selfId string, scene string, date time.Time, rank int) ([]structs.GroupStat, error)
+	FetchTopUsers(selfId string, scene string, rank int) ([]structs.UserStat, error)
+	FetchTopDailyUsers(selfId string, scene string, date time.Time, rank int) ([]structs.UserStat, error)
+	FetchGroupTopUsers(selfId string, groupId string, rank int) ([]structs.GroupUserStat, error)
+	FetchDailyGroupTopUsers(selfId string, groupId string, date time.Time, rank int) ([]structs.GroupUserStat, error)
+	FetchUserGroups(selfId string, userId string) ([]structs.GroupUserStat, error)
+	FetchConnectionSessions(selfId string, limit int) ([]structs.ConnectionSession, error)
+	FetchDailyReplies(selfId string, days int) ([]structs.ReplyStat, error)
+	FetchDailyCommandReplies(selfId string, date time.Time, rank int) ([]structs.ReplyStat, error)
+	FetchDailyGroupReplies(selfId string, date time.Time, rank int) ([]structs.ReplyStat, error)
+	FetchDailyActionStats(selfId string, date time.Time) ([]structs.ActionStat, error)
+	FetchDailyCommandLatency(selfId string, date time.Time, rank int) ([]structs.CommandLatency, error)
+	FetchDailyRequestFunnel(selfId string, days int) ([]structs.RequestFunnel, error)
+	FetchRequestEvents(selfId string, date time.Time) ([]structs.RequestRecord, error)
+	FetchDailyNoticeStats(selfId string, days int) ([]structs.NoticeStat, error)
+	FetchNoticeTimeline(selfId string, groupId string, before int64, limit int) ([]structs.NoticeRecord, error)
+	// FetchHourlyStats 返回loc中某一天24小时的统计 groupId或command不为空时只统计该群的消息或该指令的调用
+	// loc为nil时使用统计时区
+	FetchHourlyStats(selfId string, groupId string, command string, date time.Time, loc *time.Location) ([]structs.HourlyStat, error)
+	// FetchWeekHourMatrix 返回loc中最近days天按星期几和小时合计的7x24矩阵 第一维为星期几
+	FetchWeekHourMatrix(selfId string, groupId string, command string, days int, loc *time.Location) ([][]structs.HourlyStat, error)
+	// FetchDailySegmentStats 返回最近days天每天每种消息段的统计 groupId为空时合计机器人的所有消息
+	FetchDailySegmentStats(selfId string, groupId string, days int) ([]structs.SegmentStat, error)
+	// FetchDailyCommandRatio 返回最近days天每天指令与闲聊的消息数 groupId为空时合计机器人的所有消息
+	FetchDailyCommandRatio(selfId string, groupId string, days int) ([]structs.CommandRatio, error)
+	// FetchDailyGroupCommandRatio 返回某一天各群指令与闲聊的消息数 按消息数取前rank个群
+	FetchDailyGroupCommandRatio(selfId string, date time.Time, rank int) ([]structs.CommandRatio, error)
+	// FetchDailyUserActivity 返回最近days天每天的活跃用户数和其中的新用户数 新用户为当天第一次向该机器人发言的用户
+	FetchDailyUserActivity(selfId string, days int) ([]structs.UserActivity, error)
+	// FetchCohorts 返回最近days天每天的新用户在之后periods天内每天仍发言的人数
+	FetchCohorts(selfId string, days int, periods int) ([]structs.Cohort, error)
+	// RecomputeCommandStats 按当前的指令规则用储存的消息重新统计指令和闲聊
+	// 每个机器人只重新统计最早一条储存的消息之后的日期 更早的统计保持不变
+	RecomputeCommandStats() (*structs.CommandRecompute, error)
+	// SearchMessages 搜索储存的消息 按时间从新到旧分页返回
+	SearchMessages(search structs.MessageSearch) (*structs.MessageSearchResult, error)
+	// FetchWriterStats 返回异步写入队列的状态 没有写入队列时返回nil
+	FetchWriterStats() *structs.WriterStats
+	// Prune 删除超过保留期限的数据和过期的cookie
+	Prune(policy structs.RetentionPolicy) (*structs.PruneResult, error)
+	// FetchStorageStats 返回每个表的行数和存储占用
+	FetchStorageStats() (*structs.StorageStats, error)
+
+	// Close 写入尚未写入的数据
+	Close() error
+}
+
+// 回复与指令的对应窗口 超过该时间的回复不再归属于之前的指令
+const ReplyWindow = 120
+
+// EventDate 事件在统计时区中的日期 回放历史数据时以事件自身的时间为准 缺少时间时使用当前日期
+func EventDate(event structs.Event) string {
+	return eventTime(event).Format("2006-01-02")
+}
+
+// EventHour 事件在统计时区中的小时 与EventDate使用同一时间
+func EventHour(event structs.Event) int {
+	return eventTime(event).Hour()
+}
+
+// SegmentCounts 按类型合计一条消息的消息段 每种类型的Messages为1
+func SegmentCounts(selfID string, segments []structs.MessageSegment) map[string]*structs.SegmentStat {
+	counts := make(map[string]*structs.SegmentStat)
+	for _, segment := range segments {
+		count, ok := counts[segment.Type]
+		if !ok {
+			count = &structs.SegmentStat{SegmentType: segment.Type, Messages: 1}
+			counts[segment.Type] = count
+		}
+		count.Segments++
+		if segment.Type == "at" && segment.Data["qq"] == selfID {
+			count.AtSelf++
+		}
+	}
+	return counts
+}
+
+// HourlyDay 一天24小时的空统计
+func HourlyDay(date time.Time) []structs.HourlyStat {
+	stats := make([]structs.HourlyStat, 24)
+	for hour := range stats {
+		stats[hour] = structs.HourlyStat{Weekday: int(date.Weekday()), Hour: hour}
+	}
+	return stats
+}
+
+// WeekHourMatrix 空的7x24矩阵
+func WeekHourMatrix() [][]structs.HourlyStat {
+	matrix := make([][]structs.HourlyStat, 7)
+	for weekday := range matrix {
+		matrix[weekday] = make([]structs.HourlyStat, 24)
+		for hour := range matrix[weekday] {
+			matrix[weekday][hour] = structs.HourlyStat{Weekday: weekday, Hour: hour}
+		}
+	}
+	return matrix
+}
+
+// Percentile 最近秩法计算百分位 values需已排序
+func Percentile(values []int64, p int) int64 {
+	rank := (p*len(values) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return values[rank-1]
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"fmt"
+	"time"
+	_ "time/tzdata" // 容器中可能没有时区数据库 内置一份
+
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
+)
+
+// 统计日期和小时使用的时区 写入和查询都以它划分天 启动时由配置的timezone设置
+var location = time.Local
+
+// SetTimezone 设置统计使用的时区
+func SetTimezone(name string) error {
+	loc, err := LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	location = loc
+	return nil
+}
+
+// LoadLocation 解析时区名称 如Asia/Shanghai UTC 空或Local为系统时区
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %s: %w", name, err)
+	}
+	return loc, nil
+}
+
+// Location 统计使用的时区
+func Location() *time.Location {
+	return location
+}
+
+// Now 统计时区中的当前时间
+func Now() time.Time {
+	return time.Now().In(location)
+}
+
+// UnixDate 时间戳在统计时区中的日期
+func UnixDate(timestamp int64) string {
+	return time.Unix(timestamp, 0).In(location).Format("2006-01-02")
+}
+
+// UTCOffset 时间戳所在时刻统计时区与UTC的偏移秒数 用于在sql中按统计时区计算日期
+func UTCOffset(timestamp int64) int {
+	_, offset := time.Unix(timestamp, 0).In(location).Zone()
+	return offset
+}
+
+// 事件的时间 回放历史数据时以事件自身的时间为准 缺少时间时使用当前时间
+func eventTime(event structs.Event) time.Time {
+	if event.Time <= 0 {
+		return Now()
+	}
+	return time.Unix(event.Time, 0).In(location)
+}
+
+// HourlySpan 查询时区中[Start, End)的时间段 按小时的统计以统计时区记录 查询其他时区时逐小时换算
+type HourlySpan struct {
+	Start time.Time
+	End   time.Time
+}
+
+// DaySpan loc中date所在的一天 loc为nil时使用统计时区
+func DaySpan(date time.Time, loc *time.Location) HourlySpan {
+	if loc == nil {
+		loc = location
+	}
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc)
+	return HourlySpan{Start: start, End: start.AddDate(0, 0, 1)}
+}
+
+// RecentDaysSpan loc中包括今天在内的最近days天 loc为nil时使用统计时区
+func RecentDaysSpan(days int, loc *time.Location) HourlySpan {
+	if loc == nil {
+		loc = location
+	}
+	today := DaySpan(time.Now().In(loc), loc)
+	return HourlySpan{Start: today.Start.AddDate(0, 0, 1-days), End: today.End}
+}
+
+// DateRange 覆盖该时间段需要查询的统计日期范围
+func (span HourlySpan) DateRange() (string, string) {
+	return span.Start.In(location).Format("2006-01-02"), span.End.Add(-time.Second).In(location).Format("2006-01-02")
+}
+
+// Locate 将统计时区中某天某小时换算到查询时区 不在时间段内时返回false
+func (span HourlySpan) Locate(date string, hour int) (time.Time, bool) {
+	day, err := time.ParseInLocation("2006-01-02", date, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+	t := time.Date(day.Year(), day.Month(), day.Day(), hour, 0, 0, 0, location).In(span.Start.Location())
+	if t.Before(span.Start) || !t.Before(span.End) {
+		return time.Time{}, false
+	}
+	return t, true
+}
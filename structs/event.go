@@ -0,0 +1,533 @@
+package structs
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// onebot协议版本
+const (
+	ProtocolV11 = 11
+	ProtocolV12 = 12
+)
+
+// Event 统一的内部事件模型 onebot v11与v12的事件都会被转换为该结构后写入统计表
+// 所有id均使用字符串 以兼容v12和不使用数字id的平台 不存在的id为空字符串
+type Event struct {
+	Protocol       int          `json:"protocol"`
+	PostType       string       `json:"post_type"`   // message/meta_event/notice/request
+	DetailType     string       `json:"detail_type"` // 对应v11的message_type/meta_event_type/notice_type/request_type
+	SubType        string       `json:"sub_type"`
+	Time           int64        `json:"time"`
+	SelfID         string       `json:"self_id"`
+	Platform       string       `json:"platform"`
+	MessageID      string       `json:"message_id"`
+	UserID         string       `json:"user_id"`
+	GroupID        string       `json:"group_id"`
+	GuildID        string       `json:"guild_id"`
+	ChannelID      string       `json:"channel_id"`
+	OperatorID     string       `json:"operator_id"`
+	RawMessage     string       `json:"raw_message"`
+	Comment        string       `json:"comment,omitempty"` // 仅请求事件 验证信息
+	Message        interface{}  `json:"message"`
+	Sender         EventSender  `json:"sender"`
+	Status         *EventStatus `json:"status,omitempty"`         // 仅元事件 v12或缺少统计信息时为nil
+	Implementation string       `json:"implementation,omitempty"` // 仅v12 connect元事件
+}
+
+type EventSender struct {
+	Nickname string `json:"nickname"`
+	Card     string `json:"card"`
+	Role     string `json:"role"`
+}
+
+// EventStatus 心跳中携带的收发统计
+type EventStatus struct {
+	Online          bool  `json:"online"`
+	MessageReceived int   `json:"message_received"`
+	MessageSent     int   `json:"message_sent"`
+	LastMessageTime int64 `json:"last_message_time"`
+}
+
+// V12Event onebot v12 事件 只包含统计需要的字段
+type V12Event struct {
+	ID         string       `json:"id"`
+	Time       float64      `json:"time"`
+	Type       string       `json:"type"`
+	DetailType string       `json:"detail_type"`
+	SubType    string       `json:"sub_type"`
+	Self       V12Self      `json:"self"`
+	MessageID  string       `json:"message_id"`
+	Message    []V12Segment `json:"message"`
+	AltMessage string       `json:"alt_message"`
+	UserID     string       `json:"user_id"`
+	GroupID    string       `json:"group_id"`
+	GuildID    string       `json:"guild_id"`
+	ChannelID  string       `json:"channel_id"`
+	OperatorID string       `json:"operator_id"`
+	Comment    string       `json:"comment"`
+	Version    struct {
+		Impl          string `json:"impl"`
+		Version       string `json:"version"`
+		OneBotVersion string `json:"onebot_version"`
+	} `json:"version"`
+	Status struct {
+		Good bool `json:"good"`
+		Bots []struct {
+			Self   V12Self `json:"self"`
+			Online bool    `json:"online"`
+		} `json:"bots"`
+	} `json:"status"`
+}
+
+type V12Self struct {
+	Platform string `json:"platform"`
+	UserID   string `json:"user_id"`
+}
+
+type V12Segment struct {
+	Type string                 `json:"type"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// v12与v11含义相同的notice类型 统一使用v11的名称
+var v12NoticeTypes = map[string]string{
+	"group_member_increase":  "group_increase",
+	"group_member_decrease":  "group_decrease",
+	"friend_increase":        "friend_add",
+	"group_message_delete":   "group_recall",
+	"private_message_delete": "friend_recall",
+}
+
+// 消息的场景 统计中区分私聊 群和频道
+const (
+	ScenePrivate = "private"
+	SceneGroup   = "group"
+	SceneGuild   = "guild"
+)
+
+// Scenes 所有的场景
+var Scenes = []string{ScenePrivate, SceneGroup, SceneGuild}
+
+// Scene 消息的场景 频道消息有guild_id或channel_id 没有群号的其他消息都按私聊统计
+func (e Event) Scene() string {
+	switch {
+	case e.DetailType == SceneGuild || e.GuildID != "" || e.ChannelID != "":
+		return SceneGuild
+	case e.GroupID != "":
+		return SceneGroup
+	}
+	return ScenePrivate
+}
+
+// 格式化v11的数字id 0代表不存在
+func formatID(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+// Normalize 将v11消息事件转换为内部事件
+// message_sent的私聊消息中user_id是机器人自身 使用target_id作为对方
+func (e MessageEvent) Normalize() Event {
+	userID := e.UserID
+	if e.PostType == "message_sent" && e.TargetID != 0 {
+		userID = e.TargetID
+	}
+	return Event{
+		Protocol:   ProtocolV11,
+		PostType:   e.PostType,
+		DetailType: e.MessageType,
+		SubType:    e.SubType,
+		Time:       e.Time,
+		SelfID:     formatID(e.SelfID),
+		Platform:   "qq",
+		MessageID:  formatID(e.MessageID),
+		UserID:     formatID(userID),
+		GroupID:    formatID(e.GroupID),
+		GuildID:    segmentValue(e.GuildID),
+		ChannelID:  segmentValue(e.ChannelID),
+		RawMessage: e.RawMessage,
+		Message:    e.Message,
+		Sender: EventSender{
+			Nickname: e.Sender.Nickname,
+			Card:     e.Sender.Card,
+			Role:     e.Sender.Role,
+		},
+	}
+}
+
+// Normalize 将v11元事件转换为内部事件
+func (e MetaEvent) Normalize() Event {
+	event := Event{
+		Protocol:   ProtocolV11,
+		PostType:   e.PostType,
+		DetailType: e.MetaEventType,
+		SubType:    e.SubType,
+		Time:       e.Time,
+		SelfID:     formatID(e.SelfID),
+		Platform:   "qq",
+	}
+	if e.MetaEventType == "heartbeat" {
+		event.Status = &EventStatus{
+			Online:          e.Status.Online,
+			MessageReceived: e.Status.Stat.MessageReceived,
+			MessageSent:     e.Status.Stat.MessageSent,
+			LastMessageTime: e.Status.Stat.LastMessageTime,
+		}
+	}
+	return event
+}
+
+// Normalize 将v11通知事件转换为内部事件
+func (e NoticeEvent) Normalize() Event {
+	return Event{
+		Protocol:   ProtocolV11,
+		PostType:   e.PostType,
+		DetailType: e.NoticeType,
+		SubType:    e.SubType,
+		Time:       e.Time,
+		SelfID:     formatID(e.SelfID),
+		Platform:   "qq",
+		MessageID:  formatID(e.MessageID),
+		UserID:     formatID(e.UserID),
+		GroupID:    formatID(e.GroupID),
+		OperatorID: formatID(e.OperatorID),
+	}
+}
+
+// Normalize 将v11请求事件转换为内部事件
+func (e RequestEvent) Normalize() Event {
+	return Event{
+		Protocol:   ProtocolV11,
+		PostType:   e.PostType,
+		DetailType: e.RequestType,
+		SubType:    e.SubType,
+		Time:       e.Time,
+		SelfID:     formatID(e.SelfID),
+		Platform:   "qq",
+		UserID:     formatID(e.UserID),
+		GroupID:    formatID(e.GroupID),
+		Comment:    e.Comment,
+	}
+}
+
+// Normalize 将v12事件转换为内部事件
+// status_update会为其中的每个机器人各生成一个事件
+func (e V12Event) Normalize() []Event {
+	event := Event{
+		Protocol:   ProtocolV12,
+		PostType:   e.Type,
+		DetailType: e.DetailType,
+		SubType:    e.SubType,
+		Time:       int64(e.Time),
+		SelfID:     e.Self.UserID,
+		Platform:   e.Self.Platform,
+		MessageID:  e.MessageID,
+		UserID:     e.UserID,
+		GroupID:    e.GroupID,
+		GuildID:    e.GuildID,
+		ChannelID:  e.ChannelID,
+		OperatorID: e.OperatorID,
+		Comment:    e.Comment,
+	}
+
+	switch e.Type {
+	case "meta":
+		event.PostType = "meta_event"
+		switch e.DetailType {
+		case "connect":
+			event.Implementation = e.Version.Impl
+		case "status_update":
+			events := make([]Event, 0, len(e.Status.Bots))
+			for _, bot := range e.Status.Bots {
+				botEvent := event
+				botEvent.SelfID = bot.Self.UserID
+				botEvent.Platform = bot.Self.Platform
+				botEvent.Status = &EventStatus{Online: bot.Online}
+				events = append(events, botEvent)
+			}
+			return events
+		}
+	case "message":
+		event.RawMessage = e.AltMessage
+		if event.RawMessage == "" {
+			event.RawMessage = segmentsText(e.Message)
+		}
+		event.Message = e.Message
+		if e.DetailType == "channel" {
+			// 与v11的频道消息保持一致
+			event.DetailType = "guild"
+		}
+	case "notice":
+		if v11Type, ok := v12NoticeTypes[e.DetailType]; ok {
+			event.DetailType = v11Type
+		}
+		// v12中机器人自身被踢出没有单独的sub_type
+		if event.DetailType == "group_decrease" && e.SubType == "kick" && e.UserID == e.Self.UserID {
+			event.SubType = "kick_me"
+		}
+	}
+
+	return []Event{event}
+}
+
+// 发送消息的action 与对应的消息类型 send_msg需要从参数中判断
+var sendActions = map[string]string{
+	"send_msg":               "",
+	"send_private_msg":       "private",
+	"send_group_msg":         "group",
+	"send_guild_channel_msg": "guild",
+	"send_message":           "",
+}
+
+// NormalizeSend 将发送消息的action转换为message_sent内部事件 其他action返回false
+func (a ActionMessage) NormalizeSend(selfID string) (Event, bool) {
+	messageType, ok := sendActions[a.Action]
+	if !ok {
+		return Event{}, false
+	}
+
+	groupID, _ := a.Params.GroupID.(string)
+	userID, _ := a.Params.UserID.(string)
+	guildID, _ := a.Params.GuildID.(string)
+	channelID, _ := a.Params.ChannelID.(string)
+	if messageType == "" {
+		messageType = a.Params.MessageType
+	}
+	if messageType == "" {
+		messageType = a.Params.DetailType
+		if messageType == "channel" {
+			messageType = "guild"
+		}
+	}
+	if messageType == "" {
+		if groupID != "" {
+			messageType = "group"
+		} else {
+			messageType = "private"
+		}
+	}
+
+	protocol := ProtocolV11
+	if a.Action == "send_message" {
+		protocol = ProtocolV12
+	}
+
+	return Event{
+		Protocol:   protocol,
+		PostType:   "message_sent",
+		DetailType: messageType,
+		Time:       time.Now().Unix(),
+		SelfID:     selfID,
+		UserID:     userID,
+		GroupID:    groupID,
+		GuildID:    guildID,
+		ChannelID:  channelID,
+		RawMessage: messageText(a.Params.Message),
+		Message:    a.Params.Message,
+	}, true
+}
+
+var cqReplyRegexp = regexp.MustCompile(`\[CQ:reply,(?:[^\]]*,)?id=(-?[\w-]+)`)
+
+// ReplyID 返回消息中reply段引用的message_id 没有时返回空字符串
+func (e Event) ReplyID() string {
+	if segments, ok := e.Message.([]interface{}); ok {
+		for _, item := range segments {
+			segment, ok := item.(map[string]interface{})
+			if !ok || segment["type"] != "reply" {
+				continue
+			}
+			if data, ok := segment["data"].(map[string]interface{}); ok {
+				// v11为id v12为message_id
+				for _, key := range []string{"id", "message_id"} {
+					switch id := data[key].(type) {
+					case string:
+						return id
+					case float64:
+						return strconv.FormatInt(int64(id), 10)
+					}
+				}
+			}
+		}
+	}
+	if segments, ok := e.Message.([]V12Segment); ok {
+		for _, segment := range segments {
+			if segment.Type == "reply" {
+				if id, ok := segment.Data["message_id"].(string); ok {
+					return id
+				}
+			}
+		}
+	}
+	if match := cqReplyRegexp.FindStringSubmatch(e.RawMessage); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// MessageSegment 统一格式的消息段 v12的类型和参数转换为v11的名称 参数值均转换为字符串
+type MessageSegment struct {
+	Type string            `json:"type"`
+	Data map[string]string `json:"data"`
+}
+
+// v12与v11含义相同的消息段类型
+var v12SegmentTypes = map[string]string{
+	"mention":     "at",
+	"mention_all": "at",
+	"voice":       "record",
+	"audio":       "record",
+}
+
+var cqCodeRegexp = regexp.MustCompile(`\[CQ:([\w.-]+)((?:,[^\]]*)?)\]`)
+
+// Segments 返回消息的消息段 消息为字符串或只有raw_message时按CQ码解析
+func (e Event) Segments() []MessageSegment {
+	switch message := e.Message.(type) {
+	case []interface{}:
+		segments := make([]MessageSegment, 0, len(message))
+		for _, item := range message {
+			segment, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			segmentType, _ := segment["type"].(string)
+			data, _ := segment["data"].(map[string]interface{})
+			segments = append(segments, normalizeSegment(segmentType, data))
+		}
+		return segments
+	case []V12Segment:
+		segments := make([]MessageSegment, 0, len(message))
+		for _, segment := range message {
+			segments = append(segments, normalizeSegment(segment.Type, segment.Data))
+		}
+		return segments
+	case string:
+		return ParseCQCode(message)
+	}
+	return ParseCQCode(e.RawMessage)
+}
+
+// 转换为v11的类型和参数名称
+func normalizeSegment(segmentType string, data map[string]interface{}) MessageSegment {
+	segment := MessageSegment{Type: segmentType, Data: make(map[string]string, len(data))}
+	for key, value := range data {
+		segment.Data[key] = segmentValue(value)
+	}
+	if v11Type, ok := v12SegmentTypes[segmentType]; ok {
+		segment.Type = v11Type
+	}
+	switch segmentType {
+	case "mention":
+		segment.Data["qq"] = segment.Data["user_id"]
+	case "mention_all":
+		segment.Data["qq"] = "all"
+	case "reply":
+		if segment.Data["id"] == "" {
+			segment.Data["id"] = segment.Data["message_id"]
+		}
+	}
+	return segment
+}
+
+func segmentValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	// markdown等参数可能是对象
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// ParseCQCode 将含有CQ码的文本拆分为消息段 CQ码之间的文字为text段
+func ParseCQCode(text string) []MessageSegment {
+	var segments []MessageSegment
+	appendText := func(s string) {
+		if s != "" {
+			segments = append(segments, MessageSegment{Type: "text", Data: map[string]string{"text": unescapeCQ(s)}})
+		}
+	}
+
+	last := 0
+	for _, match := range cqCodeRegexp.FindAllStringSubmatchIndex(text, -1) {
+		appendText(text[last:match[0]])
+		segment := MessageSegment{Type: text[match[2]:match[3]], Data: make(map[string]string)}
+		for _, param := range strings.Split(strings.TrimPrefix(text[match[4]:match[5]], ","), ",") {
+			if key, value, ok := strings.Cut(param, "="); ok {
+				segment.Data[key] = unescapeCQ(value)
+			}
+		}
+		segments = append(segments, segment)
+		last = match[1]
+	}
+	appendText(text[last:])
+	return segments
+}
+
+var cqUnescaper = strings.NewReplacer("&#44;", ",", "&#91;", "[", "&#93;", "]", "&amp;", "&")
+
+func unescapeCQ(s string) string {
+	return cqUnescaper.Replace(s)
+}
+
+// 将action参数中的消息转换为文本 消息段数组转换为CQ码
+func messageText(message interface{}) string {
+	switch v := message.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var builder strings.Builder
+		for _, item := range v {
+			segment, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			segmentType, _ := segment["type"].(string)
+			data, _ := segment["data"].(map[string]interface{})
+			if segmentType == "text" {
+				if text, ok := data["text"].(string); ok {
+					builder.WriteString(text)
+				}
+				continue
+			}
+			builder.WriteString("[CQ:" + segmentType)
+			for key, value := range data {
+				builder.WriteString(fmt.Sprintf(",%s=%v", key, value))
+			}
+			builder.WriteString("]")
+		}
+		return builder.String()
+	}
+	return ""
+}
+
+// 拼接v12消息段中的文本 用于缺少alt_message的实现
+func segmentsText(segments []V12Segment) string {
+	var builder strings.Builder
+	for _, segment := range segments {
+		if segment.Type != "text" {
+			continue
+		}
+		if text, ok := segment.Data["text"].(string); ok {
+			builder.WriteString(text)
+		}
+	}
+	return builder.String()
+}
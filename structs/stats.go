@@ -0,0 +1,382 @@
+package structs
+
+// 面板查询返回的统计结果 各存储实现共用
+
+type APIStatus struct {
+	APIPaths        string  `json:"apiPaths"`
+	APINames        string  `json:"apiNames"`
+	Online          bool    `json:"online"`
+	ResponseTime    int     `json:"responseTime,omitempty"`
+	ChecksPerformed int     `json:"checksPerformed,omitempty"`
+	ChecksFailed    int     `json:"checksFailed,omitempty"`
+	SuccessRate     float64 `json:"successRate,omitempty"`
+	Date            string  `json:"date"`
+}
+
+type CommandStat struct {
+	CommandName       string `json:"command_name"`
+	SelfID            string `json:"self_id"`
+	TotalCalls        int    `json:"total_calls"`
+	LastCallTimestamp int64  `json:"last_call_timestamp"`
+	PrivateCalls      int    `json:"private_calls"` // 按场景拆分的调用次数
+	GroupCalls        int    `json:"group_calls"`
+	GuildCalls        int    `json:"guild_calls"`
+}
+
+// SceneCalls 某个场景的调用次数 场景为空时返回总次数
+func (stat *CommandStat) SceneCalls(scene string) int {
+	switch scene {
+	case ScenePrivate:
+		return stat.PrivateCalls
+	case SceneGroup:
+		return stat.GroupCalls
+	case SceneGuild:
+		return stat.GuildCalls
+	}
+	return stat.TotalCalls
+}
+
+// AddCall 累加一次该场景的调用
+func (stat *CommandStat) AddCall(scene string) {
+	stat.TotalCalls++
+	switch scene {
+	case ScenePrivate:
+		stat.PrivateCalls++
+	case SceneGroup:
+		stat.GroupCalls++
+	case SceneGuild:
+		stat.GuildCalls++
+	}
+}
+
+// GroupStat 群的统计 私聊合计为一行 频道按子频道区分
+type GroupStat struct {
+	GroupID                string `json:"group_id"`
+	SelfID                 string `json:"self_id"`
+	MessageType            string `json:"message_type"`
+	GuildID                string `json:"guild_id,omitempty"`
+	ChannelID              string `json:"channel_id,omitempty"`
+	TotalMessagesSent      int    `json:"total_messages_sent,omitempty"`
+	LastMessageTimestamp   int64  `json:"last_message_timestamp,omitempty"`
+	ConsecutiveMessageDays int    `json:"consecutive_message_days,omitempty"`
+	MessagesSent           int    `json:"messages_sent,omitempty"`  // For daily stats
+	ActiveMembers          int    `json:"active_members,omitempty"` // For daily stats
+	Date                   string `json:"date,omitempty"`           // Only for daily stats
+}
+
+type UserStat struct {
+	UserID                 string `json:"user_id"`
+	SelfID                 string `json:"self_id"`
+	Nickname               string `json:"nickname"`
+	Role                   string `json:"role"`
+	TotalMessagesSent      int    `json:"total_messages_sent,omitempty"`
+	LastMessageTimestamp   int64  `json:"last_message_timestamp,omitempty"`
+	ConsecutiveMessageDays int    `json:"consecutive_message_days,omitempty"`
+	MessagesSent           int    `json:"messages_sent,omitempty"`           // For daily stats
+	IncludedInGroupCount   bool   `json:"included_in_group_count,omitempty"` // For daily stats
+	Date                   string `json:"date,omitempty"`                    // Only for daily stats
+	PrivateMessages        int    `json:"private_messages"`                  // 按场景拆分的消息数
+	GroupMessages          int    `json:"group_messages"`
+	GuildMessages          int    `json:"guild_messages"`
+}
+
+// SceneMessages 某个场景的消息数
+func (stat *UserStat) SceneMessages(scene string) int {
+	switch scene {
+	case ScenePrivate:
+		return stat.PrivateMessages
+	case SceneGroup:
+		return stat.GroupMessages
+	case SceneGuild:
+		return stat.GuildMessages
+	}
+	return 0
+}
+
+// AddSceneMessage 累加一条该场景的消息 不改变总消息数
+func (stat *UserStat) AddSceneMessage(scene string) {
+	switch scene {
+	case ScenePrivate:
+		stat.PrivateMessages++
+	case SceneGroup:
+		stat.GroupMessages++
+	case SceneGuild:
+		stat.GuildMessages++
+	}
+}
+
+type ConnectionSession struct {
+	SessionID      int64  `json:"session_id"`
+	SelfID         string `json:"self_id"`
+	Role           string `json:"role"`
+	RemoteIP       string `json:"remote_ip"`
+	Implementation string `json:"implementation"`
+	Transport      string `json:"transport"`
+	ConnectedAt    int64  `json:"connected_at"`
+	DisconnectedAt int64  `json:"disconnected_at,omitempty"`
+	Online         bool   `json:"online"`
+}
+
+type ReplyStat struct {
+	Date        string  `json:"date,omitempty"`
+	CommandName string  `json:"command_name,omitempty"`
+	GroupID     string  `json:"group_id,omitempty"`
+	Calls       int     `json:"calls"`   // 收到的指令数 按群统计时为收到的消息数
+	Replies     int     `json:"replies"` // 机器人发出的回复数
+	ReplyRate   float64 `json:"reply_rate"`
+	LastReplyAt int64   `json:"last_reply_timestamp,omitempty"`
+}
+
+type ActionStat struct {
+	Action         string  `json:"action"`
+	Calls          int     `json:"calls"`
+	Failures       int     `json:"failures"`
+	FailureRate    float64 `json:"failure_rate"`
+	AvgLatencyMs   float64 `json:"avg_latency_ms"`
+	MaxLatencyMs   int64   `json:"max_latency_ms"`
+	TotalLatencyMs int64   `json:"-"`
+}
+
+type CommandLatency struct {
+	CommandName string  `json:"command_name"`
+	SelfID      string  `json:"self_id"`
+	Date        string  `json:"date"`
+	Samples     int     `json:"samples"`
+	AvgLatency  float64 `json:"avg_latency"`
+	P50         int64   `json:"p50"`
+	P90         int64   `json:"p90"`
+	P99         int64   `json:"p99"`
+	MaxLatency  int64   `json:"max_latency"`
+}
+
+// RequestFunnel 某天某种请求的转化情况
+type RequestFunnel struct {
+	Date          string `json:"date"`
+	RequestType   string `json:"request_type"`
+	Requests      int    `json:"requests"`
+	Joined        int    `json:"joined"`
+	FirstMessaged int    `json:"first_messaged"`
+}
+
+// RequestRecord 一条好友请求或加群邀请 未加入或未发言时对应时间为0
+type RequestRecord struct {
+	RequestType    string `json:"request_type"`
+	SubType        string `json:"sub_type"`
+	UserID         string `json:"user_id"`
+	GroupID        string `json:"group_id"`
+	Comment        string `json:"comment"`
+	Time           int64  `json:"time"`
+	JoinedAt       int64  `json:"joined_at"`
+	FirstMessageAt int64  `json:"first_message_at"`
+}
+
+type NoticeStat struct {
+	Date                string `json:"date"`
+	NoticeType          string `json:"notice_type"`
+	SubType             string `json:"sub_type"`
+	Count               int    `json:"count"`
+	LastNoticeTimestamp int64  `json:"last_notice_timestamp"`
+}
+
+type NoticeRecord struct {
+	NoticeType string `json:"notice_type"`
+	SubType    string `json:"sub_type"`
+	GroupID    string `json:"group_id"`
+	UserID     string `json:"user_id"`
+	OperatorID string `json:"operator_id"`
+	MessageID  string `json:"message_id"`
+	Time       int64  `json:"time"`
+}
+
+// GroupUserStat 用户在某个群内的统计 日统计时MessagesSent为当天的发言数
+type GroupUserStat struct {
+	SelfID                string `json:"self_id"`
+	GroupID               string `json:"group_id"`
+	UserID                string `json:"user_id"`
+	Nickname              string `json:"nickname"`
+	Card                  string `json:"card"`
+	Role                  string `json:"role"`
+	MessagesSent          int    `json:"messages_sent"`
+	FirstMessageTimestamp int64  `json:"first_message_timestamp,omitempty"`
+	LastMessageTimestamp  int64  `json:"last_message_timestamp"`
+	Date                  string `json:"date,omitempty"`
+}
+
+// CalculateRate 根据指令数和回复数计算回复率
+func (stat *ReplyStat) CalculateRate() {
+	if stat.Calls > 0 {
+		stat.ReplyRate = float64(stat.Replies) / float64(stat.Calls)
+	}
+}
+
+// WriterStats 写入队列的状态 用于观察是否跟得上事件的速度
+type WriterStats struct {
+	QueueLength   int   `json:"queue_length"`
+	QueueCapacity int   `json:"queue_capacity"`
+	MaxQueued     int64 `json:"max_queued"` // 出现过的最大队列长度
+	Enqueued      int64 `json:"enqueued"`
+	Dropped       int64 `json:"dropped"` // 队列已满时丢弃的事件数
+	Blocked       int64 `json:"blocked"` // 队列已满时等待的次数
+	Failed        int64 `json:"failed"`  // 写入失败的事件数
+	Retries       int64 `json:"retries"` // 整批写入失败后重试的次数
+	Batches       int64 `json:"batches"`
+	LastBatchSize int64 `json:"last_batch_size"`
+	LastFlushMs   int64 `json:"last_flush_ms"`
+	MaxFlushMs    int64 `json:"max_flush_ms"`
+}
+
+// RetentionPolicy 各类数据的保留天数 小于等于0为永久保留
+type RetentionPolicy struct {
+	RawDays   int // 收发的原始消息和通知明细
+	DailyDays int // 每日汇总 机器人每日状态 加群请求和连接会话
+}
+
+// PruneResult 一次清理的结果
+type PruneResult struct {
+	Time       int64            `json:"time"`
+	Deleted    map[string]int64 `json:"deleted"` // 每个表删除的行数
+	FreedPages int64            `json:"freed_pages"`
+	DurationMs int64            `json:"duration_ms"`
+}
+
+// TableSize 一个表的行数和所属的保留类别
+type TableSize struct {
+	Name  string `json:"name"`
+	Class string `json:"class"` // raw daily cookie 或为空(不清理)
+	Rows  int64  `json:"rows"`
+}
+
+// StorageStats 存储占用 内存存储没有页信息
+type StorageStats struct {
+	Backend   string       `json:"backend"`
+	Tables    []TableSize  `json:"tables"`
+	PageSize  int64        `json:"page_size"`
+	PageCount int64        `json:"page_count"`
+	FreePages int64        `json:"free_pages"`
+	SizeBytes int64        `json:"size_bytes"`
+	LastPrune *PruneResult `json:"last_prune"`
+}
+
+// HourlyStat 一个小时内的统计 按群或指令查询时只有Messages或Commands
+// 周矩阵中为所选天数内该星期几该小时的合计
+type HourlyStat struct {
+	Weekday      int `json:"weekday"` // 0为星期日
+	Hour         int `json:"hour"`
+	Messages     int `json:"messages"`
+	ActiveUsers  int `json:"active_users"`
+	ActiveGroups int `json:"active_groups"`
+	Commands     int `json:"commands"`
+}
+
+// Add 累加另一个小时的统计
+func (stat *HourlyStat) Add(other HourlyStat) {
+	stat.Messages += other.Messages
+	stat.ActiveUsers += other.ActiveUsers
+	stat.ActiveGroups += other.ActiveGroups
+	stat.Commands += other.Commands
+}
+
+// MessageSearch 消息搜索的条件 Keyword按空白分为多个词 全部包含才匹配
+// 日期为统计时区中的YYYY-MM-DD 为空时不限制
+type MessageSearch struct {
+	Keyword   string
+	SelfID    string
+	GroupID   string
+	UserID    string
+	StartDate string
+	EndDate   string
+	Offset    int
+	Limit     int
+}
+
+// MessageHit 搜索到的一条消息 Snippet为转义后的片段 关键词用<mark>标出
+type MessageHit struct {
+	MessageID   string `json:"message_id"`
+	SelfID      string `json:"self_id"`
+	MessageType string `json:"message_type"`
+	GroupID     string `json:"group_id"`
+	UserID      string `json:"user_id"`
+	RawMessage  string `json:"raw_message"`
+	Snippet     string `json:"snippet"`
+	Time        int64  `json:"time"`
+	Date        string `json:"date"`
+}
+
+// MessageSearchResult 一页搜索结果 Total为符合条件的总数
+type MessageSearchResult struct {
+	Total    int          `json:"total"`
+	Messages []MessageHit `json:"messages"`
+}
+
+// SegmentStat 某种消息段的每日统计 Messages为含有该类型消息段的消息数 AtSelf为@机器人的次数
+type SegmentStat struct {
+	Date        string `json:"date"`
+	SegmentType string `json:"segment_type"`
+	Segments    int    `json:"segments"`
+	Messages    int    `json:"messages"`
+	AtSelf      int    `json:"at_self"`
+}
+
+// Add 累加另一份统计
+func (stat *SegmentStat) Add(other SegmentStat) {
+	stat.Segments += other.Segments
+	stat.Messages += other.Messages
+	stat.AtSelf += other.AtSelf
+}
+
+// CommandRatio 一天中指令与闲聊的消息数 GroupID为空时合计机器人的所有消息
+type CommandRatio struct {
+	Date     string  `json:"date"`
+	GroupID  string  `json:"group_id,omitempty"`
+	Messages int     `json:"messages"`
+	Commands int     `json:"commands"`
+	Chats    int     `json:"chats"`
+	Ratio    float64 `json:"ratio"` // 指令占消息的比例
+}
+
+// Add 累加另一份统计并重新计算比例
+func (stat *CommandRatio) Add(other CommandRatio) {
+	stat.Commands += other.Commands
+	stat.Chats += other.Chats
+	stat.Messages = stat.Commands + stat.Chats
+	if stat.Messages > 0 {
+		stat.Ratio = float64(stat.Commands) / float64(stat.Messages)
+	}
+}
+
+// CommandRecompute 按当前规则重新统计指令的结果 Since为每个机器人重新统计的起始日期
+type CommandRecompute struct {
+	Messages   int               `json:"messages"`
+	Commands   int               `json:"commands"` // 其中计为指令的消息数
+	Since      map[string]string `json:"since"`
+	DurationMs int64             `json:"duration_ms"`
+}
+
+// UserActivity 一天中活跃用户里新用户与老用户的数量 新用户为当天第一次发言的用户
+type UserActivity struct {
+	Date           string `json:"date"`
+	ActiveUsers    int    `json:"active_users"`
+	NewUsers       int    `json:"new_users"`
+	ReturningUsers int    `json:"returning_users"`
+}
+
+// Cohort 同一天第一次发言的用户之后每天仍发言的人数
+// Retained[n]为第一次发言后第n天发言的人数 Retained[0]即NewUsers 只包含已经过去的天数
+type Cohort struct {
+	Date     string    `json:"date"`
+	NewUsers int       `json:"new_users"`
+	Retained []int     `json:"retained"`
+	Rates    []float64 `json:"rates"` // 对应Retained占NewUsers的比例
+}
+
+// Retention 一天的新用户的次日 7日和30日留存 尚未到达的天数为null
+type Retention struct {
+	Date      string   `json:"date"`
+	NewUsers  int      `json:"new_users"`
+	Day1      *int     `json:"day1"`
+	Day7      *int     `json:"day7"`
+	Day30     *int     `json:"day30"`
+	Day1Rate  *float64 `json:"day1_rate"`
+	Day7Rate  *float64 `json:"day7_rate"`
+	Day30Rate *float64 `json:"day30_rate"`
+}
@@ -65,16 +65,18 @@ func (a *ActionMessage) UnmarshalJSON(data []byte) error {
 
 // params类型
 type ParamsContent struct {
-	BotQQ     string      `json:"botqq,omitempty"`
-	ChannelID interface{} `json:"channel_id,omitempty"`
-	GuildID   interface{} `json:"guild_id,omitempty"`
-	GroupID   interface{} `json:"group_id,omitempty"`   // 每一种onebotv11实现的字段类型都可能不同
-	MessageID interface{} `json:"message_id,omitempty"` // 用于撤回信息
-	Message   interface{} `json:"message,omitempty"`    // 这里使用interface{}因为它可能是多种类型
-	Messages  interface{} `json:"messages,omitempty"`   // 坑爹转发信息
-	UserID    interface{} `json:"user_id,omitempty"`    // 这里使用interface{}因为它可能是多种类型
-	Duration  int         `json:"duration,omitempty"`   // 可选的整数
-	Enable    bool        `json:"enable,omitempty"`     // 可选的布尔值
+	BotQQ       string      `json:"botqq,omitempty"`
+	ChannelID   interface{} `json:"channel_id,omitempty"`
+	GuildID     interface{} `json:"guild_id,omitempty"`
+	GroupID     interface{} `json:"group_id,omitempty"`     // 每一种onebotv11实现的字段类型都可能不同
+	MessageID   interface{} `json:"message_id,omitempty"`   // 用于撤回信息
+	Message     interface{} `json:"message,omitempty"`      // 这里使用interface{}因为它可能是多种类型
+	Messages    interface{} `json:"messages,omitempty"`     // 坑爹转发信息
+	UserID      interface{} `json:"user_id,omitempty"`      // 这里使用interface{}因为它可能是多种类型
+	Duration    int         `json:"duration,omitempty"`     // 可选的整数
+	Enable      bool        `json:"enable,omitempty"`       // 可选的布尔值
+	MessageType string      `json:"message_type,omitempty"` // send_msg 的消息类型 private/group
+	DetailType  string      `json:"detail_type,omitempty"`  // v12 send_message 的消息类型
 	// handle quick operation
 	Context   Context   `json:"context,omitempty"`   // context 字段
 	Operation Operation `json:"operation,omitempty"` // operation 字段
@@ -206,13 +208,18 @@ type MessageEvent struct {
 	} `json:"anonymous"`
 	Font       int   `json:"font"`
 	GroupID    int64 `json:"group_id"`
+	TargetID   int64 `json:"target_id"` // 仅message_sent 私聊的接收者
 	MessageSeq int64 `json:"message_seq"`
 	MessageID  int64 `json:"message_id"`
+	// 仅频道消息 各实现的类型可能是字符串或数字
+	GuildID   interface{} `json:"guild_id"`
+	ChannelID interface{} `json:"channel_id"`
 }
 
 type MetaEvent struct {
 	PostType      string `json:"post_type"`
 	MetaEventType string `json:"meta_event_type"`
+	SubType       string `json:"sub_type"`
 	Time          int64  `json:"time"`
 	SelfID        int64  `json:"self_id"`
 	Interval      int    `json:"interval"`
@@ -238,6 +245,7 @@ type MetaEvent struct {
 
 type NoticeEvent struct {
 	GroupID    int64  `json:"group_id"`
+	MessageID  int64  `json:"message_id"`
 	NoticeType string `json:"notice_type"`
 	OperatorID int64  `json:"operator_id"`
 	PostType   string `json:"post_type"`
@@ -247,8 +255,20 @@ type NoticeEvent struct {
 	UserID     int64  `json:"user_id"`
 }
 
+type RequestEvent struct {
+	Comment     string `json:"comment"`
+	Flag        string `json:"flag"`
+	GroupID     int64  `json:"group_id"`
+	PostType    string `json:"post_type"`
+	RequestType string `json:"request_type"`
+	SelfID      int64  `json:"self_id"`
+	SubType     string `json:"sub_type"`
+	Time        int64  `json:"time"`
+	UserID      int64  `json:"user_id"`
+}
+
 type RobotStatus struct {
-	SelfID          int64  `json:"self_id"`
+	SelfID          string `json:"self_id"`
 	Date            string `json:"date"`
 	Online          bool   `json:"online"`
 	MessageReceived int    `json:"message_received"`
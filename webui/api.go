@@ -1,9 +1,10 @@
 package webui
 
 import (
-	"database/sql"
 	"embed"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,12 +12,15 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/apistats"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/config"
-	"github.com/hoshinonyaruko/gensokyo-dashboard/sqlite"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/server"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/structs"
 	"github.com/hoshinonyaruko/gensokyo-dashboard/sys"
 )
 
@@ -28,83 +32,213 @@ var content embed.FS
 const configFile = "config.json"
 
 // NewCombinedMiddleware 创建并返回一个带有依赖的中间件闭包
-func CombinedMiddleware(config config.Config, db *sql.DB) gin.HandlerFunc {
+func CombinedMiddleware(config config.Config, st store.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if strings.HasPrefix(c.Request.URL.Path, "/webui/api") {
 
 			// 处理/api/login的POST请求
 			if c.Param("filepath") == "/api/login" && c.Request.Method == http.MethodPost {
-				HandleLoginRequest(c, config, db)
+				HandleLoginRequest(c, config, st)
 				return
 			}
 			// 处理/api/check-login-status的GET请求
 			if c.Param("filepath") == "/api/check-login-status" && c.Request.Method == http.MethodGet {
-				HandleCheckLoginStatusRequest(db, c)
+				HandleCheckLoginStatusRequest(st, c)
 				return
 			}
 			// 处理 /api/get-json 的GET请求
 			if c.Param("filepath") == "/api/getjson" && c.Request.Method == http.MethodGet {
-				HandleGetJSON(c, config, db)
+				HandleGetJSON(c, config, st)
 				return
 			}
 			// 处理 /api/save-json 的POST请求
 			if c.Param("filepath") == "/api/savejson" && c.Request.Method == http.MethodPost {
-				HandleSaveJSON(c, config, db)
+				HandleSaveJSON(c, config, st)
 				return
 			}
 			// 处理 /api/restartself 的GET请求
 			if c.Param("filepath") == "/api/restartself" && c.Request.Method == http.MethodGet {
-				HandleRestartSelf(c, config, db)
+				HandleRestartSelf(c, config, st)
 				return
 			}
 			// 处理 /api/online-robots 的GET请求
 			if c.Param("filepath") == "/api/online-robots" && c.Request.Method == http.MethodGet {
-				HandleOnlineRobots(c, &config, db)
+				HandleOnlineRobots(c, &config, st)
 				return
 			}
 			// 处理 /api/robot-info 的GET请求
 			if c.Param("filepath") == "/api/robot-info" && c.Request.Method == http.MethodGet {
-				HandleRobotInfo(c, db)
+				HandleRobotInfo(c, st)
 				return
 			}
 			// 处理 /api/robot-info-all 的GET请求
 			if c.Param("filepath") == "/api/robot-info-all" && c.Request.Method == http.MethodGet {
-				HandleRobotInfoAll(c, db)
+				HandleRobotInfoAll(c, st)
 				return
 			}
 			// 处理 /api/api-info 的GET请求
 			if c.Param("filepath") == "/api/api-info" && c.Request.Method == http.MethodGet {
-				HandleApiInfo(c, config, db)
+				HandleApiInfo(c, config, st)
 				return
 			}
 			// 处理 /api/command-all 的GET请求
 			if c.Param("filepath") == "/api/command-all" && c.Request.Method == http.MethodGet {
-				HandleCommandAll(c, &config, db)
+				HandleCommandAll(c, &config, st)
 				return
 			}
 			// 处理 /api/command-daily 的GET请求
 			if c.Param("filepath") == "/api/command-daily" && c.Request.Method == http.MethodGet {
-				HandleCommandDaily(c, &config, db)
+				HandleCommandDaily(c, &config, st)
+				return
+			}
+
+			// 处理 /api/command-ratio 的GET请求
+			if c.Param("filepath") == "/api/command-ratio" && c.Request.Method == http.MethodGet {
+				HandleCommandRatio(c, st)
+				return
+			}
+
+			// 处理 /api/command-ratio-groups 的GET请求
+			if c.Param("filepath") == "/api/command-ratio-groups" && c.Request.Method == http.MethodGet {
+				HandleCommandRatioGroups(c, st)
+				return
+			}
+
+			// 处理 /api/user-activity 的GET请求
+			if c.Param("filepath") == "/api/user-activity" && c.Request.Method == http.MethodGet {
+				HandleUserActivity(c, st)
+				return
+			}
+
+			// 处理 /api/retention 的GET请求
+			if c.Param("filepath") == "/api/retention" && c.Request.Method == http.MethodGet {
+				HandleRetention(c, st)
+				return
+			}
+
+			// 处理 /api/cohorts 的GET请求
+			if c.Param("filepath") == "/api/cohorts" && c.Request.Method == http.MethodGet {
+				HandleCohorts(c, st)
+				return
+			}
+			// 处理 /api/command-latency-daily 的GET请求
+			if c.Param("filepath") == "/api/command-latency-daily" && c.Request.Method == http.MethodGet {
+				HandleCommandLatencyDaily(c, st)
 				return
 			}
 			// 处理 /api/group-all 的GET请求
 			if c.Param("filepath") == "/api/group-all" && c.Request.Method == http.MethodGet {
-				HandleGroupAll(c, db)
+				HandleGroupAll(c, st)
 				return
 			}
 			// 处理 /api/group-daily 的GET请求
 			if c.Param("filepath") == "/api/group-daily" && c.Request.Method == http.MethodGet {
-				HandleGroupDaily(c, db)
+				HandleGroupDaily(c, st)
 				return
 			}
 			// 处理 /api/user-all 的GET请求
 			if c.Param("filepath") == "/api/user-all" && c.Request.Method == http.MethodGet {
-				HandleUserAll(c, db)
+				HandleUserAll(c, st)
 				return
 			}
 			// 处理 /api/user-daily 的GET请求
 			if c.Param("filepath") == "/api/user-daily" && c.Request.Method == http.MethodGet {
-				HandleUserDaily(c, db)
+				HandleUserDaily(c, st)
+				return
+			}
+			// 处理 /api/group-user-top 的GET请求
+			if c.Param("filepath") == "/api/group-user-top" && c.Request.Method == http.MethodGet {
+				HandleGroupUserTop(c, st)
+				return
+			}
+			// 处理 /api/user-groups 的GET请求
+			if c.Param("filepath") == "/api/user-groups" && c.Request.Method == http.MethodGet {
+				HandleUserGroups(c, st)
+				return
+			}
+			// 处理 /api/reply-daily 的GET请求
+			if c.Param("filepath") == "/api/reply-daily" && c.Request.Method == http.MethodGet {
+				HandleReplyDaily(c, st)
+				return
+			}
+			// 处理 /api/reply-command-daily 的GET请求
+			if c.Param("filepath") == "/api/reply-command-daily" && c.Request.Method == http.MethodGet {
+				HandleReplyCommandDaily(c, st)
+				return
+			}
+			// 处理 /api/reply-group-daily 的GET请求
+			if c.Param("filepath") == "/api/reply-group-daily" && c.Request.Method == http.MethodGet {
+				HandleReplyGroupDaily(c, st)
+				return
+			}
+			// 处理 /api/action-daily 的GET请求
+			if c.Param("filepath") == "/api/action-daily" && c.Request.Method == http.MethodGet {
+				HandleActionDaily(c, st)
+				return
+			}
+			// 处理 /api/request-daily 的GET请求
+			if c.Param("filepath") == "/api/request-daily" && c.Request.Method == http.MethodGet {
+				HandleRequestDaily(c, st)
+				return
+			}
+			// 处理 /api/requests 的GET请求
+			if c.Param("filepath") == "/api/requests" && c.Request.Method == http.MethodGet {
+				HandleRequests(c, st)
+				return
+			}
+			// 处理 /api/notice-daily 的GET请求
+			if c.Param("filepath") == "/api/notice-daily" && c.Request.Method == http.MethodGet {
+				HandleNoticeDaily(c, st)
+				return
+			}
+			// 处理 /api/notice-timeline 的GET请求
+			if c.Param("filepath") == "/api/notice-timeline" && c.Request.Method == http.MethodGet {
+				HandleNoticeTimeline(c, st)
+				return
+			}
+			// 处理 /api/segment-daily 的GET请求
+			if c.Param("filepath") == "/api/segment-daily" && c.Request.Method == http.MethodGet {
+				HandleSegmentDaily(c, st)
+				return
+			}
+			// 处理 /api/hourly 的GET请求
+			if c.Param("filepath") == "/api/hourly" && c.Request.Method == http.MethodGet {
+				HandleHourly(c, st)
+				return
+			}
+			// 处理 /api/hourly-week 的GET请求
+			if c.Param("filepath") == "/api/hourly-week" && c.Request.Method == http.MethodGet {
+				HandleHourlyWeek(c, st)
+				return
+			}
+			// 处理 /api/messages/search 的GET请求
+			if c.Param("filepath") == "/api/messages/search" && c.Request.Method == http.MethodGet {
+				HandleMessageSearch(c, st)
+				return
+			}
+			// 处理 /api/write-queue 的GET请求
+			if c.Param("filepath") == "/api/write-queue" && c.Request.Method == http.MethodGet {
+				HandleWriteQueue(c, st)
+				return
+			}
+			// 处理 /api/connections 的GET请求
+			if c.Param("filepath") == "/api/connections" && c.Request.Method == http.MethodGet {
+				HandleConnections(c, st)
+				return
+			}
+			// 处理 /api/commands/recompute 的POST请求
+			if c.Param("filepath") == "/api/commands/recompute" && c.Request.Method == http.MethodPost {
+				HandleRecomputeCommands(c, st)
+				return
+			}
+			// 处理 /api/storage 的GET请求
+			if c.Param("filepath") == "/api/storage" && c.Request.Method == http.MethodGet {
+				HandleStorage(c, config, st)
+				return
+			}
+			// 处理 /api/storage/prune 的POST请求
+			if c.Param("filepath") == "/api/storage/prune" && c.Request.Method == http.MethodPost {
+				HandlePrune(c, config, st)
 				return
 			}
 
@@ -134,8 +268,8 @@ func CombinedMiddleware(config config.Config, db *sql.DB) gin.HandlerFunc {
 }
 
 // HandleOnlineRobots returns all online robots' statuses for the current day in JSON
-func HandleOnlineRobots(c *gin.Context, config *config.Config, db *sql.DB) {
-	jsonData, err := sqlite.FetchOnlineRobots(db, config)
+func HandleOnlineRobots(c *gin.Context, config *config.Config, st store.Store) {
+	jsonData, err := fetchOnlineRobots(st, config)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -143,6 +277,95 @@ func HandleOnlineRobots(c *gin.Context, config *config.Config, db *sql.DB) {
 	c.Data(http.StatusOK, "application/json; charset=utf-8", jsonData)
 }
 
+// RobotStatus 机器人当日的状态 附带配置中的昵称和头像
+type RobotStatus struct {
+	SelfID          string `json:"self_id"`
+	MessageReceived int    `json:"message_received"`
+	MessageSent     int    `json:"message_sent"`
+	LastMessageTime int64  `json:"last_message_time"`
+	InvitesReceived int    `json:"invites_received"`
+	KicksReceived   int    `json:"kicks_received"`
+	DailyDAU        int    `json:"daily_dau"`
+	Nickname        string `json:"nickname"`
+	ImgHead         string `json:"imgHead"`
+	IsOnline        bool   `json:"isOnline"`
+}
+
+// fetchOnlineRobots returns a JSON array of all online robots' statuses for the current day
+// 返回机器人信息，会返回当日所有机器人，包括不在线的
+func fetchOnlineRobots(st store.Store, cfg *config.Config) ([]byte, error) {
+	statuses, err := st.FetchRobotStatuses(store.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var robots []RobotStatus
+	onlineBots := make(map[string]bool) // Map to track which bots are online
+	for _, status := range statuses {
+		robot := RobotStatus{
+			SelfID:          status.SelfID,
+			MessageReceived: status.MessageReceived,
+			MessageSent:     status.MessageSent,
+			LastMessageTime: status.LastMessageTime,
+			InvitesReceived: status.InvitesReceived,
+			KicksReceived:   status.KicksReceived,
+			DailyDAU:        status.DailyDAU,
+			IsOnline:        status.Online,
+		}
+
+		// Map robot info from config and handle the image
+		botFound := false
+		for _, botInfo := range cfg.BotInfos {
+			if robot.SelfID == botInfo.BotID {
+				robot.Nickname = botInfo.BotNickname
+				imgData, imgErr := os.ReadFile(botInfo.BotHead)
+				if imgErr == nil {
+					robot.ImgHead = base64.StdEncoding.EncodeToString(imgData)
+				} else {
+					fmt.Printf("Error reading image file: %v\n", imgErr)
+					robot.ImgHead = "" // Use an empty string if the image cannot be loaded
+				}
+				botFound = true
+				break
+			}
+		}
+
+		// If bot not found in config, initialize with default settings
+		if !botFound {
+			newBotInfo := config.BotInfo{
+				BotID:       robot.SelfID,
+				BotNickname: "NewBot-" + robot.SelfID,
+				BotHead:     "images/head.gif", // Default image path
+			}
+			cfg.BotInfos = append(cfg.BotInfos, newBotInfo)
+			config.WriteConfigToFile(*cfg)
+		}
+
+		onlineBots[robot.SelfID] = true // Mark this bot as online
+		robots = append(robots, robot)
+	}
+
+	// Append offline robots
+	for _, botInfo := range cfg.BotInfos {
+		if !onlineBots[botInfo.BotID] {
+			imgData, _ := os.ReadFile(botInfo.BotHead)
+			robots = append(robots, RobotStatus{
+				SelfID:   botInfo.BotID,
+				Nickname: botInfo.BotNickname,
+				ImgHead:  base64.StdEncoding.EncodeToString(imgData),
+				IsOnline: false,
+			})
+		}
+	}
+
+	jsonData, err := json.Marshal(robots)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling today's robot statuses to JSON: %w", err)
+	}
+
+	return jsonData, nil
+}
+
 func getContentType(path string) string {
 	// todo 根据需要增加更多的 MIME 类型
 	switch filepath.Ext(path) {
@@ -162,7 +385,7 @@ func getContentType(path string) string {
 }
 
 // HandleLoginRequest处理登录请求
-func HandleLoginRequest(c *gin.Context, config config.Config, db *sql.DB) {
+func HandleLoginRequest(c *gin.Context, config config.Config, st store.Store) {
 	var json struct {
 		Username string `json:"username" binding:"required"`
 		Password string `json:"password" binding:"required"`
@@ -175,7 +398,7 @@ func HandleLoginRequest(c *gin.Context, config config.Config, db *sql.DB) {
 
 	if checkCredentials(json.Username, json.Password, config) {
 		// 如果验证成功，设置cookie
-		cookieValue, err := GenerateCookie(db)
+		cookieValue, err := GenerateCookie(st)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate cookie"})
 			return
@@ -206,7 +429,7 @@ func checkCredentials(username, password string, jsonconfig config.Config) bool
 }
 
 // HandleCheckLoginStatusRequest 检查登录状态的处理函数
-func HandleCheckLoginStatusRequest(db *sql.DB, c *gin.Context) {
+func HandleCheckLoginStatusRequest(st store.Store, c *gin.Context) {
 	// 从请求中获取cookie
 	cookieValue, err := c.Cookie("login_cookie")
 	if err != nil {
@@ -216,7 +439,7 @@ func HandleCheckLoginStatusRequest(db *sql.DB, c *gin.Context) {
 	}
 
 	// 使用ValidateCookie函数验证cookie
-	isValid, err := ValidateCookie(db, cookieValue)
+	isValid, err := ValidateCookie(st, cookieValue)
 	if err != nil {
 		switch err {
 		case ErrCookieNotFound:
@@ -237,7 +460,7 @@ func HandleCheckLoginStatusRequest(db *sql.DB, c *gin.Context) {
 }
 
 // HandleGetJSON 返回当前的config作为JSON
-func HandleGetJSON(c *gin.Context, cfg config.Config, db *sql.DB) {
+func HandleGetJSON(c *gin.Context, cfg config.Config, st store.Store) {
 	// 从请求中获取cookie
 	cookieValue, err := c.Cookie("login_cookie")
 	if err != nil {
@@ -246,7 +469,7 @@ func HandleGetJSON(c *gin.Context, cfg config.Config, db *sql.DB) {
 	}
 
 	// 使用ValidateCookie函数验证cookie
-	isValid, err := ValidateCookie(db, cookieValue)
+	isValid, err := ValidateCookie(st, cookieValue)
 	if err != nil || !isValid {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid cookie"})
 		return
@@ -254,8 +477,23 @@ func HandleGetJSON(c *gin.Context, cfg config.Config, db *sql.DB) {
 	c.JSON(http.StatusOK, cfg)
 }
 
+// 验证登入cookie 未登入时返回401
+func requireLogin(c *gin.Context, st store.Store) bool {
+	cookieValue, err := c.Cookie("login_cookie")
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Cookie not provided"})
+		return false
+	}
+	isValid, err := ValidateCookie(st, cookieValue)
+	if err != nil || !isValid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid cookie"})
+		return false
+	}
+	return true
+}
+
 // HandleSaveJSON 从请求体中读取JSON并更新config
-func HandleSaveJSON(c *gin.Context, cfg config.Config, db *sql.DB) {
+func HandleSaveJSON(c *gin.Context, cfg config.Config, st store.Store) {
 	// 从请求中获取cookie
 	cookieValue, err := c.Cookie("login_cookie")
 	if err != nil {
@@ -264,7 +502,7 @@ func HandleSaveJSON(c *gin.Context, cfg config.Config, db *sql.DB) {
 	}
 
 	// 使用ValidateCookie函数验证cookie
-	isValid, err := ValidateCookie(db, cookieValue)
+	isValid, err := ValidateCookie(st, cookieValue)
 	if err != nil || !isValid {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid cookie"})
 		return
@@ -282,11 +520,11 @@ func HandleSaveJSON(c *gin.Context, cfg config.Config, db *sql.DB) {
 	c.JSON(http.StatusOK, gin.H{"message": "Config updated successfully"})
 
 	//重启自身 很快 唰的一下
-	sys.RestartApplication()
+	restartApplication(st)
 
 }
 
-func HandleRestartSelf(c *gin.Context, cfg config.Config, db *sql.DB) {
+func HandleRestartSelf(c *gin.Context, cfg config.Config, st store.Store) {
 	// 从请求中获取cookie
 	cookieValue, err := c.Cookie("login_cookie")
 	if err != nil {
@@ -295,7 +533,7 @@ func HandleRestartSelf(c *gin.Context, cfg config.Config, db *sql.DB) {
 	}
 
 	// 使用ValidateCookie函数验证cookie
-	isValid, err := ValidateCookie(db, cookieValue)
+	isValid, err := ValidateCookie(st, cookieValue)
 	if err != nil || !isValid {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid cookie"})
 		return
@@ -304,6 +542,15 @@ func HandleRestartSelf(c *gin.Context, cfg config.Config, db *sql.DB) {
 	// Cookie验证通过后，执行重启操作
 	c.JSON(http.StatusOK, gin.H{"message": "Restart initiated"})
 	//重启自身 很快 唰的一下
+	restartApplication(st)
+}
+
+// 重启会直接退出进程 先写完存档文件的结尾和写入队列中的事件
+func restartApplication(st store.Store) {
+	server.CloseCapture()
+	if err := st.Close(); err != nil {
+		log.Printf("Error closing store before restart: %v", err)
+	}
 	sys.RestartApplication()
 }
 
@@ -328,10 +575,10 @@ type RobotInfo struct {
 }
 
 // HandleRobotInfo handles the GET request to fetch robot info based on the provided parameters.
-func HandleRobotInfo(c *gin.Context, db *sql.DB) {
+func HandleRobotInfo(c *gin.Context, st store.Store) {
 	// Parse URL query parameters
-	selfID, err := strconv.ParseInt(c.Query("selfID"), 10, 64)
-	if err != nil {
+	selfID := c.Query("selfID")
+	if selfID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid selfID"})
 		return
 	}
@@ -349,14 +596,14 @@ func HandleRobotInfo(c *gin.Context, db *sql.DB) {
 	}
 
 	// Fetch field values from the database
-	values, err := sqlite.FetchFieldValuesForRobot(db, selfID, days, fieldType)
+	values, err := st.FetchFieldValuesForRobot(selfID, days, fieldType)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Convert values into structured format
-	endDate := time.Now()
+	endDate := store.Now()
 	var robotInfos []RobotInfo
 	for i, value := range values {
 		date := endDate.AddDate(0, 0, -i).Format("2006-01-02")
@@ -371,9 +618,9 @@ func HandleRobotInfo(c *gin.Context, db *sql.DB) {
 	c.JSON(http.StatusOK, robotInfos)
 }
 
-func HandleRobotInfoAll(c *gin.Context, db *sql.DB) {
-	selfID, err := strconv.ParseInt(c.Query("selfID"), 10, 64)
-	if err != nil {
+func HandleRobotInfoAll(c *gin.Context, st store.Store) {
+	selfID := c.Query("selfID")
+	if selfID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid selfID"})
 		return
 	}
@@ -384,7 +631,7 @@ func HandleRobotInfoAll(c *gin.Context, db *sql.DB) {
 		return
 	}
 
-	robots, err := sqlite.FetchAllFieldsForRobot(db, selfID, days)
+	robots, err := st.FetchAllFieldsForRobot(selfID, days)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -393,7 +640,7 @@ func HandleRobotInfoAll(c *gin.Context, db *sql.DB) {
 	c.JSON(http.StatusOK, robots)
 }
 
-func HandleApiInfo(c *gin.Context, cfg config.Config, db *sql.DB) {
+func HandleApiInfo(c *gin.Context, cfg config.Config, st store.Store) {
 
 	// Parse days from the query parameter
 	days, err := strconv.Atoi(c.DefaultQuery("days", "7")) // If days is not specified, default to the last 7 days
@@ -403,7 +650,7 @@ func HandleApiInfo(c *gin.Context, cfg config.Config, db *sql.DB) {
 	}
 
 	// Fetch API statuses using the provided function
-	apiStatuses, err := apistats.FetchAPIStatuses(db, cfg, days)
+	apiStatuses, err := apistats.FetchAPIStatuses(st, cfg, days)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -413,9 +660,9 @@ func HandleApiInfo(c *gin.Context, cfg config.Config, db *sql.DB) {
 	c.JSON(http.StatusOK, apiStatuses)
 }
 
-func HandleCommandAll(c *gin.Context, config *config.Config, db *sql.DB) {
-	selfId, err := strconv.ParseInt(c.Query("selfId"), 10, 64)
-	if err != nil {
+func HandleCommandAll(c *gin.Context, config *config.Config, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
 		return
 	}
@@ -426,7 +673,13 @@ func HandleCommandAll(c *gin.Context, config *config.Config, db *sql.DB) {
 		return
 	}
 
-	commands, err := sqlite.FetchTopCommands(db, selfId, rank)
+	scene, err := requestScene(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	commands, err := st.FetchTopCommands(selfId, scene, rank)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -435,27 +688,32 @@ func HandleCommandAll(c *gin.Context, config *config.Config, db *sql.DB) {
 	c.JSON(http.StatusOK, commands)
 }
 
-func HandleCommandDaily(c *gin.Context, config *config.Config, db *sql.DB) {
-	selfId, err := strconv.ParseInt(c.Query("selfId"), 10, 64)
-	if err != nil {
+func HandleCommandDaily(c *gin.Context, config *config.Config, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
 		return
 	}
 
-	dateStr := c.Query("date")
 	rank, err := strconv.Atoi(c.Query("rank"))
 	if err != nil || rank <= 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rank"})
 		return
 	}
 
-	date, err := time.Parse("2006-01-02", dateStr)
+	date, err := requestDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scene, err := requestScene(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, use YYYY-MM-DD"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	commands, err := sqlite.FetchTopDailyCommands(db, selfId, date, rank)
+	commands, err := st.FetchTopDailyCommands(selfId, scene, date, rank)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -464,9 +722,169 @@ func HandleCommandDaily(c *gin.Context, config *config.Config, db *sql.DB) {
 	c.JSON(http.StatusOK, commands)
 }
 
-func HandleGroupAll(c *gin.Context, db *sql.DB) {
-	selfId, err := strconv.ParseInt(c.Query("selfId"), 10, 64)
-	if err != nil || selfId <= 0 {
+// HandleCommandRatio 返回最近几天每天指令与闲聊的消息数和指令占比 可用groupId只看某个群
+func HandleCommandRatio(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid days parameter"})
+		return
+	}
+
+	stats, err := st.FetchDailyCommandRatio(selfId, c.Query("groupId"), days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// HandleCommandRatioGroups 返回指定日期消息最多的几个群的指令与闲聊消息数和指令占比
+func HandleCommandRatioGroups(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	rank, err := strconv.Atoi(c.DefaultQuery("rank", "10"))
+	if err != nil || rank <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rank"})
+		return
+	}
+
+	date, err := requestDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stats, err := st.FetchDailyGroupCommandRatio(selfId, date, rank)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// HandleUserActivity 返回最近几天每天的活跃用户中新用户和老用户的数量
+func HandleUserActivity(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid days parameter"})
+		return
+	}
+
+	stats, err := st.FetchDailyUserActivity(selfId, days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// HandleRetention 返回最近几天每天的新用户的次日 7日和30日留存
+func HandleRetention(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid days parameter"})
+		return
+	}
+
+	cohorts, err := st.FetchCohorts(selfId, days, store.RetentionPeriods)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	stats := make([]structs.Retention, 0, len(cohorts))
+	for _, cohort := range cohorts {
+		stats = append(stats, store.CohortRetention(cohort))
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// HandleCohorts 返回最近几天每天的新用户之后每天仍发言的人数和比例 periods为每行最多的天数
+func HandleCohorts(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid days parameter"})
+		return
+	}
+
+	periods, err := strconv.Atoi(c.DefaultQuery("periods", strconv.Itoa(store.RetentionPeriods)))
+	if err != nil || periods <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid periods parameter"})
+		return
+	}
+
+	cohorts, err := st.FetchCohorts(selfId, days, periods)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, cohorts)
+}
+
+// HandleCommandLatencyDaily 返回指定日期每个指令从用户发出到机器人回复的耗时分布
+func HandleCommandLatencyDaily(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	rank, err := strconv.Atoi(c.Query("rank"))
+	if err != nil || rank <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rank"})
+		return
+	}
+
+	date, err := requestDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	latencies, err := st.FetchDailyCommandLatency(selfId, date, rank)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, latencies)
+}
+
+func HandleGroupAll(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
 		return
 	}
@@ -477,7 +895,13 @@ func HandleGroupAll(c *gin.Context, db *sql.DB) {
 		return
 	}
 
-	groups, err := sqlite.FetchTopGroups(db, selfId, rank)
+	scene, err := requestScene(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	groups, err := st.FetchTopGroups(selfId, scene, rank)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -486,27 +910,32 @@ func HandleGroupAll(c *gin.Context, db *sql.DB) {
 	c.JSON(http.StatusOK, groups)
 }
 
-func HandleGroupDaily(c *gin.Context, db *sql.DB) {
-	selfId, err := strconv.ParseInt(c.Query("selfId"), 10, 64)
-	if err != nil || selfId <= 0 {
+func HandleGroupDaily(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
 		return
 	}
 
-	dateStr := c.Query("date")
 	rank, err := strconv.Atoi(c.Query("rank"))
 	if err != nil || rank <= 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rank"})
 		return
 	}
 
-	date, err := time.Parse("2006-01-02", dateStr)
+	date, err := requestDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scene, err := requestScene(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, use YYYY-MM-DD"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	groups, err := sqlite.FetchTopDailyGroups(db, selfId, date, rank)
+	groups, err := st.FetchTopDailyGroups(selfId, scene, date, rank)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -515,9 +944,9 @@ func HandleGroupDaily(c *gin.Context, db *sql.DB) {
 	c.JSON(http.StatusOK, groups)
 }
 
-func HandleUserAll(c *gin.Context, db *sql.DB) {
-	selfId, err := strconv.ParseInt(c.Query("selfId"), 10, 64)
-	if err != nil {
+func HandleUserAll(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
 		return
 	}
@@ -528,7 +957,13 @@ func HandleUserAll(c *gin.Context, db *sql.DB) {
 		return
 	}
 
-	users, err := sqlite.FetchTopUsers(db, selfId, rank)
+	scene, err := requestScene(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	users, err := st.FetchTopUsers(selfId, scene, rank)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -537,27 +972,32 @@ func HandleUserAll(c *gin.Context, db *sql.DB) {
 	c.JSON(http.StatusOK, users)
 }
 
-func HandleUserDaily(c *gin.Context, db *sql.DB) {
-	selfId, err := strconv.ParseInt(c.Query("selfId"), 10, 64)
-	if err != nil {
+func HandleUserDaily(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
 		return
 	}
 
-	dateStr := c.Query("date")
 	rank, err := strconv.Atoi(c.Query("rank"))
 	if err != nil || rank <= 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rank"})
 		return
 	}
 
-	date, err := time.Parse("2006-01-02", dateStr)
+	date, err := requestDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scene, err := requestScene(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, use YYYY-MM-DD"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	users, err := sqlite.FetchTopDailyUsers(db, selfId, date, rank)
+	users, err := st.FetchTopDailyUsers(selfId, scene, date, rank)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -565,3 +1005,527 @@ func HandleUserDaily(c *gin.Context, db *sql.DB) {
 
 	c.JSON(http.StatusOK, users)
 }
+
+// HandleGroupUserTop 返回机器人某个群内发言最多的用户 带date时为当天的排行
+func HandleGroupUserTop(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	groupId := c.Query("groupId")
+	if selfId == "" || groupId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId or groupId parameter"})
+		return
+	}
+
+	rank, err := strconv.Atoi(c.Query("rank"))
+	if err != nil || rank <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing rank parameter"})
+		return
+	}
+
+	var users []structs.GroupUserStat
+	if c.Query("date") != "" {
+		date, err := requestDate(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		users, err = st.FetchDailyGroupTopUsers(selfId, groupId, date, rank)
+	} else {
+		users, err = st.FetchGroupTopUsers(selfId, groupId, rank)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// HandleUserGroups 返回用户发过言的群 selfId可选 不填返回所有机器人下的群
+func HandleUserGroups(c *gin.Context, st store.Store) {
+	userId := c.Query("userId")
+	if userId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing userId parameter"})
+		return
+	}
+
+	groups, err := st.FetchUserGroups(c.Query("selfId"), userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, groups)
+}
+
+// HandleConnections 返回连接会话记录 selfId可选 不填返回全部机器人 需要登入
+func HandleConnections(c *gin.Context, st store.Store) {
+	// 会话记录包含对端地址 需要登入
+	if !requireLogin(c, st) {
+		return
+	}
+	selfId := c.Query("selfId")
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit parameter"})
+		return
+	}
+
+	sessions, err := st.FetchConnectionSessions(selfId, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// HandleReplyDaily 返回最近days天每天的回复数和回复率
+func HandleReplyDaily(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid days parameter"})
+		return
+	}
+
+	replies, err := st.FetchDailyReplies(selfId, days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, replies)
+}
+
+// HandleReplyCommandDaily 返回指定日期每个指令的回复率
+func HandleReplyCommandDaily(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	rank, err := strconv.Atoi(c.Query("rank"))
+	if err != nil || rank <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rank"})
+		return
+	}
+
+	date, err := requestDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	replies, err := st.FetchDailyCommandReplies(selfId, date, rank)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, replies)
+}
+
+// HandleReplyGroupDaily 返回指定日期每个群的回复数
+func HandleReplyGroupDaily(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	rank, err := strconv.Atoi(c.Query("rank"))
+	if err != nil || rank <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rank"})
+		return
+	}
+
+	date, err := requestDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	replies, err := st.FetchDailyGroupReplies(selfId, date, rank)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, replies)
+}
+
+// HandleActionDaily 返回中继模式下指定日期每个action的耗时和失败率
+func HandleActionDaily(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	date, err := requestDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	actions, err := st.FetchDailyActionStats(selfId, date)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, actions)
+}
+
+// HandleRequestDaily 返回最近几天每种请求的 请求->加入->首条消息 转化数
+func HandleRequestDaily(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid days parameter"})
+		return
+	}
+
+	funnels, err := st.FetchDailyRequestFunnel(selfId, days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, funnels)
+}
+
+// HandleRequests 返回指定日期收到的请求明细
+func HandleRequests(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	date, err := requestDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	requests, err := st.FetchRequestEvents(selfId, date)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// HandleNoticeDaily 返回最近几天每种通知的数量
+func HandleNoticeDaily(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid days parameter"})
+		return
+	}
+
+	stats, err := st.FetchDailyNoticeStats(selfId, days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// HandleNoticeTimeline 返回机器人或某个群最近的通知 可用before翻页
+func HandleNoticeTimeline(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit parameter"})
+		return
+	}
+
+	before, err := strconv.ParseInt(c.DefaultQuery("before", "0"), 10, 64)
+	if err != nil || before < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid before parameter"})
+		return
+	}
+
+	notices, err := st.FetchNoticeTimeline(selfId, c.Query("groupId"), before, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, notices)
+}
+
+// HandleSegmentDaily 返回最近几天每种消息段的数量 可用groupId只看某个群
+func HandleSegmentDaily(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid days parameter"})
+		return
+	}
+
+	stats, err := st.FetchDailySegmentStats(selfId, c.Query("groupId"), days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// HandleHourly 返回某一天24小时的消息数 活跃用户数 活跃群数和指令数
+// 可用groupId查看某个群的消息数 或用command查看某个指令的调用次数 tz不为空时按该时区换算小时
+func HandleHourly(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+	groupId, command := c.Query("groupId"), c.Query("command")
+	if groupId != "" && command != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "groupId and command cannot be used together"})
+		return
+	}
+
+	loc, err := requestLocation(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	date, err := requestDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stats, err := st.FetchHourlyStats(selfId, groupId, command, date, loc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// HandleHourlyWeek 返回最近days天(默认28)按星期几和小时合计的7x24矩阵 tz不为空时按该时区换算
+func HandleHourlyWeek(c *gin.Context, st store.Store) {
+	selfId := c.Query("selfId")
+	if selfId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing selfId parameter"})
+		return
+	}
+	groupId, command := c.Query("groupId"), c.Query("command")
+	if groupId != "" && command != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "groupId and command cannot be used together"})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "28"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid days parameter"})
+		return
+	}
+	loc, err := requestLocation(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	matrix, err := st.FetchWeekHourMatrix(selfId, groupId, command, days, loc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, matrix)
+}
+
+// HandleMessageSearch 按关键词搜索储存的消息 可按机器人 群 用户和日期范围筛选 用offset和limit分页
+func HandleMessageSearch(c *gin.Context, st store.Store) {
+	// 返回的是消息原文 需要登入
+	if !requireLogin(c, st) {
+		return
+	}
+
+	search := structs.MessageSearch{
+		Keyword:   strings.TrimSpace(c.Query("q")),
+		SelfID:    c.Query("selfId"),
+		GroupID:   c.Query("groupId"),
+		UserID:    c.Query("userId"),
+		StartDate: c.Query("startDate"),
+		EndDate:   c.Query("endDate"),
+	}
+	if search.Keyword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or missing q parameter"})
+		return
+	}
+	for _, date := range []string{search.StartDate, search.EndDate} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, use YYYY-MM-DD"})
+			return
+		}
+	}
+
+	var err error
+	search.Limit, err = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(store.DefaultSearchLimit)))
+	if err != nil || search.Limit <= 0 || search.Limit > store.MaxSearchLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid limit parameter, must be 1-%d", store.MaxSearchLimit)})
+		return
+	}
+	search.Offset, err = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || search.Offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset parameter"})
+		return
+	}
+
+	result, err := st.SearchMessages(search)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 请求中的tz参数 如Asia/Shanghai 不填时返回nil 使用配置的统计时区
+func requestLocation(c *gin.Context) (*time.Location, error) {
+	name := c.Query("tz")
+	if name == "" {
+		return nil, nil
+	}
+	loc, err := store.LoadLocation(name)
+	if err != nil {
+		return nil, errors.New("invalid tz parameter")
+	}
+	return loc, nil
+}
+
+// 请求中的date参数 不填时为tz中的今天 日统计按配置的统计时区划分 tz只影响默认的日期
+func requestDate(c *gin.Context) (time.Time, error) {
+	loc, err := requestLocation(c)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if loc == nil {
+		loc = store.Location()
+	}
+	dateStr := c.Query("date")
+	if dateStr == "" {
+		return time.Now().In(loc), nil
+	}
+	date, err := time.ParseInLocation("2006-01-02", dateStr, loc)
+	if err != nil {
+		return time.Time{}, errors.New("invalid date format, use YYYY-MM-DD")
+	}
+	return date, nil
+}
+
+// 请求中的scene参数 private group或guild 不填时统计全部场景
+func requestScene(c *gin.Context) (string, error) {
+	scene := c.Query("scene")
+	if scene == "" {
+		return "", nil
+	}
+	for _, known := range structs.Scenes {
+		if scene == known {
+			return scene, nil
+		}
+	}
+	return "", errors.New("invalid scene, use private, group or guild")
+}
+
+// 是否正在重新统计指令
+var recomputing atomic.Bool
+
+// HandleRecomputeCommands 按当前的指令规则用储存的消息重新统计指令
+func HandleRecomputeCommands(c *gin.Context, st store.Store) {
+	// 会重新读取所有储存的消息 需要登入 同时只运行一次
+	if !requireLogin(c, st) {
+		return
+	}
+	if !recomputing.CompareAndSwap(false, true) {
+		c.JSON(http.StatusConflict, gin.H{"error": "command recompute already in progress"})
+		return
+	}
+	defer recomputing.Store(false)
+
+	result, err := st.RecomputeCommandStats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// HandleStorage 返回每个表的行数 存储占用和保留策略
+func HandleStorage(c *gin.Context, config config.Config, st store.Store) {
+	stats, err := st.FetchStorageStats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"storage":         stats,
+		"retainRawDays":   config.RetainRawDays,
+		"retainDailyDays": config.RetainDailyDays,
+		"pruneInterval":   config.PruneIntervalMin,
+	})
+}
+
+// HandlePrune 立即按配置的保留策略清理一次过期数据
+func HandlePrune(c *gin.Context, config config.Config, st store.Store) {
+	// 会删除数据 需要登入
+	if !requireLogin(c, st) {
+		return
+	}
+
+	result, err := st.Prune(store.PolicyFromConfig(config))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// HandleWriteQueue 返回异步写入队列的积压和丢弃情况
+func HandleWriteQueue(c *gin.Context, st store.Store) {
+	stats := st.FetchWriterStats()
+	if stats == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "async writer not running"})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
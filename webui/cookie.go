@@ -1,12 +1,12 @@
 package webui
 
 import (
-	"database/sql"
 	"errors"
 	"log"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/hoshinonyaruko/gensokyo-dashboard/store"
 )
 
 var ErrCookieNotFound = errors.New("cookie not found")
@@ -14,11 +14,11 @@ var ErrCookieExpired = errors.New("cookie has expired")
 
 const ExpirationHours = 30 * 24 // Cookie 有效期改为一个月
 
-func GenerateCookie(db *sql.DB) (string, error) {
+func GenerateCookie(st store.Store) (string, error) {
 	cookie := uuid.New().String()
 	expiration := time.Now().Add(ExpirationHours * time.Hour).Unix()
 
-	_, err := db.Exec("INSERT INTO cookies (cookie_id, expiration) VALUES (?, ?)", cookie, expiration)
+	err := st.SaveCookie(cookie, expiration)
 	if err != nil {
 		log.Fatalf("Failed to insert new cookie: %v", err)
 		return "", err
@@ -26,11 +26,10 @@ func GenerateCookie(db *sql.DB) (string, error) {
 	return cookie, nil
 }
 
-func ValidateCookie(db *sql.DB, cookie string) (bool, error) {
-	var expiration int64
-	err := db.QueryRow("SELECT expiration FROM cookies WHERE cookie_id = ?", cookie).Scan(&expiration)
+func ValidateCookie(st store.Store, cookie string) (bool, error) {
+	expiration, err := st.FetchCookieExpiration(cookie)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == store.ErrNotFound {
 			return false, ErrCookieNotFound
 		}
 		log.Fatalf("Failed to query cookie: %v", err)